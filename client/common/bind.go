@@ -0,0 +1,70 @@
+package common
+
+import (
+	"fmt"
+	"net"
+)
+
+// LocalIP resolves AppState.BindAddress, an IP address or a network interface name, to the
+// address torrent traffic is bound to. An interface's first IPv4 address is preferred. It
+// returns nil when no bind address is configured.
+func LocalIP() (net.IP, error) {
+	if AppState.BindAddress == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(AppState.BindAddress); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(AppState.BindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("bind address %q is neither an IP address nor an interface: %w", AppState.BindAddress, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", iface.Name)
+	}
+	return found, nil
+}
+
+// ApplyBindAddress binds outgoing peer and tracker connections to the bind address, resolved
+// again for every connection so that an interface changing address is followed. While it cannot
+// be resolved, e.g. the interface is down, connections are refused rather than left unbound,
+// and the error is returned for the first resolution.
+func ApplyBindAddress() error {
+	if AppState.BindAddress == "" {
+		AppState.Proxy.SetLocalIP(nil)
+		return nil
+	}
+	AppState.Proxy.SetLocalIP(LocalIP)
+	_, err := LocalIP()
+	return err
+}
+
+// ListenAddr returns the host:port peers are accepted on
+func ListenAddr(port uint16) (string, error) {
+	ip, err := LocalIP()
+	if err != nil {
+		return "", err
+	}
+	host := ""
+	if ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
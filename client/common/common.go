@@ -1,18 +1,68 @@
 package common
 
 import (
+	"client/connlimit"
+	"client/ipfilter"
+	"client/proxy"
+	"client/ratelimit"
+	"client/scheduler"
+	"crypto/tls"
 	"fmt"
 	"math/rand"
+	"net"
 )
 
 var AppState struct {
 	PeerID                [20]byte
 	Port                  uint16
-	IsTrafficAESEncrypted bool
+	Encryption            EncryptionMode     // Encryption used for outgoing connections, AES, MSE or TLS
+	EncryptionPolicy      EncryptionPolicy   // Whether connections may, must or must not be encrypted
+	MSEAllowPlaintext     bool               // Offer and accept MSE's plaintext method besides RC4
+	TLSCertFile           string             // PEM certificate presented by the TLS transport
+	TLSKeyFile            string             // PEM private key of TLSCertFile
+	TLSCAFile             string             // PEM CA that peer certificates must chain to
+	TLS                   *tls.Config        // Built by LoadTLS, nil when the TLS transport is not configured
+	UploadLimiter         *ratelimit.Limiter // Session-wide upload cap
+	DownloadLimiter       *ratelimit.Limiter // Session-wide download cap
+	UploadRate            int64              // Configured session upload cap, applied when no schedule rule is active
+	DownloadRate          int64              // Configured session download cap, applied when no schedule rule is active
+	PeerUploadRate        int64              // Upload cap for each new peer connection, 0 is unlimited
+	PeerDownloadRate      int64              // Download cap for each new peer connection, 0 is unlimited
+	Schedule              scheduler.Schedule // Time-of-day bandwidth schedule
+	Connections           *connlimit.Group   // Established peer connections across all torrents
+	HalfOpen              *connlimit.Group   // Outgoing dials that have not completed their handshake
+	ConnectionsPerIP      *connlimit.IPGroup // Established peer connections to each remote IP
+	MaxTorrentConnections int                // Cap on established connections of each new torrent, 0 is unlimited
+	VerifyPeerIDs         bool               // Ask trackers for peer IDs and drop peers whose handshake does not match
+	IPFilter              *ipfilter.Filter   // Blocklist consulted before dialing or accepting a peer
+	EnableUTP             bool               // Accept uTP peers and try uTP before TCP when dialing
+	Proxy                 *proxy.Dialer      // Routes tracker requests and outgoing peer connections
+	EnableLSD             bool               // Announce torrents and find peers on the local network (BEP 14)
+	LSDInterface          string             // Network interface LSD multicasts on, empty for the system default
+	BindAddress           string             // IP address or interface name torrent traffic is bound to, empty for any
+	PieceFiles            bool               // Keep new downloads as a directory with a file per piece
 }
 
 func InitAppState() {
 	AppState.Port = 6881
 	copy(AppState.PeerID[:], []byte(fmt.Sprintf("-GT001-%012d", rand.Int63())))
-	AppState.IsTrafficAESEncrypted = true
+	AppState.Encryption = EncryptionAES
+	AppState.EncryptionPolicy = PolicyPrefer
+	AppState.UploadLimiter = ratelimit.New(0)
+	AppState.DownloadLimiter = ratelimit.New(0)
+	AppState.Connections = connlimit.NewGroup(200)
+	AppState.HalfOpen = connlimit.NewGroup(20)
+	AppState.ConnectionsPerIP = connlimit.NewIPGroup(4)
+	AppState.MaxTorrentConnections = 50
+	AppState.IPFilter = ipfilter.New()
+	AppState.EnableUTP = true
+	AppState.EnableLSD = true
+	AppState.Proxy = proxy.NewDialer()
+}
+
+// NewPeerConn wraps a peer connection with the session limiters and a fresh per-peer limiter
+func NewPeerConn(conn net.Conn) *ratelimit.Conn {
+	c := ratelimit.NewConn(conn, AppState.DownloadLimiter, AppState.UploadLimiter)
+	c.Attach(ratelimit.New(AppState.PeerDownloadRate), ratelimit.New(AppState.PeerUploadRate))
+	return c
 }
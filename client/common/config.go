@@ -0,0 +1,165 @@
+package common
+
+import (
+	"client/proxy"
+	"client/scheduler"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Config is the part of AppState that is persisted between runs
+type Config struct {
+	Port             uint16             `json:"port"`
+	UploadRate       int64              `json:"upload_rate"`
+	DownloadRate     int64              `json:"download_rate"`
+	PeerUploadRate   int64              `json:"peer_upload_rate"`
+	PeerDownloadRate int64              `json:"peer_download_rate"`
+	Schedule         scheduler.Schedule `json:"schedule"`
+	MaxConnections   int                `json:"max_connections"`
+	MaxHalfOpen      int                `json:"max_half_open"`
+	MaxPerIP         int                `json:"max_connections_per_ip"`
+	MaxPerTorrent    int                `json:"max_connections_per_torrent"`
+	Encryption       EncryptionMode     `json:"encryption"`
+	EncryptionPolicy EncryptionPolicy   `json:"encryption_policy"`
+	MSEPlaintext     bool               `json:"mse_allow_plaintext"`
+	TLSCertFile      string             `json:"tls_cert_file"`
+	TLSKeyFile       string             `json:"tls_key_file"`
+	TLSCAFile        string             `json:"tls_ca_file"`
+	VerifyPeerIDs    bool               `json:"verify_peer_ids"`
+	IPFilter         string             `json:"ip_filter"` // Path of an ipfilter.dat or P2P blocklist
+	EnableUTP        bool               `json:"enable_utp"`
+	Proxy            proxy.Config       `json:"proxy"`
+	EnableLSD        bool               `json:"enable_lsd"`
+	LSDInterface     string             `json:"lsd_interface"`
+	BindAddress      string             `json:"bind_address"` // IP address or interface name
+	PieceFiles       bool               `json:"piece_files"`
+}
+
+// ConfigDir returns the directory the client keeps its persistent state in
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gotorrent"), nil
+}
+
+func configPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// currentConfig snapshots the persisted fields of AppState
+func currentConfig() Config {
+	return Config{
+		Port:             AppState.Port,
+		UploadRate:       AppState.UploadRate,
+		DownloadRate:     AppState.DownloadRate,
+		PeerUploadRate:   AppState.PeerUploadRate,
+		PeerDownloadRate: AppState.PeerDownloadRate,
+		Schedule:         AppState.Schedule,
+		MaxConnections:   AppState.Connections.Max(),
+		MaxHalfOpen:      AppState.HalfOpen.Max(),
+		MaxPerIP:         AppState.ConnectionsPerIP.Max(),
+		MaxPerTorrent:    AppState.MaxTorrentConnections,
+		Encryption:       AppState.Encryption,
+		EncryptionPolicy: AppState.EncryptionPolicy,
+		MSEPlaintext:     AppState.MSEAllowPlaintext,
+		TLSCertFile:      AppState.TLSCertFile,
+		TLSKeyFile:       AppState.TLSKeyFile,
+		TLSCAFile:        AppState.TLSCAFile,
+		VerifyPeerIDs:    AppState.VerifyPeerIDs,
+		IPFilter:         AppState.IPFilter.Path(),
+		EnableUTP:        AppState.EnableUTP,
+		Proxy:            AppState.Proxy.Config(),
+		EnableLSD:        AppState.EnableLSD,
+		LSDInterface:     AppState.LSDInterface,
+		BindAddress:      AppState.BindAddress,
+		PieceFiles:       AppState.PieceFiles,
+	}
+}
+
+// applyConfig copies a loaded config into AppState
+func applyConfig(cfg *Config) {
+	if cfg.Port != 0 {
+		AppState.Port = cfg.Port
+	}
+	AppState.UploadRate = cfg.UploadRate
+	AppState.DownloadRate = cfg.DownloadRate
+	AppState.PeerUploadRate = cfg.PeerUploadRate
+	AppState.PeerDownloadRate = cfg.PeerDownloadRate
+	AppState.Schedule = cfg.Schedule
+	AppState.UploadLimiter.SetRate(cfg.UploadRate)
+	AppState.DownloadLimiter.SetRate(cfg.DownloadRate)
+	AppState.Connections.SetMax(cfg.MaxConnections)
+	AppState.HalfOpen.SetMax(cfg.MaxHalfOpen)
+	AppState.ConnectionsPerIP.SetMax(cfg.MaxPerIP)
+	AppState.MaxTorrentConnections = cfg.MaxPerTorrent
+	AppState.Encryption = cfg.Encryption
+	if cfg.EncryptionPolicy != PolicyDefault {
+		AppState.EncryptionPolicy = cfg.EncryptionPolicy
+	}
+	if cfg.Encryption == EncryptionNone {
+		// The method must be a real one, or the policy would try plaintext twice
+		AppState.Encryption = EncryptionAES
+		if cfg.EncryptionPolicy == PolicyDefault {
+			// A config from before encryption policies, where "OFF" meant a disabled policy
+			AppState.EncryptionPolicy = PolicyDisabled
+		}
+	}
+	AppState.MSEAllowPlaintext = cfg.MSEPlaintext
+	AppState.TLSCertFile = cfg.TLSCertFile
+	AppState.TLSKeyFile = cfg.TLSKeyFile
+	AppState.TLSCAFile = cfg.TLSCAFile
+	AppState.VerifyPeerIDs = cfg.VerifyPeerIDs
+	AppState.EnableUTP = cfg.EnableUTP
+	AppState.Proxy.Configure(cfg.Proxy)
+	AppState.EnableLSD = cfg.EnableLSD
+	AppState.LSDInterface = cfg.LSDInterface
+	AppState.BindAddress = cfg.BindAddress
+	AppState.PieceFiles = cfg.PieceFiles
+}
+
+// LoadConfig reads the saved configuration into AppState. A missing file leaves the defaults.
+func LoadConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cfg := currentConfig()
+	cfg.EncryptionPolicy = PolicyDefault // Left so by configs from before encryption policies
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	applyConfig(&cfg)
+	return errors.Join(LoadTLS(), AppState.IPFilter.Load(cfg.IPFilter), ApplyBindAddress())
+}
+
+// SaveConfig writes the persisted fields of AppState to disk
+func SaveConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(currentConfig(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
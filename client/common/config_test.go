@@ -0,0 +1,69 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig points the config directory at a temporary one holding data as config.json
+func writeConfig(t *testing.T, data string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	if err := os.MkdirAll(filepath.Join(dir, "gotorrent"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "gotorrent", "config.json"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigEncryption(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantMode   EncryptionMode
+		wantPolicy EncryptionPolicy
+	}{
+		{"old config with encryption off", `{"encryption": "OFF"}`, EncryptionAES, PolicyDisabled},
+		{"old config with AES", `{"encryption": "AES"}`, EncryptionAES, PolicyPrefer},
+		{"old config with MSE", `{"encryption": "MSE"}`, EncryptionMSE, PolicyPrefer},
+		{"required policy", `{"encryption": "MSE", "encryption_policy": "REQUIRE"}`, EncryptionMSE, PolicyRequire},
+		{"disabled policy", `{"encryption": "AES", "encryption_policy": "DISABLED"}`, EncryptionAES, PolicyDisabled},
+		{"policy with encryption off", `{"encryption": "OFF", "encryption_policy": "REQUIRE"}`, EncryptionAES, PolicyRequire},
+		{"policy left to the default", `{"encryption": "AES", "encryption_policy": "DEFAULT"}`, EncryptionAES, PolicyPrefer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitAppState()
+			writeConfig(t, tt.config)
+			if err := LoadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if AppState.Encryption != tt.wantMode || AppState.EncryptionPolicy != tt.wantPolicy {
+				t.Errorf("loaded %v with %v, want %v with %v", AppState.Encryption, AppState.EncryptionPolicy,
+					tt.wantMode, tt.wantPolicy)
+			}
+		})
+	}
+}
+
+func TestSaveConfigKeepsPolicy(t *testing.T) {
+	for _, policy := range []EncryptionPolicy{PolicyDisabled, PolicyPrefer, PolicyRequire} {
+		InitAppState()
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		AppState.Encryption = EncryptionMSE
+		AppState.EncryptionPolicy = policy
+		if err := SaveConfig(); err != nil {
+			t.Fatal(err)
+		}
+		InitAppState()
+		if err := LoadConfig(); err != nil {
+			t.Fatal(err)
+		}
+		if AppState.Encryption != EncryptionMSE || AppState.EncryptionPolicy != policy {
+			t.Errorf("saved MSE with %v, loaded %v with %v", policy, AppState.Encryption, AppState.EncryptionPolicy)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"client/mse"
+	"fmt"
+)
+
+// EncryptionMode is a way of protecting a peer connection
+type EncryptionMode int
+
+const (
+	EncryptionNone EncryptionMode = iota // Plain BitTorrent protocol
+	EncryptionAES                        // This client's own AES transport
+	EncryptionMSE                        // Standard Message Stream Encryption, understood by other clients
+	EncryptionTLS                        // TLS with certificates from a shared CA, see LoadTLS
+)
+
+var encryptionNames = []string{"OFF", "AES", "MSE", "TLS"}
+
+func (m EncryptionMode) String() string {
+	if m < 0 || int(m) >= len(encryptionNames) {
+		return fmt.Sprintf("EncryptionMode(%d)", int(m))
+	}
+	return encryptionNames[m]
+}
+
+func (m EncryptionMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *EncryptionMode) UnmarshalText(text []byte) error {
+	for i, name := range encryptionNames {
+		if name == string(text) {
+			*m = EncryptionMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encryption mode %q", text)
+}
+
+// EncryptionPolicy decides whether peer connections may, must or must not be encrypted
+type EncryptionPolicy int
+
+const (
+	PolicyDefault  EncryptionPolicy = iota // Use the session policy, only meaningful for a torrent
+	PolicyDisabled                         // Plaintext connections only
+	PolicyPrefer                           // Try encryption first, fall back to plaintext
+	PolicyRequire                          // Encrypted connections only
+)
+
+var policyNames = []string{"DEFAULT", "DISABLED", "PREFER", "REQUIRE"}
+
+func (p EncryptionPolicy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+func (p EncryptionPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *EncryptionPolicy) UnmarshalText(text []byte) error {
+	for i, name := range policyNames {
+		if name == string(text) {
+			*p = EncryptionPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encryption policy %q", text)
+}
+
+// ParseEncryptionPolicy converts a name from String back into a policy
+func ParseEncryptionPolicy(name string) (EncryptionPolicy, error) {
+	var p EncryptionPolicy
+	err := p.UnmarshalText([]byte(name))
+	return p, err
+}
+
+// Resolve replaces PolicyDefault with the session policy
+func (p EncryptionPolicy) Resolve() EncryptionPolicy {
+	if p == PolicyDefault {
+		return AppState.EncryptionPolicy
+	}
+	return p
+}
+
+// Next returns the session policy after p, wrapping around, for cycling through policies in the GUI
+func (p EncryptionPolicy) Next() EncryptionPolicy {
+	if p >= PolicyRequire {
+		return PolicyDisabled
+	}
+	return p + 1
+}
+
+// Allows tells if a connection that is (or is not) encrypted is acceptable
+func (p EncryptionPolicy) Allows(encrypted bool) bool {
+	switch p.Resolve() {
+	case PolicyDisabled:
+		return !encrypted
+	case PolicyRequire:
+		return encrypted
+	default:
+		return true
+	}
+}
+
+// OutboundModes returns the modes to try, in order, when connecting to a peer with method as
+// the preferred encryption
+func (p EncryptionPolicy) OutboundModes(method EncryptionMode) []EncryptionMode {
+	switch p.Resolve() {
+	case PolicyDisabled:
+		return []EncryptionMode{EncryptionNone}
+	case PolicyRequire:
+		return []EncryptionMode{method}
+	default:
+		return []EncryptionMode{method, EncryptionNone}
+	}
+}
+
+// MSEMethods returns the MSE crypto methods we offer and accept
+func MSEMethods() mse.CryptoMethod {
+	if AppState.MSEAllowPlaintext {
+		return mse.CryptoRC4 | mse.CryptoPlaintext
+	}
+	return mse.CryptoRC4
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"client/protocolconn"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LoadTLS builds AppState.TLS from the configured certificate, key and CA files.
+// With no files configured the TLS transport is disabled and AppState.TLS is nil.
+func LoadTLS() error {
+	AppState.TLS = nil
+	if AppState.TLSCertFile == "" && AppState.TLSKeyFile == "" && AppState.TLSCAFile == "" {
+		return nil
+	}
+	if AppState.TLSCertFile == "" || AppState.TLSKeyFile == "" || AppState.TLSCAFile == "" {
+		return errors.New("the TLS transport needs a certificate, a key and a CA certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(AppState.TLSCertFile, AppState.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	caPEM, err := os.ReadFile(AppState.TLSCAFile)
+	if err != nil {
+		return err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", AppState.TLSCAFile)
+	}
+	AppState.TLS = protocolconn.NewTLSConfig(cert, ca)
+	return nil
+}
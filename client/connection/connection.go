@@ -3,10 +3,15 @@ package connection
 import (
 	"bytes"
 	"client/bitfield"
+	"client/common"
 	"client/handshake"
 	"client/message"
+	"client/mse"
 	"client/peer"
 	"client/protocolconn"
+	"client/ratelimit"
+	"client/utp"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -14,18 +19,49 @@ import (
 
 // Connection represents a client connection.
 type Connection struct {
-	Conn     net.Conn                   // Underlying TCP connection
-	EncConn  *protocolconn.ProtocolConn // Encrypted connection for protocol communication
-	Choked   bool
-	Bitfield bitfield.Bitfield
-	peer     peer.Peer
-	infoHash *[20]byte
-	peerID   *[20]byte
+	Conn       net.Conn                   // Underlying TCP connection
+	EncConn    *protocolconn.ProtocolConn // Encrypted connection for protocol communication
+	Encryption common.EncryptionMode      // The mode the connection was established with
+	UTP        bool                       // The connection runs over uTP rather than TCP
+	RemoteID   *[20]byte                  // The peer ID from the peer's handshake
+	RemoteUTP  bool                       // The peer's handshake advertises uTP support
+	Choked     bool
+	Bitfield   bitfield.Bitfield
+	maxLength  uint32 // Longest message accepted from the peer
+	peer       peer.Peer
+	infoHash   *[20]byte
+	peerID     *[20]byte
+}
+
+var (
+	// ErrSelfConnection is returned when the handshake carries our own peer ID
+	ErrSelfConnection = errors.New("connected to ourselves")
+	// ErrPeerIDMismatch is returned when the handshake's peer ID differs from the tracker's
+	ErrPeerIDMismatch = errors.New("peer ID does not match the tracker")
+)
+
+// DialTimeout bounds each transport's connection attempt
+const DialTimeout = 3 * time.Second
+
+// HandshakeTimeout bounds the encryption preamble, handshake and bitfield exchange
+const HandshakeTimeout = 10 * time.Second
+
+// Options controls how a connection to a peer is established
+type Options struct {
+	Encryption       common.EncryptionMode   // Preferred encryption, AES or MSE
+	Policy           common.EncryptionPolicy // Whether to encrypt, and whether to retry in plaintext
+	SwarmSecret      []byte                  // Private swarm secret, forces the AES transport when set
+	MaxMessageLength uint32                  // Longest message accepted, see message.MaxLength; 0 allows a block
+	VerifyPeerID     bool                    // Reject the peer if its handshake ID differs from peer.ID
+	UTP              *utp.Socket             // Try uTP from this socket before TCP, nil for TCP only
+	DownloadLimiter  *ratelimit.Limiter      // Torrent download cap, may be nil
+	UploadLimiter    *ratelimit.Limiter      // Torrent upload cap, may be nil
 }
 
 func completeHandshake(rw *protocolconn.ProtocolConn, infohash, peerID *[20]byte) (*handshake.Handshake, error) {
 	// Use ReadWriter for handshake
 	req := handshake.New(infohash, peerID)
+	req.SetUTP(common.AppState.EnableUTP)
 	// log.Printf("created handshake - %v", req)
 	pstrlen := []byte{byte(len(req.Pstr))}
 	_, err := rw.RawReadWriter.Write(pstrlen)
@@ -49,11 +85,14 @@ func completeHandshake(rw *protocolconn.ProtocolConn, infohash, peerID *[20]byte
 	if !bytes.Equal(resp.InfoHash[:], infohash[:]) {
 		return nil, fmt.Errorf("expected infohash %x but got %x", resp.InfoHash, infohash)
 	}
+	if *resp.PeerID == *peerID {
+		return nil, ErrSelfConnection
+	}
 	return resp, nil
 }
 
-func recvBitfield(rw *protocolconn.ProtocolConn) (bitfield.Bitfield, error) {
-	msg, err := message.Read(rw)
+func recvBitfield(rw *protocolconn.ProtocolConn, maxLength uint32) (bitfield.Bitfield, error) {
+	msg, err := message.Read(rw, maxLength)
 	if err != nil {
 		return nil, err
 	}
@@ -68,75 +107,140 @@ func recvBitfield(rw *protocolconn.ProtocolConn) (bitfield.Bitfield, error) {
 	return msg.Payload, nil
 }
 
-func New(peer peer.Peer, peerID *[20]byte, infoHash *[20]byte, encrypted bool) (*Connection, error) {
-	// log.Printf("[Connection] Attempting to connect to peer: %s", peer.String())
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
-	if err != nil {
-		// log.Printf("[Connection] Failed to connect to peer: %s, error: %v", peer.String(), err)
-		return nil, err
-	}
-	var encConn *protocolconn.ProtocolConn = &protocolconn.ProtocolConn{
-		EncryptedReader: conn,
-		EncryptedWriter: conn,
-		RawReadWriter:   conn,
-	}
-	if encrypted {
-		// log.Printf("[Connection] Starting encryption handshake with peer: %s", peer.String())
-		// --- Encryption handshake: send key/iv ---
-		key, iv, err := protocolconn.GenerateRandomKeyIV()
+// setupEncryption runs the initiating side of the encryption preamble selected by mode
+func setupEncryption(conn net.Conn, mode common.EncryptionMode, infoHash *[20]byte,
+	secret []byte) (*protocolconn.ProtocolConn, error) {
+	switch mode {
+	case common.EncryptionAES:
+		// log.Printf("[Connection] Starting key exchange with peer: %s", conn.RemoteAddr())
+		return protocolconn.Initiate(conn, protocolconn.Swarm{InfoHash: *infoHash, Secret: secret})
+	case common.EncryptionMSE:
+		mseConn, err := mse.Initiate(conn, *infoHash, common.MSEMethods())
 		if err != nil {
-			// log.Printf("[Connection] Failed to generate key/iv: %v", err)
-			conn.Close()
 			return nil, err
 		}
-		if _, err := conn.Write(key); err != nil {
-			// log.Printf("[Connection] Failed to send key: %v", err)
-			conn.Close()
-			return nil, err
+		return protocolconn.NewStream(mseConn), nil
+	case common.EncryptionTLS:
+		if common.AppState.TLS == nil {
+			return nil, errors.New("the TLS transport is not configured")
 		}
-		if _, err := conn.Write(iv); err != nil {
-			// log.Printf("[Connection] Failed to send iv: %v", err)
-			conn.Close()
-			return nil, err
+		return protocolconn.InitiateTLS(conn, common.AppState.TLS)
+	default:
+		return protocolconn.NewStream(conn), nil
+	}
+}
+
+// outboundModes returns the encryption modes to try, in order
+func (opts Options) outboundModes() []common.EncryptionMode {
+	if len(opts.SwarmSecret) > 0 {
+		// Only the AES key exchange can prove knowledge of the secret
+		return []common.EncryptionMode{common.EncryptionAES}
+	}
+	return opts.Policy.OutboundModes(opts.Encryption)
+}
+
+// New connects to a peer, trying each encryption mode the policy allows until one succeeds
+func New(peer peer.Peer, peerID *[20]byte, infoHash *[20]byte, opts Options) (*Connection, error) {
+	var err error
+	for _, mode := range opts.outboundModes() {
+		var c *Connection
+		var dialed bool
+		c, dialed, err = connect(peer, peerID, infoHash, mode, &opts)
+		if err == nil {
+			return c, nil
 		}
-		encConn, err = protocolconn.New(conn, key, key, iv, iv)
-		if err != nil {
-			// log.Printf("[Connection] Failed to wrap conn with AES: %v", err)
-			conn.Close()
+		if !dialed || errors.Is(err, ErrSelfConnection) || errors.Is(err, ErrPeerIDMismatch) {
+			// The peer is unreachable or not who we want, another mode will not help
 			return nil, err
 		}
+		// log.Printf("[Connection] %s connection to %s failed, trying the next mode: %v", mode, peer.String(), err)
+	}
+	return nil, err
+}
+
+// dial connects over uTP when opts.UTP is set, falling back to TCP. A failed uTP attempt clears
+// opts.UTP so that retries go straight to TCP.
+func dial(peer peer.Peer, opts *Options) (conn net.Conn, overUTP bool, err error) {
+	if opts.UTP != nil {
+		conn, err := opts.UTP.Dial(peer.String(), DialTimeout)
+		if err == nil {
+			return conn, true, nil
+		}
+		// log.Printf("[Connection] uTP failed for %s, falling back to TCP: %v", peer.String(), err)
+		opts.UTP = nil
+	}
+	conn, err = common.AppState.Proxy.DialTimeout("tcp", peer.String(), DialTimeout)
+	return conn, false, err
+}
+
+// connect makes a single connection attempt with the given encryption mode.
+// dialed reports whether the peer accepted the connection.
+func connect(peer peer.Peer, peerID *[20]byte, infoHash *[20]byte, mode common.EncryptionMode,
+	opts *Options) (c *Connection, dialed bool, err error) {
+	// log.Printf("[Connection] Attempting to connect to peer: %s", peer.String())
+	rawConn, overUTP, err := dial(peer, opts)
+	if err != nil {
+		// log.Printf("[Connection] Failed to connect to peer: %s, error: %v", peer.String(), err)
+		return nil, false, err
+	}
+	limitedConn := common.NewPeerConn(rawConn)
+	limitedConn.Attach(opts.DownloadLimiter, opts.UploadLimiter)
+	var conn net.Conn = limitedConn
+	// Bound the whole setup so a silent peer cannot stall the worker
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	encConn, err := setupEncryption(conn, mode, infoHash, opts.SwarmSecret)
+	if err != nil {
+		// log.Printf("[Connection] Encryption setup failed with peer: %s, error: %v", peer.String(), err)
+		conn.Close()
+		return nil, true, err
 	}
 	// Use bufRW for handshake and bitfield
 	// log.Printf("[Connection] Performing handshake with peer: %s", peer.String())
-	if _, err = completeHandshake(encConn, infoHash, peerID); err != nil {
+	resp, err := completeHandshake(encConn, infoHash, peerID)
+	if err != nil {
 		// log.Printf("[Connection] Handshake failed with peer: %s, error: %v", peer.String(), err)
 		conn.Close()
-		return nil, err
+		return nil, true, err
+	}
+	if opts.VerifyPeerID && peer.ID != nil && *peer.ID != *resp.PeerID {
+		conn.Close()
+		return nil, true, fmt.Errorf("%w: expected %x, got %x", ErrPeerIDMismatch, *peer.ID, *resp.PeerID)
 	}
 
 	// log.Printf("[Connection] Receiving bitfield from peer: %s", peer.String())
-	bf, err := recvBitfield(encConn)
+	maxLength := opts.MaxMessageLength
+	if maxLength == 0 {
+		maxLength = message.MaxLength(0)
+	}
+	bf, err := recvBitfield(encConn, maxLength)
 	if err != nil {
 		// log.Printf("[Connection] Failed to receive bitfield from peer: %s, error: %v", peer.String(), err)
 		conn.Close()
-		return nil, err
+		return nil, true, err
 	}
 
 	// log.Printf("[Connection] Connection established with peer: %s", peer.String())
 	return &Connection{
-		Conn:     conn,
-		EncConn:  encConn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+		Conn:       conn,
+		EncConn:    encConn,
+		Encryption: mode,
+		UTP:        overUTP,
+		RemoteID:   resp.PeerID,
+		RemoteUTP:  resp.UTP(),
+		Choked:     true,
+		Bitfield:   bf,
+		maxLength:  maxLength,
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+	}, true, nil
 }
 
 func (c *Connection) Read() (*message.Message, error) {
 	// // log.Printf("[Connection] Reading message from peer: %s", c.peer.String())
-	return message.Read(c.EncConn)
+	return message.Read(c.EncConn, c.maxLength)
 }
 
 func (c *Connection) SendUnchoke() error {
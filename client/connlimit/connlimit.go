@@ -0,0 +1,156 @@
+package connlimit
+
+import (
+	"net"
+	"sync"
+)
+
+// Group caps the number of connections counted against it. A max of 0 means unlimited.
+type Group struct {
+	mu   sync.Mutex
+	max  int
+	open int
+}
+
+// NewGroup creates a group allowing max connections
+func NewGroup(max int) *Group {
+	return &Group{max: max}
+}
+
+// TryAcquire takes a place in the group if one is free
+func (g *Group) TryAcquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.max > 0 && g.open >= g.max {
+		return false
+	}
+	g.open++
+	return true
+}
+
+// Release frees a place taken by TryAcquire
+func (g *Group) Release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.open > 0 {
+		g.open--
+	}
+}
+
+// Full tells if no place is currently free
+func (g *Group) Full() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max > 0 && g.open >= g.max
+}
+
+// Open returns the number of places taken
+func (g *Group) Open() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.open
+}
+
+// Max returns the cap, 0 meaning unlimited
+func (g *Group) Max() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+// SetMax changes the cap. Connections above a lowered cap are kept until they close.
+func (g *Group) SetMax(max int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.max = max
+}
+
+// IPGroup caps the number of connections to each remote IP. A max of 0 means unlimited.
+type IPGroup struct {
+	mu   sync.Mutex
+	max  int
+	open map[string]int
+}
+
+// NewIPGroup creates a group allowing max connections per IP
+func NewIPGroup(max int) *IPGroup {
+	return &IPGroup{max: max, open: make(map[string]int)}
+}
+
+// TryAcquire takes a place for ip if it has one free
+func (g *IPGroup) TryAcquire(ip net.IP) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := ip.String()
+	if g.max > 0 && g.open[key] >= g.max {
+		return false
+	}
+	g.open[key]++
+	return true
+}
+
+// Release frees a place taken for ip
+func (g *IPGroup) Release(ip net.IP) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := ip.String()
+	if g.open[key] <= 1 {
+		delete(g.open, key)
+		return
+	}
+	g.open[key]--
+}
+
+// Max returns the per-IP cap, 0 meaning unlimited
+func (g *IPGroup) Max() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+// SetMax changes the per-IP cap
+func (g *IPGroup) SetMax(max int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.max = max
+}
+
+// Slot is a connection's place in an IP group and any number of groups, released together
+type Slot struct {
+	once   sync.Once
+	ip     net.IP
+	ips    *IPGroup
+	groups []*Group
+}
+
+// Acquire takes a place for ip in ips and in every group, or in none of them.
+// ips may be nil when no per-IP cap applies.
+func Acquire(ip net.IP, ips *IPGroup, groups ...*Group) (*Slot, bool) {
+	if ips != nil && !ips.TryAcquire(ip) {
+		return nil, false
+	}
+	for i, g := range groups {
+		if !g.TryAcquire() {
+			for _, taken := range groups[:i] {
+				taken.Release()
+			}
+			if ips != nil {
+				ips.Release(ip)
+			}
+			return nil, false
+		}
+	}
+	return &Slot{ip: ip, ips: ips, groups: groups}, true
+}
+
+// Release frees every place held by the slot. It is safe to call more than once.
+func (s *Slot) Release() {
+	s.once.Do(func() {
+		for _, g := range s.groups {
+			g.Release()
+		}
+		if s.ips != nil {
+			s.ips.Release(s.ip)
+		}
+	})
+}
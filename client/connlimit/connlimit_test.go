@@ -0,0 +1,126 @@
+package connlimit
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		acquire  int
+		release  int
+		want     int
+		wantFull bool
+	}{
+		{"unlimited", 0, 100, 0, 100, false},
+		{"below cap", 3, 2, 0, 2, false},
+		{"at cap", 3, 3, 0, 3, true},
+		{"over cap", 3, 5, 0, 3, true},
+		{"released", 3, 5, 1, 2, false},
+		{"released too often", 3, 1, 4, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGroup(tt.max)
+			for range tt.acquire {
+				g.TryAcquire()
+			}
+			for range tt.release {
+				g.Release()
+			}
+			if got := g.Open(); got != tt.want {
+				t.Errorf("Open() = %d, want %d", got, tt.want)
+			}
+			if got := g.Full(); got != tt.wantFull {
+				t.Errorf("Full() = %v, want %v", got, tt.wantFull)
+			}
+		})
+	}
+}
+
+// TestHalfOpen checks that lowering the cap keeps the connections already open
+func TestHalfOpen(t *testing.T) {
+	g := NewGroup(4)
+	for range 4 {
+		g.TryAcquire()
+	}
+	g.SetMax(2)
+	if got := g.Open(); got != 4 {
+		t.Errorf("Open() = %d after lowering the cap, want 4", got)
+	}
+	g.Release()
+	g.Release()
+	if g.TryAcquire() {
+		t.Error("TryAcquire succeeded with 2 open and a cap of 2")
+	}
+	g.Release()
+	if !g.TryAcquire() {
+		t.Error("TryAcquire failed with 1 open and a cap of 2")
+	}
+}
+
+func TestIPGroup(t *testing.T) {
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	tests := []struct {
+		name    string
+		max     int
+		acquire []net.IP
+		release []net.IP
+		try     net.IP
+		want    bool
+	}{
+		{"unlimited", 0, []net.IP{a, a, a}, nil, a, true},
+		{"below cap", 2, []net.IP{a}, nil, a, true},
+		{"at cap", 2, []net.IP{a, a}, nil, a, false},
+		{"other IP", 2, []net.IP{a, a}, nil, b, true},
+		{"released", 2, []net.IP{a, a}, []net.IP{a}, a, true},
+		{"released other IP", 2, []net.IP{a, a}, []net.IP{b}, a, false},
+		{"IPv4 in IPv6", 1, []net.IP{a}, nil, net.ParseIP("::ffff:10.0.0.1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewIPGroup(tt.max)
+			for _, ip := range tt.acquire {
+				g.TryAcquire(ip)
+			}
+			for _, ip := range tt.release {
+				g.Release(ip)
+			}
+			if got := g.TryAcquire(tt.try); got != tt.want {
+				t.Errorf("TryAcquire(%v) = %v, want %v", tt.try, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	ips := NewIPGroup(1)
+	total, halfOpen := NewGroup(10), NewGroup(1)
+
+	slot, ok := Acquire(ip, ips, total, halfOpen)
+	if !ok {
+		t.Fatal("Acquire failed with free places")
+	}
+	// halfOpen is full, the places taken in ips and total must be given back
+	if _, ok := Acquire(net.ParseIP("10.0.0.2"), ips, total, halfOpen); ok {
+		t.Fatal("Acquire succeeded with a full group")
+	}
+	if got := total.Open(); got != 1 {
+		t.Errorf("total.Open() = %d after a failed Acquire, want 1", got)
+	}
+	if !ips.TryAcquire(net.ParseIP("10.0.0.2")) {
+		t.Error("the failed Acquire kept its per-IP place")
+	}
+
+	slot.Release()
+	slot.Release()
+	if got := total.Open(); got != 0 {
+		t.Errorf("total.Open() = %d after releasing twice, want 0", got)
+	}
+	if _, ok := Acquire(ip, nil, halfOpen); !ok {
+		t.Error("Acquire without an IP group failed after the slot was released")
+	}
+}
@@ -6,17 +6,42 @@ import (
 	"io"
 )
 
+// Protocol is the only pstr this client speaks
+const Protocol = "BitTorrent protocol"
+
+// utpByte and utpBit locate the reserved bit that advertises uTP support. No BEP assigns it, so
+// other clients ignore it.
+const (
+	utpByte = 6
+	utpBit  = 0x10
+)
+
 // A Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte // Extension bits, see SetUTP
 	InfoHash *[20]byte
 	PeerID   *[20]byte
 }
 
+// SetUTP sets whether the handshake advertises that we accept uTP connections
+func (h *Handshake) SetUTP(supported bool) {
+	if supported {
+		h.Reserved[utpByte] |= utpBit
+	} else {
+		h.Reserved[utpByte] &^= utpBit
+	}
+}
+
+// UTP tells if the sender accepts uTP connections
+func (h *Handshake) UTP() bool {
+	return h.Reserved[utpByte]&utpBit != 0
+}
+
 // New creates a new handshake with the standard pstr
 func New(infoHash, peerID *[20]byte) *Handshake {
 	return &Handshake{
-		Pstr:     "BitTorrent protocol",
+		Pstr:     Protocol,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -25,16 +50,16 @@ func New(infoHash, peerID *[20]byte) *Handshake {
 // Serialize serializes the handshake to a buffer
 func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49)
-	reserved := [8]byte{0}
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], reserved[:]) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:]) // 8 reserved bytes
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
 }
 
+// Read parses a handshake from a stream, rejecting any protocol other than Protocol
 func Read(r *protocolconn.ProtocolConn) (*Handshake, error) {
 	lengthBuf := make([]byte, 1)
 	_, err := io.ReadFull(r.RawReadWriter, lengthBuf)
@@ -43,8 +68,8 @@ func Read(r *protocolconn.ProtocolConn) (*Handshake, error) {
 	}
 	pstrlen := int(lengthBuf[0])
 
-	if pstrlen == 0 {
-		err := fmt.Errorf("pstrlen cannot be 0")
+	if pstrlen != len(Protocol) {
+		err := fmt.Errorf("unexpected pstrlen %d", pstrlen)
 		return nil, err
 	}
 
@@ -54,13 +79,21 @@ func Read(r *protocolconn.ProtocolConn) (*Handshake, error) {
 		return nil, err
 	}
 
+	if pstr := string(handshakeBuf[0:pstrlen]); pstr != Protocol {
+		err := fmt.Errorf("unexpected protocol %q", pstr)
+		return nil, err
+	}
+
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: &infoHash,
 		PeerID:   &peerID,
 	}
@@ -0,0 +1,175 @@
+package ipfilter
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Filter decides which peer addresses may be dialed or accepted. An empty filter allows everything.
+type Filter struct {
+	mu      sync.RWMutex
+	v4, v6  []Range // Sorted and merged, so a lookup is a binary search
+	path    string
+	modTime time.Time
+	skipped int // Malformed lines in the loaded file
+	blocked atomic.Uint64
+	quit    chan struct{}
+}
+
+// New creates an empty filter
+func New() *Filter {
+	return &Filter{quit: make(chan struct{})}
+}
+
+// Load replaces the filter's ranges with the ones in the file at path and remembers the path
+// for Reload. An empty path clears the filter.
+func (f *Filter) Load(path string) error {
+	if path == "" {
+		f.set("", time.Time{}, nil, 0)
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	ranges, malformed, err := Parse(file)
+	if err != nil {
+		return err
+	}
+	f.set(path, info.ModTime(), ranges, malformed)
+	return nil
+}
+
+func (f *Filter) set(path string, modTime time.Time, ranges []Range, skipped int) {
+	var v4, v6 []Range
+	for _, r := range ranges {
+		if r.From.Is4() {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+	v4, v6 = merge(v4), merge(v6)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.path, f.modTime, f.v4, f.v6, f.skipped = path, modTime, v4, v6, skipped
+}
+
+// merge sorts ranges and joins the ones that overlap or touch
+func merge(ranges []Range) []Range {
+	slices.SortFunc(ranges, func(a, b Range) int { return a.From.Compare(b.From) })
+	var merged []Range
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if next := last.To.Next(); !next.IsValid() || r.From.Compare(next) <= 0 {
+				if last.To.Less(r.To) {
+					last.To = r.To
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Reload loads the file again if it changed since it was last loaded
+func (f *Filter) Reload() (bool, error) {
+	f.mu.RLock()
+	path, modTime := f.path, f.modTime
+	f.mu.RUnlock()
+	if path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+	return true, f.Load(path)
+}
+
+// Watch calls Reload every interval until Stop is called
+func (f *Filter) Watch(interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := f.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+// Stop ends Watch
+func (f *Filter) Stop() {
+	close(f.quit)
+}
+
+// Allows tells if ip may be connected to. Blocked addresses are counted.
+func (f *Filter) Allows(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	f.mu.RLock()
+	ranges := f.v6
+	if addr.Is4() {
+		ranges = f.v4
+	}
+	// The last range starting at or before addr is the only one that can contain it
+	i, found := slices.BinarySearchFunc(ranges, addr, func(r Range, a netip.Addr) int { return r.From.Compare(a) })
+	if !found {
+		i--
+	}
+	blocked := i >= 0 && ranges[i].Contains(addr)
+	f.mu.RUnlock()
+	if blocked {
+		f.blocked.Add(1)
+	}
+	return !blocked
+}
+
+// Blocked returns how many connection attempts the filter has blocked
+func (f *Filter) Blocked() uint64 {
+	return f.blocked.Load()
+}
+
+// Len returns the number of merged ranges in the filter
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.v4) + len(f.v6)
+}
+
+// Skipped returns the number of malformed lines that were skipped in the loaded file
+func (f *Filter) Skipped() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.skipped
+}
+
+// Path returns the file the filter was loaded from, empty if none
+func (f *Filter) Path() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.path
+}
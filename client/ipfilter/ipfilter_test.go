@@ -0,0 +1,68 @@
+package ipfilter
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []Range
+		want   []Range
+	}{
+		{"empty", nil, nil},
+		{"disjoint", []Range{rng("1.0.0.5", "1.0.0.9", ""), rng("1.0.0.1", "1.0.0.3", "")},
+			[]Range{rng("1.0.0.1", "1.0.0.3", ""), rng("1.0.0.5", "1.0.0.9", "")}},
+		{"overlapping", []Range{rng("1.0.0.1", "1.0.0.5", ""), rng("1.0.0.3", "1.0.0.9", "")},
+			[]Range{rng("1.0.0.1", "1.0.0.9", "")}},
+		{"touching", []Range{rng("1.0.0.1", "1.0.0.4", ""), rng("1.0.0.5", "1.0.0.9", "")},
+			[]Range{rng("1.0.0.1", "1.0.0.9", "")}},
+		{"contained", []Range{rng("1.0.0.1", "1.0.0.9", ""), rng("1.0.0.3", "1.0.0.4", "")},
+			[]Range{rng("1.0.0.1", "1.0.0.9", "")}},
+		{"chain", []Range{rng("1.0.0.7", "1.0.0.9", ""), rng("1.0.0.1", "1.0.0.4", ""), rng("1.0.0.3", "1.0.0.7", "")},
+			[]Range{rng("1.0.0.1", "1.0.0.9", "")}},
+		{"up to the last address", []Range{rng("255.255.255.0", "255.255.255.255", ""), rng("255.255.255.255", "255.255.255.255", "")},
+			[]Range{rng("255.255.255.0", "255.255.255.255", "")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := merge(tt.ranges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	f := New()
+	f.set("", time.Time{}, []Range{
+		rng("10.0.0.0", "10.0.0.255", ""),
+		rng("10.0.0.128", "10.0.1.10", ""),
+		rng("2001:db8::", "2001:db8::ffff", ""),
+	}, 0)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"9.255.255.255", true},
+		{"10.0.0.0", false},
+		{"10.0.1.10", false},
+		{"10.0.1.11", true},
+		{"::ffff:10.0.0.5", false},
+		{"2001:db8::1", false},
+		{"2001:db8::1:0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := f.Allows(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Allows(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+	if got := f.Len(); got != 2 {
+		t.Errorf("Len() = %d after merging, want 2", got)
+	}
+}
@@ -0,0 +1,179 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Range is an inclusive range of blocked addresses
+type Range struct {
+	From, To    netip.Addr
+	Description string
+}
+
+// Contains tells if addr is inside the range
+func (r Range) Contains(addr netip.Addr) bool {
+	return r.From.Compare(addr) <= 0 && addr.Compare(r.To) <= 0
+}
+
+// emuleAllowLevel is the access level from which eMule ipfilter.dat entries allow a range
+const emuleAllowLevel = 128
+
+// Parse reads ranges in either the eMule ipfilter.dat format
+//
+//	001.009.096.105 - 001.009.096.105 , 000 , Description
+//
+// or the PeerGuardian P2P text format
+//
+//	Description:1.9.96.105-1.9.96.105
+//
+// The format is told apart per line by the range syntax, since P2P descriptions may contain
+// commas. Blank lines and lines starting with # or // are skipped. eMule entries with an access
+// level of 128 or more allow their range and are skipped as well. Malformed lines are skipped
+// and counted, as published lists often carry a few; a list with nothing but malformed lines
+// is an error.
+func Parse(r io.Reader) (ranges []Range, malformed int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		var rng Range
+		var blocked bool
+		var err error
+		if isEmule(line) {
+			rng, blocked, err = parseEmule(line)
+		} else {
+			rng, err = parseP2P(line)
+			blocked = true
+		}
+		if err != nil {
+			malformed++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, malformed, err
+	}
+	if len(ranges) == 0 && malformed > 0 {
+		return nil, malformed, fmt.Errorf("no valid range in %d lines", malformed)
+	}
+	return ranges, malformed, nil
+}
+
+// isEmule tells if the line starts with an eMule range, two addresses around a dash before
+// the first comma. P2P lines start with their description instead.
+func isEmule(line string) bool {
+	head, _, ok := strings.Cut(line, ",")
+	if !ok {
+		return false
+	}
+	from, to, ok := strings.Cut(head, " - ")
+	if !ok {
+		from, to, ok = strings.Cut(head, "-")
+	}
+	if !ok {
+		return false
+	}
+	_, err := newRange(from, to)
+	return err == nil
+}
+
+func parseEmule(line string) (Range, bool, error) {
+	fields := strings.SplitN(line, ",", 3)
+	from, to, ok := strings.Cut(fields[0], " - ")
+	if !ok {
+		from, to, ok = strings.Cut(fields[0], "-")
+	}
+	if !ok {
+		return Range{}, false, fmt.Errorf("malformed range %q", fields[0])
+	}
+	rng, err := newRange(from, to)
+	if err != nil {
+		return Range{}, false, err
+	}
+	if len(fields) > 1 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("malformed access level %q", fields[1])
+		}
+		if level >= emuleAllowLevel {
+			return Range{}, false, nil
+		}
+	}
+	if len(fields) > 2 {
+		rng.Description = strings.TrimSpace(fields[2])
+	}
+	return rng, true, nil
+}
+
+func parseP2P(line string) (Range, error) {
+	// Descriptions may contain colons and dashes, and IPv6 addresses contain colons, so the
+	// range is the part after the last dash and the longest valid address before it
+	dash := strings.LastIndex(line, "-")
+	if dash < 0 {
+		return Range{}, fmt.Errorf("malformed range %q", line)
+	}
+	to := line[dash+1:]
+	head := line[:dash]
+	for i := 0; i < len(head); i++ {
+		if head[i] != ':' {
+			continue
+		}
+		rng, err := newRange(head[i+1:], to)
+		if err == nil {
+			rng.Description = strings.TrimSpace(head[:i])
+			return rng, nil
+		}
+	}
+	return Range{}, fmt.Errorf("malformed range %q", line)
+}
+
+func newRange(from, to string) (Range, error) {
+	fromAddr, err := parseAddr(from)
+	if err != nil {
+		return Range{}, err
+	}
+	toAddr, err := parseAddr(to)
+	if err != nil {
+		return Range{}, err
+	}
+	if fromAddr.Is4() != toAddr.Is4() || toAddr.Less(fromAddr) {
+		return Range{}, fmt.Errorf("invalid range %s - %s", fromAddr, toAddr)
+	}
+	return Range{From: fromAddr, To: toAddr}, nil
+}
+
+// parseAddr parses an IPv4 or IPv6 address. IPv4 octets may carry the leading zeros
+// ipfilter.dat pads them with.
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return addr.Unmap(), nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, fmt.Errorf("malformed address %q", s)
+	}
+	var octets [4]byte
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("malformed address %q", s)
+		}
+		octets[i] = byte(n)
+	}
+	return netip.AddrFrom4(octets), nil
+}
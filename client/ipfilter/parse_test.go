@@ -0,0 +1,61 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rng returns a range from two addresses and a description
+func rng(from, to, description string) Range {
+	return Range{From: netip.MustParseAddr(from), To: netip.MustParseAddr(to), Description: description}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		want          []Range
+		wantMalformed int
+		wantErr       bool
+	}{
+		{"eMule", "001.009.096.105 - 001.009.096.110 , 000 , Some ISP",
+			[]Range{rng("1.9.96.105", "1.9.96.110", "Some ISP")}, 0, false},
+		{"eMule without spaces", "1.2.3.4-1.2.3.5,100,Tight",
+			[]Range{rng("1.2.3.4", "1.2.3.5", "Tight")}, 0, false},
+		{"eMule allowed", "001.009.096.105 - 001.009.096.110 , 128 , Friends", nil, 0, false},
+		{"eMule bad level", "1.2.3.4 - 1.2.3.5 , high , Bad\n5.6.7.8 - 5.6.7.9 , 0 , Good",
+			[]Range{rng("5.6.7.8", "5.6.7.9", "Good")}, 1, false},
+		{"P2P", "Some ISP:1.9.96.105-1.9.96.110",
+			[]Range{rng("1.9.96.105", "1.9.96.110", "Some ISP")}, 0, false},
+		{"P2P description with comma", "Corp, Inc.:1.2.3.4-1.2.3.5",
+			[]Range{rng("1.2.3.4", "1.2.3.5", "Corp, Inc.")}, 0, false},
+		{"P2P description with colon and dash", "Net: A-B:1.2.3.4-1.2.3.5",
+			[]Range{rng("1.2.3.4", "1.2.3.5", "Net: A-B")}, 0, false},
+		{"P2P IPv6", "V6 block:2001:db8::1-2001:db8::ff",
+			[]Range{rng("2001:db8::1", "2001:db8::ff", "V6 block")}, 0, false},
+		{"mixed formats", "# comment\n\n// other comment\n1.2.3.4 - 1.2.3.5 , 0 , eMule\nP2P:5.6.7.8-5.6.7.9",
+			[]Range{rng("1.2.3.4", "1.2.3.5", "eMule"), rng("5.6.7.8", "5.6.7.9", "P2P")}, 0, false},
+		{"reversed range", "Backwards:1.2.3.5-1.2.3.4\nGood:1.2.3.4-1.2.3.5",
+			[]Range{rng("1.2.3.4", "1.2.3.5", "Good")}, 1, false},
+		{"mixed families", "Mixed:1.2.3.4-2001:db8::1\nGood:1.2.3.4-1.2.3.5",
+			[]Range{rng("1.2.3.4", "1.2.3.5", "Good")}, 1, false},
+		{"empty", "", nil, 0, false},
+		{"only malformed", "garbage\nmore garbage", nil, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, malformed, err := Parse(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+			if malformed != tt.wantMalformed {
+				t.Errorf("Parse() malformed = %d, want %d", malformed, tt.wantMalformed)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+// Package lsd implements Local Service Discovery (BEP 14): torrents are announced to the
+// local network over IPv4 multicast, and peers announced by others are handed to the torrents.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"client/peer"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Handler is a torrent that accepts peers found on the local network
+type Handler interface {
+	HandleLocalPeer(pr peer.Peer)
+}
+
+// Group is the BEP 14 IPv4 multicast group
+const Group = "239.192.152.143:6771"
+
+// AnnounceInterval is how often each torrent is announced
+const AnnounceInterval = 5 * time.Minute
+
+// MinAnnounceInterval is how often announcements are sent at most, so that torrents registered
+// in a burst share a few datagrams
+const MinAnnounceInterval = time.Minute
+
+// maxHashesPerMessage keeps an announcement within a single unfragmented datagram
+const maxHashesPerMessage = 20
+
+var (
+	mu        sync.Mutex
+	handlers  = make(map[[20]byte]Handler)
+	announced = make(map[[20]byte]time.Time) // When each registered torrent was last announced
+	service   *lsdService
+)
+
+type lsdService struct {
+	port   uint16
+	cookie string // Identifies our own announcements when they loop back
+	group  *net.UDPAddr
+	recv   *net.UDPConn
+	send   *ipv4.PacketConn
+	lookup func(infoHash [20]byte) (Handler, bool) // Finds the torrent of an announced infohash
+	wake   chan struct{}
+	quit   chan struct{}
+}
+
+// Register announces infoHash on the local network and passes peers found for it to h.
+// Private torrents must not be registered.
+func Register(infoHash [20]byte, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[infoHash] = h
+	if service != nil {
+		select {
+		case service.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Unregister stops announcing infoHash
+func Unregister(infoHash [20]byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(handlers, infoHash)
+	delete(announced, infoHash)
+}
+
+func lookup(infoHash [20]byte) (Handler, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	h, ok := handlers[infoHash]
+	return h, ok
+}
+
+// Start joins the multicast group on the named interface, or the system's default multicast
+// interface if ifaceName is empty, and announces port as our listening port. It is a no-op
+// if discovery is already running.
+func Start(port uint16, ifaceName string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if service != nil {
+		return nil
+	}
+	s, err := listen(port, ifaceName, lookup)
+	if err != nil {
+		return err
+	}
+	service = s
+	// Torrents registered before the start are announced again by the new service
+	clear(announced)
+	go service.announceLoop()
+	return nil
+}
+
+// listen joins the multicast group and passes the peers it hears about to the handlers lookup
+// finds. Nothing is announced until announce is called.
+func listen(port uint16, ifaceName string, lookup func(infoHash [20]byte) (Handler, bool)) (*lsdService, error) {
+	var iface *net.Interface
+	if ifaceName != "" {
+		var err error
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+	group, err := net.ResolveUDPAddr("udp4", Group)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return nil, err
+	}
+	// Announcements go out from their own socket, with loopback left on so that other clients
+	// on this host hear them
+	sendConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+	send := ipv4.NewPacketConn(sendConn)
+	if iface != nil {
+		if err := send.SetMulticastInterface(iface); err != nil {
+			recv.Close()
+			send.Close()
+			return nil, err
+		}
+	}
+	send.SetMulticastLoopback(true)
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	s := &lsdService{
+		port:   port,
+		cookie: hex.EncodeToString(cookie),
+		group:  group,
+		recv:   recv,
+		send:   send,
+		lookup: lookup,
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	go s.receiveLoop()
+	return s, nil
+}
+
+// Stop leaves the multicast group. Registered torrents stay registered for a later Start.
+func Stop() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if service == nil {
+		return nil
+	}
+	err := service.close()
+	service = nil
+	return err
+}
+
+func (s *lsdService) close() error {
+	close(s.quit)
+	return errors.Join(s.recv.Close(), s.send.Close())
+}
+
+func (s *lsdService) announceLoop() {
+	ticker := time.NewTicker(MinAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		s.announce(due(time.Now()))
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// due returns the registered torrents that have not been announced for AnnounceInterval and
+// marks them as announced
+func due(now time.Time) [][20]byte {
+	mu.Lock()
+	defer mu.Unlock()
+	var hashes [][20]byte
+	for infoHash := range handlers {
+		if last, ok := announced[infoHash]; ok && now.Sub(last) < AnnounceInterval {
+			continue
+		}
+		announced[infoHash] = now
+		hashes = append(hashes, infoHash)
+	}
+	return hashes
+}
+
+func (s *lsdService) announce(hashes [][20]byte) {
+	for len(hashes) > 0 {
+		n := min(len(hashes), maxHashesPerMessage)
+		msg := Marshal(s.port, hashes[:n], s.cookie)
+		if _, err := s.send.WriteTo(msg, nil, s.group); err != nil {
+			// log.Printf("[LSD] Failed to send announcement: %v", err)
+		}
+		hashes = hashes[n:]
+	}
+}
+
+func (s *lsdService) receiveLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.recv.ReadFromUDP(buf)
+		if err != nil {
+			// log.Printf("[LSD] Receive stopped: %v", err)
+			return
+		}
+		ann, err := Parse(buf[:n])
+		if err != nil || ann.Cookie == s.cookie {
+			continue
+		}
+		pr := peer.Peer{IP: from.IP, Port: ann.Port}
+		for _, infoHash := range ann.InfoHashes {
+			if h, ok := s.lookup(infoHash); ok {
+				h.HandleLocalPeer(pr)
+			}
+		}
+	}
+}
+
+// Announcement is a decoded BT-SEARCH message
+type Announcement struct {
+	Port       uint16
+	InfoHashes [][20]byte
+	Cookie     string // Empty if the sender did not set one
+}
+
+const requestLine = "BT-SEARCH * HTTP/1.1"
+
+// Marshal encodes a BT-SEARCH announcement for infoHashes
+func Marshal(port uint16, infoHashes [][20]byte, cookie string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\r\nHost: %s\r\nPort: %d\r\n", requestLine, Group, port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", infoHash)
+	}
+	if cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// Parse decodes a BT-SEARCH announcement. Malformed infohashes are skipped, but an
+// announcement without a valid one is an error.
+func Parse(data []byte) (*Announcement, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if line != requestLine {
+		return nil, fmt.Errorf("not a BT-SEARCH message: %q", line)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %q", header.Get("Port"))
+	}
+	ann := &Announcement{Port: uint16(port), Cookie: header.Get("Cookie")}
+	for _, value := range header.Values("Infohash") {
+		value = strings.TrimSpace(value)
+		var infoHash [20]byte
+		if len(value) != hex.EncodedLen(len(infoHash)) {
+			continue
+		}
+		if _, err := hex.Decode(infoHash[:], []byte(value)); err != nil {
+			continue
+		}
+		ann.InfoHashes = append(ann.InfoHashes, infoHash)
+	}
+	if len(ann.InfoHashes) == 0 {
+		return nil, errors.New("no valid infohash")
+	}
+	return ann, nil
+}
@@ -0,0 +1,146 @@
+package lsd
+
+import (
+	"client/peer"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMarshalParse(t *testing.T) {
+	hashes := [][20]byte{{1, 2, 3}, {0xff, 0xee}}
+	ann, err := Parse(Marshal(6881, hashes, "c00k1e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Announcement{Port: 6881, InfoHashes: hashes, Cookie: "c00k1e"}
+	if !reflect.DeepEqual(ann, want) {
+		t.Errorf("Parse(Marshal) = %+v, want %+v", ann, want)
+	}
+
+	ann, err = Parse(Marshal(6881, hashes[:1], ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ann.Cookie != "" {
+		t.Errorf("cookie %q parsed from an announcement without one", ann.Cookie)
+	}
+}
+
+func TestParse(t *testing.T) {
+	valid := strings.Repeat("ab", 20)
+	var validHash [20]byte
+	for i := range validHash {
+		validHash[i] = 0xab
+	}
+	tests := []struct {
+		name    string
+		msg     string
+		want    *Announcement
+		wantErr bool
+	}{
+		{
+			name: "header case and spacing",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nhost: " + Group + "\r\nport:  51413\r\ninfohash: " + valid + "\r\nCookie: x\r\n\r\n\r\n",
+			want: &Announcement{Port: 51413, InfoHashes: [][20]byte{validHash}, Cookie: "x"},
+		},
+		{
+			name: "malformed infohashes skipped",
+			msg:  "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: xyz\r\nInfohash: " + strings.Repeat("zz", 20) + "\r\nInfohash: " + valid + "\r\n\r\n",
+			want: &Announcement{Port: 1, InfoHashes: [][20]byte{validHash}},
+		},
+		{name: "no valid infohash", msg: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: xyz\r\n\r\n", wantErr: true},
+		{name: "port zero", msg: "BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + valid + "\r\n\r\n", wantErr: true},
+		{name: "port out of range", msg: "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + valid + "\r\n\r\n", wantErr: true},
+		{name: "other request", msg: "M-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: " + valid + "\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.msg))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Parse = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// peers records the peers found for one infohash
+type peers struct {
+	mu    sync.Mutex
+	ports []uint16
+	found chan struct{}
+}
+
+func (p *peers) HandleLocalPeer(pr peer.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ports = append(p.ports, pr.Port)
+	select {
+	case p.found <- struct{}{}:
+	default:
+	}
+}
+
+func (p *peers) get() []uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]uint16(nil), p.ports...)
+}
+
+// startLoopback starts a service on lo whose torrent infoHash reports peers to h
+func startLoopback(t *testing.T, port uint16, infoHash [20]byte, h Handler) *lsdService {
+	t.Helper()
+	s, err := listen(port, "lo", func(ih [20]byte) (Handler, bool) {
+		return h, ih == infoHash
+	})
+	if err != nil {
+		t.Skipf("multicast on lo is unavailable: %v", err)
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func TestDiscoveryOnLoopback(t *testing.T) {
+	infoHash := [20]byte{0x14}
+	foundByA := &peers{found: make(chan struct{}, 1)}
+	foundByB := &peers{found: make(chan struct{}, 1)}
+	a := startLoopback(t, 10001, infoHash, foundByA)
+	b := startLoopback(t, 10002, infoHash, foundByB)
+
+	// Announce until both sides heard the other, as the first datagrams may beat the group join
+	deadline := time.Now().Add(5 * time.Second)
+	for len(foundByA.get()) == 0 || len(foundByB.get()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("A found %v and B found %v", foundByA.get(), foundByB.get())
+		}
+		a.announce([][20]byte{infoHash})
+		b.announce([][20]byte{infoHash})
+		select {
+		case <-foundByA.found:
+		case <-foundByB.found:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	// Each side only hears the other, its own announcements loop back but carry its cookie
+	for _, port := range foundByA.get() {
+		if port != 10002 {
+			t.Errorf("A found a peer on port %d, want only B's 10002", port)
+		}
+	}
+	for _, port := range foundByB.get() {
+		if port != 10001 {
+			t.Errorf("B found a peer on port %d, want only A's 10001", port)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"client/common"
+	"client/lsd"
+	"client/session"
 	"client/view"
+	"log"
 	"os"
+	"time"
 )
 
 func writeToFile(filename string, data []byte) error {
@@ -19,5 +23,17 @@ func writeToFile(filename string, data []byte) error {
 
 func main() {
 	common.InitAppState()
+	if err := common.LoadConfig(); err != nil {
+		log.Printf("error loading config - %v", err)
+	}
+	common.AppState.Proxy.SetSharedUDP(session.DialUDP)
+	go common.AppState.IPFilter.Watch(time.Minute, func(err error) {
+		log.Printf("error reloading IP filter - %v", err)
+	})
+	if common.AppState.EnableLSD {
+		if err := lsd.Start(common.AppState.Port, common.AppState.LSDInterface); err != nil {
+			log.Printf("error starting local service discovery - %v", err)
+		}
+	}
 	view.CreateMainWindow()
 }
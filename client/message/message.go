@@ -7,6 +7,23 @@ import (
 	"io"
 )
 
+// MaxBlockSize is the largest block a request may ask for, and so the largest piece payload
+const MaxBlockSize = 0x4000
+
+// ErrTooLarge is returned by Read for a message longer than the caller allows
+var ErrTooLarge = protocolconn.ErrTooLarge
+
+// MaxLength returns the longest message a well-behaved peer sends for a torrent with numPieces
+// pieces: a piece message carrying a full block, or the bitfield if that is longer
+func MaxLength(numPieces int) uint32 {
+	pieceMsg := 1 + 8 + MaxBlockSize
+	bitfieldMsg := 1 + (numPieces+7)/8
+	if bitfieldMsg > pieceMsg {
+		return uint32(bitfieldMsg)
+	}
+	return uint32(pieceMsg)
+}
+
 type messageID uint8
 
 const (
@@ -41,8 +58,9 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
-// Read parses a message from a stream. Returns `nil` on keep-alive message
-func Read(r *protocolconn.ProtocolConn) (*Message, error) {
+// Read parses a message from a stream. Returns `nil` on keep-alive message.
+// Messages longer than maxLength are rejected with ErrTooLarge before allocating a buffer.
+func Read(r *protocolconn.ProtocolConn, maxLength uint32) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 	_, err := io.ReadFull(r.RawReadWriter, lengthBuf)
 	if err != nil {
@@ -54,6 +72,9 @@ func Read(r *protocolconn.ProtocolConn) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > maxLength {
+		return nil, fmt.Errorf("%w: %d > %d bytes", ErrTooLarge, length, maxLength)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r.EncryptedReader, messageBuf)
@@ -0,0 +1,69 @@
+package message
+
+import (
+	"bytes"
+	"client/protocolconn"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// stream serves the given bytes as a plaintext peer connection
+type stream struct {
+	*bytes.Reader
+}
+
+func (stream) Write(p []byte) (int, error) { return len(p), nil }
+func (stream) Close() error                { return nil }
+
+func newStream(b []byte) *protocolconn.ProtocolConn {
+	return protocolconn.NewStream(stream{bytes.NewReader(b)})
+}
+
+func TestMaxLength(t *testing.T) {
+	tests := []struct {
+		numPieces int
+		want      uint32
+	}{
+		{1, 1 + 8 + MaxBlockSize},
+		{8 * (8 + MaxBlockSize), 1 + 8 + MaxBlockSize},
+		{8*(8+MaxBlockSize) + 1, 1 + 8 + MaxBlockSize + 1},
+		{1 << 20, 1 + 1<<17},
+	}
+	for _, tt := range tests {
+		if got := MaxLength(tt.numPieces); got != tt.want {
+			t.Errorf("MaxLength(%d) = %d, want %d", tt.numPieces, got, tt.want)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	have := FormatHave(3).Serialize()
+	full := &Message{ID: MsgBitfield, Payload: bytes.Repeat([]byte{0xff}, 31)}
+	tests := []struct {
+		name    string
+		in      []byte
+		want    *Message
+		wantErr error
+	}{
+		{"keep-alive", []byte{0, 0, 0, 0}, nil, nil},
+		{"have", have, FormatHave(3), nil},
+		{"at the limit", full.Serialize(), full, nil},
+		{"over the limit", binary.BigEndian.AppendUint32(nil, 33), nil, ErrTooLarge},
+		{"4 GiB", []byte{0xff, 0xff, 0xff, 0xff}, nil, ErrTooLarge},
+		{"truncated length", []byte{0, 0}, nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(newStream(tt.in), 32)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Read error = %v, want %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) ||
+				(got != nil && (got.ID != tt.want.ID || !bytes.Equal(got.Payload, tt.want.Payload))) {
+				t.Errorf("Read = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+// Package mse implements the BitTorrent Message Stream Encryption handshake
+// (also known as Protocol Encryption), which obfuscates the connection with a
+// Diffie-Hellman key exchange followed by RC4 or plaintext
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// CryptoMethod is a bitmask of the methods offered in crypto_provide or chosen in crypto_select
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01
+	CryptoRC4       CryptoMethod = 0x02
+)
+
+const (
+	keySize    = 96  // DH public keys and shared secrets are 768 bits
+	maxPad     = 512 // PadA, PadB, PadC and PadD are at most 512 bytes
+	vcSize     = 8   // Verification constant, 8 zero bytes
+	rc4Discard = 1024
+)
+
+var (
+	prime     = mustParsePrime("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563")
+	generator = big.NewInt(2)
+	vc        = make([]byte, vcSize)
+)
+
+func mustParsePrime(s string) *big.Int {
+	p, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("mse: invalid prime")
+	}
+	return p
+}
+
+// Conn is a connection that completed the MSE handshake. Reads and writes pass
+// through RC4 when it was selected and go straight to the socket otherwise.
+type Conn struct {
+	net.Conn
+	Method  CryptoMethod // The method selected by the receiving side
+	dec     *rc4.Cipher
+	enc     *rc4.Cipher
+	initial []byte // Decrypted initial payload not yet returned by Read
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.initial) > 0 {
+		n := copy(p, c.initial)
+		c.initial = c.initial[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	if c.Method == CryptoRC4 {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.Method != CryptoRC4 {
+		return c.Conn.Write(p)
+	}
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func newRC4(name string, secret, skey []byte) (*rc4.Cipher, error) {
+	c, err := rc4.NewCipher(hash([]byte(name), secret, skey))
+	if err != nil {
+		return nil, err
+	}
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c, nil
+}
+
+// padded returns x as a big-endian number of exactly keySize bytes
+func padded(x *big.Int) []byte {
+	buf := make([]byte, keySize)
+	return x.FillBytes(buf)
+}
+
+// generateKeys creates a 160 bit private key and the matching public key
+func generateKeys() (private *big.Int, public []byte, err error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	private = new(big.Int).SetBytes(buf)
+	return private, padded(new(big.Int).Exp(generator, private, prime)), nil
+}
+
+func sharedSecret(private *big.Int, remotePublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remotePublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(prime, big.NewInt(1))) >= 0 {
+		return nil, errors.New("mse: invalid public key")
+	}
+	return padded(new(big.Int).Exp(y, private, prime)), nil
+}
+
+// randomPad returns between 0 and maxPad random bytes
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// sendKey writes our public key followed by random padding
+func sendKey(conn net.Conn, public []byte) error {
+	pad, err := randomPad()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(append([]byte{}, public...), pad...))
+	return err
+}
+
+// syncOn reads from r until the last len(pattern) bytes equal pattern,
+// giving up after maxPad bytes of padding
+func syncOn(r io.Reader, pattern []byte) error {
+	window := make([]byte, len(pattern))
+	if _, err := io.ReadFull(r, window); err != nil {
+		return err
+	}
+	for skipped := 0; !bytes.Equal(window, pattern); skipped++ {
+		if skipped == maxPad {
+			return errors.New("mse: could not synchronize on handshake")
+		}
+		copy(window, window[1:])
+		if _, err := io.ReadFull(r, window[len(window)-1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPadded reads a 2-byte length followed by that many bytes through the decrypting cipher
+func readPadded(r io.Reader, dec *rc4.Cipher, limit int) ([]byte, error) {
+	var lengthBuf [2]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(lengthBuf[:], lengthBuf[:])
+	length := int(binary.BigEndian.Uint16(lengthBuf[:]))
+	if length > limit {
+		return nil, fmt.Errorf("mse: field length %d exceeds %d", length, limit)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// Initiate performs the initiating side of the handshake. skey is the infohash of the
+// torrent being connected to and provide the methods we are willing to use.
+func Initiate(conn net.Conn, skey [20]byte, provide CryptoMethod) (*Conn, error) {
+	private, public, err := generateKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := sendKey(conn, public); err != nil {
+		return nil, err
+	}
+	remotePublic := make([]byte, keySize)
+	if _, err := io.ReadFull(conn, remotePublic); err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(private, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newRC4("keyA", secret, skey[:])
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newRC4("keyB", secret, skey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), secret)
+	subtle.XORBytes(req2, req2, req3)
+	padC, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 0, vcSize+4+2+len(padC)+2)
+	plain = append(plain, vc...)
+	plain = binary.BigEndian.AppendUint32(plain, uint32(provide))
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(padC)))
+	plain = append(plain, padC...)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // No initial payload, the BitTorrent handshake follows the negotiation
+	enc.XORKeyStream(plain, plain)
+	msg := append(append(hash([]byte("req1"), secret), req2...), plain...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	// The receiver's reply starts with ENCRYPT(VC) somewhere after PadB
+	encryptedVC := make([]byte, vcSize)
+	dec.XORKeyStream(encryptedVC, vc)
+	if err := syncOn(conn, encryptedVC); err != nil {
+		return nil, err
+	}
+	selectBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, selectBuf); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(selectBuf, selectBuf)
+	selected := CryptoMethod(binary.BigEndian.Uint32(selectBuf))
+	if (selected != CryptoRC4 && selected != CryptoPlaintext) || selected&provide == 0 {
+		return nil, fmt.Errorf("mse: peer selected unsupported method %#x", selected)
+	}
+	if _, err := readPadded(conn, dec, maxPad); err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, Method: selected, dec: dec, enc: enc}, nil
+}
+
+// Accept performs the receiving side of the handshake. skeys are the infohashes the peer
+// may ask for and allowed the methods we accept. It returns the infohash the peer chose. The
+// caller closes conn when the handshake fails.
+func Accept(conn net.Conn, skeys [][20]byte, allowed CryptoMethod) (*Conn, [20]byte, error) {
+	var skey [20]byte
+	remotePublic := make([]byte, keySize)
+	if _, err := io.ReadFull(conn, remotePublic); err != nil {
+		return nil, skey, err
+	}
+	private, public, err := generateKeys()
+	if err != nil {
+		return nil, skey, err
+	}
+	secret, err := sharedSecret(private, remotePublic)
+	if err != nil {
+		return nil, skey, err
+	}
+	// Our key goes out while PadA is read, as the initiator may still be writing it and the
+	// transport need not buffer both directions
+	sent := make(chan error, 1)
+	go func() { sent <- sendKey(conn, public) }()
+
+	// Skip PadA by looking for HASH('req1', S)
+	if err := syncOn(conn, hash([]byte("req1"), secret)); err != nil {
+		return nil, skey, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(conn, obfuscated); err != nil {
+		return nil, skey, err
+	}
+	subtle.XORBytes(obfuscated, obfuscated, hash([]byte("req3"), secret))
+	found := false
+	for _, candidate := range skeys {
+		if subtle.ConstantTimeCompare(obfuscated, hash([]byte("req2"), candidate[:])) == 1 {
+			skey = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, errors.New("mse: peer asked for an unknown torrent")
+	}
+	dec, err := newRC4("keyA", secret, skey[:])
+	if err != nil {
+		return nil, skey, err
+	}
+	enc, err := newRC4("keyB", secret, skey[:])
+	if err != nil {
+		return nil, skey, err
+	}
+
+	header := make([]byte, vcSize+4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:vcSize], vc) {
+		return nil, skey, errors.New("mse: invalid verification constant")
+	}
+	provide := CryptoMethod(binary.BigEndian.Uint32(header[vcSize:]))
+	if _, err := readPadded(conn, dec, maxPad); err != nil { // PadC
+		return nil, skey, err
+	}
+	// The initial payload usually carries the BitTorrent handshake, it is handed back by Read
+	initialPayload, err := readPadded(conn, dec, 0xffff)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	var selected CryptoMethod
+	switch {
+	case provide&allowed&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&allowed&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, skey, fmt.Errorf("mse: no common method in %#x", provide)
+	}
+
+	if err := <-sent; err != nil {
+		return nil, skey, err
+	}
+
+	// ENCRYPT(VC, crypto_select, len(padD), padD)
+	reply := make([]byte, 0, vcSize+4+2)
+	reply = append(reply, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, uint32(selected))
+	reply = binary.BigEndian.AppendUint16(reply, 0)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, skey, err
+	}
+	return &Conn{Conn: conn, Method: selected, dec: dec, enc: enc, initial: initialPayload}, skey, nil
+}
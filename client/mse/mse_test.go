@@ -0,0 +1,216 @@
+package mse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapConn records the bytes read from the connection, as they were on the wire
+type tapConn struct {
+	net.Conn
+	mu   sync.Mutex
+	read []byte
+}
+
+func (c *tapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read = append(c.read, p[:n]...)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *tapConn) wire() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.read...)
+}
+
+// handshake runs Initiate and Accept against each other over an in-memory pipe
+func handshake(t *testing.T, skey [20]byte, skeys [][20]byte, provide, allowed CryptoMethod) (
+	initiator, acceptor *Conn, tap *tapConn, chosen [20]byte, initErr, acceptErr error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	a.SetDeadline(time.Now().Add(10 * time.Second))
+	b.SetDeadline(time.Now().Add(10 * time.Second))
+	tap = &tapConn{Conn: b}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		acceptor, chosen, acceptErr = Accept(tap, skeys, allowed)
+		if acceptErr != nil {
+			b.Close() // A real listener hangs up on a failed handshake
+		}
+	}()
+	initiator, initErr = Initiate(a, skey, provide)
+	if initErr != nil {
+		a.Close()
+	}
+	<-done
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	var skey [20]byte
+	copy(skey[:], "0123456789abcdefghij")
+	other := [20]byte{1}
+	both := CryptoRC4 | CryptoPlaintext
+	tests := []struct {
+		name     string
+		provide  CryptoMethod
+		allowed  CryptoMethod
+		want     CryptoMethod
+		wantFail bool
+	}{
+		{"RC4 preferred", both, both, CryptoRC4, false},
+		{"RC4 only", CryptoRC4, both, CryptoRC4, false},
+		{"plaintext offered", CryptoPlaintext, both, CryptoPlaintext, false},
+		{"plaintext allowed", both, CryptoPlaintext, CryptoPlaintext, false},
+		{"no common method", CryptoRC4, CryptoPlaintext, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initiator, acceptor, tap, chosen, initErr, acceptErr := handshake(t, skey, [][20]byte{other, skey}, tt.provide, tt.allowed)
+			if tt.wantFail {
+				if initErr == nil || acceptErr == nil {
+					t.Fatalf("handshake succeeded: %v, %v", initErr, acceptErr)
+				}
+				return
+			}
+			if initErr != nil || acceptErr != nil {
+				t.Fatalf("handshake failed: %v, %v", initErr, acceptErr)
+			}
+			if chosen != skey {
+				t.Errorf("Accept chose infohash %x, want %x", chosen, skey)
+			}
+			if initiator.Method != tt.want || acceptor.Method != tt.want {
+				t.Errorf("methods %#x and %#x, want %#x", initiator.Method, acceptor.Method, tt.want)
+			}
+
+			// Both directions carry data after the handshake
+			hello := []byte("\x13BitTorrent protocol, as the first message after the handshake")
+			go initiator.Write(hello)
+			got := make([]byte, len(hello))
+			if _, err := io.ReadFull(acceptor, got); err != nil || !bytes.Equal(got, hello) {
+				t.Fatalf("acceptor read %q, %v", got, err)
+			}
+			go acceptor.Write([]byte("reply"))
+			got = make([]byte, 5)
+			if _, err := io.ReadFull(initiator, got); err != nil || string(got) != "reply" {
+				t.Fatalf("initiator read %q, %v", got, err)
+			}
+			onWire := bytes.Contains(tap.wire(), hello)
+			if onWire != (tt.want == CryptoPlaintext) {
+				t.Errorf("message visible on the wire = %v with method %#x", onWire, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeWrongInfoHash(t *testing.T) {
+	var skey, other [20]byte
+	copy(skey[:], "0123456789abcdefghij")
+	copy(other[:], "jihgfedcba9876543210")
+	_, _, _, _, initErr, acceptErr := handshake(t, skey, [][20]byte{other}, CryptoRC4, CryptoRC4)
+	if acceptErr == nil || !strings.Contains(acceptErr.Error(), "unknown torrent") {
+		t.Errorf("Accept error = %v, want an unknown torrent", acceptErr)
+	}
+	if initErr == nil {
+		t.Error("Initiate succeeded against a peer without the torrent")
+	}
+}
+
+func TestHandshakeInvalidKey(t *testing.T) {
+	for _, key := range []*big.Int{big.NewInt(0), big.NewInt(1), new(big.Int).Sub(prime, big.NewInt(1)), prime} {
+		if _, err := sharedSecret(big.NewInt(12345), padded(key)); err == nil {
+			t.Errorf("accepted the public key %x", key)
+		}
+	}
+}
+
+// TestKeyVector checks the shared secret and the RC4 keys against values computed independently
+// for the private keys 0x1111... and 0x2222..., and skey 00 01 02 ... 13. The keystreams must
+// start after the first 1024 bytes.
+func TestKeyVector(t *testing.T) {
+	a := new(big.Int).SetBytes(bytes.Repeat([]byte{0x11}, 20))
+	b := new(big.Int).SetBytes(bytes.Repeat([]byte{0x22}, 20))
+	var skey [20]byte
+	for i := range skey {
+		skey[i] = byte(i)
+	}
+	publicB := padded(new(big.Int).Exp(generator, b, prime))
+	secret, err := sharedSecret(a, publicB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ef037082d79ae7baeddb00b3ba4f24ec8a79c06c927258e89e01c46f8249187e672c919b9ff29abeb97fd230f6302fb1" +
+		"21a5bad27c4c34e48722446a121d5e213b13e9eeb6dd23716be80c8a1cf31af29589c5245e74b3b8713d6b229ce05731"
+	if hex.EncodeToString(secret) != want {
+		t.Fatalf("shared secret %x, want %s", secret, want)
+	}
+	publicA := padded(new(big.Int).Exp(generator, a, prime))
+	if other, _ := sharedSecret(b, publicA); !bytes.Equal(other, secret) {
+		t.Error("the two sides computed different secrets")
+	}
+	if got := hex.EncodeToString(hash([]byte("req1"), secret)); got != "32dd7e3b16e8d7a1b444ea3f4167e202514f9feb" {
+		t.Errorf("HASH('req1', S) = %s", got)
+	}
+
+	tests := []struct {
+		name      string
+		skipped   string // The first 16 bytes of the keystream, which must be discarded
+		keystream string // The 16 bytes after the first 1024
+	}{
+		{"keyA", "1dd576c4049671057613b7d1e5f2483d", "9529bd86a508fa4a07dcfad827e34361"},
+		{"keyB", "850a5e1667bd00f301c79ca487abb2b0", "bdb873b37b8af573903872af791f1856"},
+	}
+	for _, tt := range tests {
+		c, err := newRC4(tt.name, secret, skey[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 16)
+		c.XORKeyStream(got, got)
+		if hex.EncodeToString(got) == tt.skipped {
+			t.Errorf("%s keystream starts at byte 0, the first %d bytes were not discarded", tt.name, rc4Discard)
+		}
+		if hex.EncodeToString(got) != tt.keystream {
+			t.Errorf("%s keystream %x, want %s", tt.name, got, tt.keystream)
+		}
+	}
+}
+
+func TestSyncOn(t *testing.T) {
+	pattern := []byte("marker")
+	tests := []struct {
+		name    string
+		in      string
+		rest    string
+		wantErr bool
+	}{
+		{"at once", "markerrest", "rest", false},
+		{"after padding", strings.Repeat("x", 100) + "markerrest", "rest", false},
+		{"overlapping", "mamarkerrest", "rest", false},
+		{"missing", strings.Repeat("x", 100), "", true},
+		{"beyond the padding limit", strings.Repeat("x", maxPad+1) + "marker", "", true},
+	}
+	for _, tt := range tests {
+		r := strings.NewReader(tt.in)
+		err := syncOn(r, pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: syncOn error = %v", tt.name, err)
+			continue
+		}
+		if rest, _ := io.ReadAll(r); !tt.wantErr && string(rest) != tt.rest {
+			t.Errorf("%s: left %q, want %q", tt.name, rest, tt.rest)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 )
 
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	ID   *[20]byte // Peer ID reported by the tracker, nil if unknown
 }
 
 func (p *Peer) String() string {
@@ -20,6 +22,23 @@ func (p *Peer) String() string {
 	return fmt.Sprintf("%s:%d", ipStr, p.Port)
 }
 
+// FromAddr converts a network address of the form host:port into a Peer
+func FromAddr(addr net.Addr) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Peer{}, fmt.Errorf("invalid peer IP %q", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Peer{}, err
+	}
+	return Peer{IP: ip, Port: uint16(port)}, nil
+}
+
 func UnmarshalBinary(peersBin []byte) ([]Peer, error) {
 	const peerSize = 6 // 4 for IP, 2 for port
 	numPeers := len(peersBin) / peerSize
@@ -58,9 +77,16 @@ func UnmarshalDict(dicts []map[string]interface{}) ([]Peer, error) {
 			}
 		}
 
+		var id *[20]byte
+		if idStr, ok := entry["peer id"].(string); ok && len(idStr) == 20 {
+			id = new([20]byte)
+			copy(id[:], idStr)
+		}
+
 		peers = append(peers, Peer{
 			IP:   ip,
 			Port: uint16(portFloat),
+			ID:   id,
 		})
 	}
 	return peers, nil
@@ -0,0 +1,267 @@
+package peerpool
+
+import (
+	"client/peer"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Source tells where the pool learned about a peer
+type Source int
+
+const (
+	SourceTracker Source = iota
+	SourceIncoming
+	SourceLSD // Announced on the local network
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceIncoming:
+		return "incoming"
+	case SourceLSD:
+		return "lsd"
+	default:
+		return "unknown"
+	}
+}
+
+// Backoff bounds: a peer that failed n times waits BaseBackoff * 2^(n-1), at most MaxBackoff
+const (
+	BaseBackoff = 15 * time.Second
+	MaxBackoff  = 10 * time.Minute
+)
+
+// Entry is everything the pool knows about one peer address
+type Entry struct {
+	Peer        peer.Peer
+	Source      Source
+	Failures    int       // Consecutive failed attempts, reset on a successful handshake
+	LastAttempt time.Time // Zero if never dialed
+	Dialing     bool      // An attempt is in progress
+	Connected   bool      // The peer completed a handshake and is still connected
+	Dropped     bool      // Never dial the address again, e.g. it is ourselves
+	NoUTP       bool      // The peer did not answer uTP but did answer TCP
+}
+
+// NextAttempt returns the earliest time the peer may be dialed again
+func (e *Entry) NextAttempt() time.Time {
+	if e.Failures == 0 {
+		return e.LastAttempt
+	}
+	backoff := BaseBackoff << (e.Failures - 1)
+	if backoff > MaxBackoff || backoff <= 0 {
+		backoff = MaxBackoff
+	}
+	return e.LastAttempt.Add(backoff)
+}
+
+// Pool records every known peer of a torrent and hands out the ones due for a connection attempt
+type Pool struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+	order   []string                      // Insertion order, so older peers are tried first
+	banned  map[string]string             // Banned IP addresses and why they were banned
+	ids     map[[20]byte]bool             // Peer IDs with an established connection
+	open    map[string]map[io.Closer]bool // Established connections by IP, closed on a ban
+}
+
+// New creates an empty pool
+func New() *Pool {
+	return &Pool{
+		entries: make(map[string]*Entry),
+		banned:  make(map[string]string),
+		ids:     make(map[[20]byte]bool),
+		open:    make(map[string]map[io.Closer]bool),
+	}
+}
+
+// Add records peers from source, returning how many were not known before
+func (p *Pool) Add(peers []peer.Peer, source Source) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	added := 0
+	for _, pr := range peers {
+		key := pr.String()
+		if _, ok := p.entries[key]; ok {
+			continue
+		}
+		p.entries[key] = &Entry{Peer: pr, Source: source}
+		p.order = append(p.order, key)
+		added++
+	}
+	return added
+}
+
+// Ready returns the peers that are neither connected nor being dialed and whose backoff has elapsed
+func (p *Pool) Ready(now time.Time) []peer.Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ready []peer.Peer
+	for _, key := range p.order {
+		e := p.entries[key]
+		if e.Dialing || e.Connected || e.Dropped || now.Before(e.NextAttempt()) {
+			continue
+		}
+		if _, ok := p.banned[e.Peer.IP.String()]; ok {
+			continue
+		}
+		ready = append(ready, e.Peer)
+	}
+	return ready
+}
+
+// update applies fn to the entry of pr, adding it as an incoming peer if unknown
+func (p *Pool) update(pr peer.Peer, fn func(e *Entry)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := pr.String()
+	e, ok := p.entries[key]
+	if !ok {
+		e = &Entry{Peer: pr, Source: SourceIncoming}
+		p.entries[key] = e
+		p.order = append(p.order, key)
+	}
+	fn(e)
+}
+
+// Attempt marks the start of a dial to pr
+func (p *Pool) Attempt(pr peer.Peer, now time.Time) {
+	p.update(pr, func(e *Entry) {
+		e.Dialing = true
+		e.LastAttempt = now
+	})
+}
+
+// Connected marks pr as connected and clears its failures
+func (p *Pool) Connected(pr peer.Peer) {
+	p.update(pr, func(e *Entry) {
+		e.Dialing = false
+		e.Connected = true
+		e.Failures = 0
+	})
+}
+
+// Failed records a failed attempt or a connection dropped because of an error
+func (p *Pool) Failed(pr peer.Peer) {
+	p.update(pr, func(e *Entry) {
+		e.Dialing = false
+		e.Connected = false
+		e.Failures++
+	})
+}
+
+// Disconnected records a connection that ended without an error
+func (p *Pool) Disconnected(pr peer.Peer) {
+	p.update(pr, func(e *Entry) {
+		e.Dialing = false
+		e.Connected = false
+	})
+}
+
+// Drop stops the pool from handing out pr again. Unlike Ban, other ports of the IP stay usable.
+func (p *Pool) Drop(pr peer.Peer) {
+	p.update(pr, func(e *Entry) {
+		e.Dialing = false
+		e.Connected = false
+		e.Dropped = true
+	})
+}
+
+// SetNoUTP remembers that pr only answers TCP
+func (p *Pool) SetNoUTP(pr peer.Peer) {
+	p.update(pr, func(e *Entry) {
+		e.NoUTP = true
+	})
+}
+
+// TriesUTP tells if pr should be dialed over uTP first
+func (p *Pool) TriesUTP(pr peer.Peer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[pr.String()]
+	return !ok || !e.NoUTP
+}
+
+// ClaimID records an established connection to the peer with id. It returns false if the
+// peer is already connected, in which case the new connection is a duplicate.
+func (p *Pool) ClaimID(id [20]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ids[id] {
+		return false
+	}
+	p.ids[id] = true
+	return true
+}
+
+// ReleaseID forgets a connection recorded with ClaimID
+func (p *Pool) ReleaseID(id [20]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.ids, id)
+}
+
+// Ban stops the pool from handing out any address of ip, recording why, and closes the
+// connections to it that are still open
+func (p *Pool) Ban(ip net.IP, reason string) {
+	p.mu.Lock()
+	key := ip.String()
+	p.banned[key] = reason
+	conns := p.open[key]
+	delete(p.open, key)
+	p.mu.Unlock()
+	for c := range conns {
+		c.Close()
+	}
+}
+
+// Track records an open connection to ip so that banning ip closes it. The returned function
+// forgets the connection and must be called once it is closed.
+func (p *Pool) Track(ip net.IP, c io.Closer) (untrack func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := ip.String()
+	if p.open[key] == nil {
+		p.open[key] = make(map[io.Closer]bool)
+	}
+	p.open[key][c] = true
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.open[key], c)
+		if len(p.open[key]) == 0 {
+			delete(p.open, key)
+		}
+	}
+}
+
+// Banned tells if ip was banned
+func (p *Pool) Banned(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.banned[ip.String()]
+	return ok
+}
+
+// Len returns the number of known peers
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// Entries returns a snapshot of every entry in insertion order
+func (p *Pool) Entries() []Entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := make([]Entry, 0, len(p.order))
+	for _, key := range p.order {
+		entries = append(entries, *p.entries[key])
+	}
+	return entries
+}
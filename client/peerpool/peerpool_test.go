@@ -0,0 +1,73 @@
+package peerpool
+
+import (
+	"client/peer"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNextAttempt(t *testing.T) {
+	last := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", 0, 0},
+		{"first failure", 1, 15 * time.Second},
+		{"second failure", 2, 30 * time.Second},
+		{"third failure", 3, time.Minute},
+		{"sixth failure", 6, 8 * time.Minute},
+		{"capped", 7, MaxBackoff},
+		{"overflow", 64, MaxBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Entry{Failures: tt.failures, LastAttempt: last}
+			if got := e.NextAttempt().Sub(last); got != tt.want {
+				t.Errorf("backoff after %d failures = %v, want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	now := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	a := peer.Peer{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	b := peer.Peer{IP: net.ParseIP("10.0.0.2"), Port: 6881}
+	tests := []struct {
+		name  string
+		setup func(p *Pool)
+		after time.Duration
+		want  []peer.Peer
+	}{
+		{"new", func(p *Pool) {}, 0, []peer.Peer{a, b}},
+		{"dialing", func(p *Pool) { p.Attempt(a, now) }, 0, []peer.Peer{b}},
+		{"connected", func(p *Pool) { p.Attempt(a, now); p.Connected(a) }, time.Hour, []peer.Peer{b}},
+		{"disconnected", func(p *Pool) { p.Attempt(a, now); p.Connected(a); p.Disconnected(a) }, 0, []peer.Peer{a, b}},
+		{"backing off", func(p *Pool) { p.Attempt(a, now); p.Failed(a) }, 14 * time.Second, []peer.Peer{b}},
+		{"backoff over", func(p *Pool) { p.Attempt(a, now); p.Failed(a) }, 15 * time.Second, []peer.Peer{a, b}},
+		{"failures reset", func(p *Pool) {
+			p.Attempt(a, now)
+			p.Failed(a)
+			p.Attempt(a, now)
+			p.Connected(a)
+			p.Disconnected(a)
+		}, 0, []peer.Peer{a, b}},
+		{"dropped", func(p *Pool) { p.Drop(a) }, time.Hour, []peer.Peer{b}},
+		{"banned", func(p *Pool) { p.Ban(b.IP, "test") }, 0, []peer.Peer{a}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New()
+			p.Add([]peer.Peer{a, b}, SourceTracker)
+			tt.setup(p)
+			got := p.Ready(now.Add(tt.after))
+			if !slices.EqualFunc(got, tt.want, func(x, y peer.Peer) bool { return x.IP.Equal(y.IP) && x.Port == y.Port }) {
+				t.Errorf("Ready() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
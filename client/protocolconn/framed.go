@@ -0,0 +1,141 @@
+package protocolconn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MaxFrameSize is the largest payload sealed into a single frame. Larger writes are split.
+const MaxFrameSize = 0x10000
+
+// lengthSize is the size of the frame header before sealing
+const lengthSize = 4
+
+// ErrFrameAuth is returned when a frame was tampered with, truncated or replayed
+var ErrFrameAuth = errors.New("frame authentication failed")
+
+// FramedConn is a net.Conn that seals every write into AES-GCM frames. A frame is the sealed
+// 4-byte payload length followed by the sealed payload, so not even message lengths are visible
+// on the wire. Nonces are per-direction sequence numbers, so reordered, replayed or dropped
+// frames fail authentication.
+type FramedConn struct {
+	net.Conn
+	writeMu   sync.Mutex
+	sendAEAD  cipher.AEAD
+	sendIV    []byte
+	sendSeq   uint64
+	recvAEAD  cipher.AEAD
+	recvIV    []byte
+	recvSeq   uint64
+	pending   []byte // Opened payload not yet returned by Read
+	lengthBuf []byte
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewFramedConn wraps conn with separate keys and IVs for each direction
+func NewFramedConn(conn net.Conn, sendKey, recvKey, sendIV, recvIV []byte) (*FramedConn, error) {
+	sendAEAD, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sendIV) < sendAEAD.NonceSize() || len(recvIV) < recvAEAD.NonceSize() {
+		return nil, errors.New("IV shorter than the AEAD nonce")
+	}
+	return &FramedConn{
+		Conn:      conn,
+		sendAEAD:  sendAEAD,
+		sendIV:    sendIV[:sendAEAD.NonceSize()],
+		recvAEAD:  recvAEAD,
+		recvIV:    recvIV[:recvAEAD.NonceSize()],
+		lengthBuf: make([]byte, lengthSize+recvAEAD.Overhead()),
+	}, nil
+}
+
+// nonce XORs the sequence number into the end of the IV and advances it
+func nonce(iv []byte, seq *uint64) []byte {
+	n := make([]byte, len(iv))
+	copy(n, iv)
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], *seq)
+	for i := range seqBuf {
+		n[len(n)-8+i] ^= seqBuf[i]
+	}
+	*seq++
+	return n
+}
+
+func (c *FramedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		var header [lengthSize]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(chunk)))
+		frame := c.sendAEAD.Seal(nil, nonce(c.sendIV, &c.sendSeq), header[:], nil)
+		frame = c.sendAEAD.Seal(frame, nonce(c.sendIV, &c.sendSeq), chunk, nil)
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// readFrame reads and opens the next frame into pending
+func (c *FramedConn) readFrame() error {
+	if _, err := io.ReadFull(c.Conn, c.lengthBuf); err != nil {
+		return err
+	}
+	header, err := c.recvAEAD.Open(nil, nonce(c.recvIV, &c.recvSeq), c.lengthBuf, nil)
+	if err != nil {
+		return ErrFrameAuth
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxFrameSize {
+		return errors.New("frame exceeds the maximum size")
+	}
+	sealed := make([]byte, int(length)+c.recvAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	payload, err := c.recvAEAD.Open(sealed[:0], nonce(c.recvIV, &c.recvSeq), sealed, nil)
+	if err != nil {
+		return ErrFrameAuth
+	}
+	c.pending = payload
+	return nil
+}
+
+func (c *FramedConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,185 @@
+package protocolconn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+)
+
+// The AES transport starts with an ephemeral X25519 key exchange:
+//
+//	initiator -> receiver: kxMagic, initiator public key
+//	receiver -> initiator: receiver public key
+//	initiator -> receiver: initiator confirmation
+//	receiver -> initiator: receiver confirmation
+//
+// Keys are derived with HKDF-SHA256 from the shared secret, salted with the infohash, so the
+// confirmations prove that both sides know the torrent without sending the infohash. Each
+// direction gets its own key and IV for the AES-GCM framing (see FramedConn).
+//
+// A private swarm also mixes its pre-shared secret into the salt, so a peer that knows the
+// infohash but not the secret fails the confirmation and never gets to send a handshake.
+
+// kxMagic identifies the AES transport's key exchange
+var kxMagic = []byte("GTKX\x02")
+
+// Swarm identifies a torrent a peer may connect to: its infohash and, for a private swarm, the
+// pre-shared secret. An empty Secret means the torrent is public.
+type Swarm struct {
+	InfoHash [20]byte
+	Secret   []byte
+}
+
+func (s Swarm) salt() []byte {
+	return append(append([]byte{}, s.InfoHash[:]...), s.Secret...)
+}
+
+// IsKeyExchange tells if prefix, the first bytes sent by a peer, starts the AES key exchange
+func IsKeyExchange(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, kxMagic)
+}
+
+const (
+	keySize     = 32 // AES-256
+	confirmSize = sha256.Size
+	kxInfo      = "gotorrent aes kx v2"
+)
+
+type sessionKeys struct {
+	initiatorKey, initiatorIV []byte // Protect initiator -> receiver traffic
+	receiverKey, receiverIV   []byte // Protect receiver -> initiator traffic
+	initiatorConfirm          []byte
+	receiverConfirm           []byte
+}
+
+// hkdf derives length bytes from secret as described in RFC 5869
+func hkdf(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+func deriveKeys(shared, initiatorPublic, receiverPublic []byte, swarm Swarm) *sessionKeys {
+	info := append(append([]byte(kxInfo), initiatorPublic...), receiverPublic...)
+	okm := hkdf(shared, swarm.salt(), info, 2*keySize+2*aes.BlockSize+2*confirmSize)
+	next := func(n int) []byte {
+		part := okm[:n]
+		okm = okm[n:]
+		return part
+	}
+	return &sessionKeys{
+		initiatorKey:     next(keySize),
+		initiatorIV:      next(aes.BlockSize),
+		receiverKey:      next(keySize),
+		receiverIV:       next(aes.BlockSize),
+		initiatorConfirm: next(confirmSize),
+		receiverConfirm:  next(confirmSize),
+	}
+}
+
+func generateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func readPublicKey(r io.Reader) (*ecdh.PublicKey, []byte, error) {
+	buf := make([]byte, 32)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	public, err := ecdh.X25519().NewPublicKey(buf)
+	return public, buf, err
+}
+
+// Initiate runs the initiating side of the key exchange for swarm
+func Initiate(conn net.Conn, swarm Swarm) (*ProtocolConn, error) {
+	private, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	publicBytes := private.PublicKey().Bytes()
+	if _, err := conn.Write(append(append([]byte{}, kxMagic...), publicBytes...)); err != nil {
+		return nil, err
+	}
+	remote, remoteBytes, err := readPublicKey(conn)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+	keys := deriveKeys(shared, publicBytes, remoteBytes, swarm)
+	if _, err := conn.Write(keys.initiatorConfirm); err != nil {
+		return nil, err
+	}
+	confirm := make([]byte, confirmSize)
+	if _, err := io.ReadFull(conn, confirm); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(confirm, keys.receiverConfirm) {
+		return nil, errors.New("key exchange confirmation failed")
+	}
+	return NewFramed(conn, keys.initiatorKey, keys.receiverKey, keys.initiatorIV, keys.receiverIV)
+}
+
+// Accept runs the receiving side of the key exchange. swarms are the torrents the peer may
+// connect to; the infohash of the one it proved knowledge of is returned.
+func Accept(conn net.Conn, swarms []Swarm) (*ProtocolConn, [20]byte, error) {
+	var infoHash [20]byte
+	magic := make([]byte, len(kxMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return nil, infoHash, err
+	}
+	if !bytes.Equal(magic, kxMagic) {
+		return nil, infoHash, errors.New("peer did not start an AES key exchange")
+	}
+	remote, remoteBytes, err := readPublicKey(conn)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	private, err := generateKey()
+	if err != nil {
+		return nil, infoHash, err
+	}
+	publicBytes := private.PublicKey().Bytes()
+	if _, err := conn.Write(publicBytes); err != nil {
+		return nil, infoHash, err
+	}
+	shared, err := private.ECDH(remote)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	confirm := make([]byte, confirmSize)
+	if _, err := io.ReadFull(conn, confirm); err != nil {
+		return nil, infoHash, err
+	}
+	for _, candidate := range swarms {
+		keys := deriveKeys(shared, remoteBytes, publicBytes, candidate)
+		if !hmac.Equal(confirm, keys.initiatorConfirm) {
+			continue
+		}
+		if _, err := conn.Write(keys.receiverConfirm); err != nil {
+			return nil, infoHash, err
+		}
+		pc, err := NewFramed(conn, keys.receiverKey, keys.initiatorKey, keys.receiverIV, keys.initiatorIV)
+		return pc, candidate.InfoHash, err
+	}
+	return nil, infoHash, errors.New("peer asked for an unknown torrent")
+}
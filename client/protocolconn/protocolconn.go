@@ -1,49 +1,50 @@
 package protocolconn
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 )
 
+// ErrTooLarge is returned when a peer announces a message longer than the reader accepts.
+// The stream cannot be resynchronised afterwards, so the connection must be dropped.
+var ErrTooLarge = errors.New("peer message exceeds the maximum length")
+
 type ProtocolConn struct {
 	EncryptedReader io.Reader // decrypting reader
 	EncryptedWriter io.Writer // encrypting writer
 	RawReadWriter   io.ReadWriteCloser
 }
 
-func New(conn net.Conn, encKey, decKey, encIV, decIV []byte) (*ProtocolConn, error) {
-	// Outgoing (encrypt)
-	encBlock, err := aes.NewCipher(encKey)
-	if err != nil {
-		return nil, err
+// NewStream wraps a connection that needs no per-message encryption, either because it is
+// plaintext or because the whole stream is already encrypted (e.g. by MSE or FramedConn)
+func NewStream(rw io.ReadWriteCloser) *ProtocolConn {
+	return &ProtocolConn{
+		EncryptedReader: rw,
+		EncryptedWriter: rw,
+		RawReadWriter:   rw,
 	}
-	encStream := cipher.NewCTR(encBlock, encIV)
+}
 
-	// Incoming (decrypt)
-	decBlock, err := aes.NewCipher(decKey)
+// NewFramed wraps conn in the authenticated AES-GCM framing with a key and IV per direction
+func NewFramed(conn net.Conn, sendKey, recvKey, sendIV, recvIV []byte) (*ProtocolConn, error) {
+	framed, err := NewFramedConn(conn, sendKey, recvKey, sendIV, recvIV)
 	if err != nil {
 		return nil, err
 	}
-	decStream := cipher.NewCTR(decBlock, decIV)
-
-	return &ProtocolConn{
-		EncryptedReader: &cipher.StreamReader{S: decStream, R: conn},
-		EncryptedWriter: &cipher.StreamWriter{S: encStream, W: conn},
-		RawReadWriter:   conn,
-	}, nil
+	return NewStream(framed), nil
 }
 
+// Read reads one length-prefixed message into p. A message longer than p is rejected with
+// ErrTooLarge before any of its payload is read.
 func (pc *ProtocolConn) Read(p []byte) (int, error) {
 	var n uint32
 	if err := binary.Read(pc.RawReadWriter, binary.BigEndian, &n); err != nil {
 		return 0, err
 	}
 	if int(n) > len(p) {
-		return 0, io.ErrShortBuffer
+		return 0, ErrTooLarge
 	}
 	if _, err := io.ReadFull(pc.EncryptedReader, p[:n]); err != nil {
 		return 0, err
@@ -51,7 +52,12 @@ func (pc *ProtocolConn) Read(p []byte) (int, error) {
 	return int(n), nil
 }
 
+// Write sends one serialized message, length prefix included. A stream encrypted as a whole
+// gets the message in a single write, so FramedConn seals it into one frame.
 func (pc *ProtocolConn) Write(p []byte) (int, error) {
+	if pc.EncryptedWriter == pc.RawReadWriter {
+		return pc.RawReadWriter.Write(p)
+	}
 	if err := binary.Write(pc.RawReadWriter, binary.BigEndian, uint32(len(p))-4); err != nil {
 		return 0, err
 	}
@@ -61,17 +67,3 @@ func (pc *ProtocolConn) Write(p []byte) (int, error) {
 	}
 	return 4 + written, nil
 }
-
-func GenerateRandomKeyIV() (key, iv []byte, err error) {
-	key = make([]byte, 32) // AES-256
-	iv = make([]byte, aes.BlockSize)
-	_, err = rand.Read(key)
-	if err != nil {
-		return nil, nil, err
-	}
-	_, err = rand.Read(iv)
-	if err != nil {
-		return nil, nil, err
-	}
-	return key, iv, nil
-}
@@ -0,0 +1,121 @@
+package protocolconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// countingConn counts the writes reaching the network
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// framedPair returns the two ends of a framed connection over an in-memory pipe
+func framedPair(t *testing.T) (client *ProtocolConn, server *ProtocolConn, raw *countingConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	raw = &countingConn{Conn: a}
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	iv1, iv2 := bytes.Repeat([]byte{3}, 12), bytes.Repeat([]byte{4}, 12)
+	client, err := NewFramed(raw, key1, key2, iv1, iv2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewFramed(b, key2, key1, iv2, iv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server, raw
+}
+
+// serialize prefixes a message payload with its length
+func serialize(payload []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+func TestFramedMessageIsOneFrame(t *testing.T) {
+	client, server, raw := framedPair(t)
+	msgs := [][]byte{
+		serialize([]byte{4, 0, 0, 0, 7}),
+		serialize([]byte{6, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0}),
+		serialize(bytes.Repeat([]byte{7}, 3*MaxFrameSize/2)),
+	}
+	go func() {
+		for _, msg := range msgs {
+			if _, err := client.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 2*MaxFrameSize)
+	for _, msg := range msgs {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg[4:]) {
+			t.Errorf("read %d bytes, want %d", n, len(msg)-4)
+		}
+	}
+	// Two small messages and a large one split at MaxFrameSize
+	if raw.writes != 4 {
+		t.Errorf("%d frames written, want 4", raw.writes)
+	}
+}
+
+func TestReadTooLarge(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go NewStream(a).Write(serialize(make([]byte, 13)))
+	if _, err := NewStream(b).Read(make([]byte, 8)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Read = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestFrameTampered(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	key, iv := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12)
+	sender, err := NewFramedConn(a, key, key, iv, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewFramedConn(&flipConn{Conn: b, at: 30}, key, key, iv, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sender.Write([]byte("attack at dawn"))
+	if _, err := io.ReadFull(receiver, make([]byte, 14)); !errors.Is(err, ErrFrameAuth) {
+		t.Errorf("Read = %v, want ErrFrameAuth", err)
+	}
+}
+
+// flipConn flips a bit in the byte at the given stream offset
+type flipConn struct {
+	net.Conn
+	at   int
+	read int
+}
+
+func (c *flipConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if i := c.at - c.read; i >= 0 && i < n {
+		p[i] ^= 1
+	}
+	c.read += n
+	return n, err
+}
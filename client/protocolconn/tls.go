@@ -0,0 +1,72 @@
+package protocolconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// The TLS transport authenticates both sides with certificates issued by a shared CA. Peers are
+// dialed by IP address, so the chain is verified against the CA without checking host names.
+
+// NewTLSConfig returns a configuration presenting cert and accepting only peers whose
+// certificate chains to ca. The same configuration serves both sides of a connection.
+func NewTLSConfig(cert tls.Certificate, ca *x509.CertPool) *tls.Config {
+	verify := func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         ca,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		return err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// Host name verification does not apply to peers, VerifyConnection checks the chain instead
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyConnection:   verify,
+	}
+}
+
+// maxTLSRecord is the largest plaintext TLS record, 2^14 bytes
+const maxTLSRecord = 1 << 14
+
+// IsTLS tells if prefix, the first bytes sent by a peer, starts a TLS ClientHello: a handshake
+// record of a TLS 1.x version with a valid length, holding a ClientHello message. Checking all
+// of them keeps a random MSE public key from passing as TLS.
+func IsTLS(prefix []byte) bool {
+	if len(prefix) < 6 || prefix[0] != 0x16 || prefix[1] != 0x03 || prefix[2] > 0x04 {
+		return false
+	}
+	length := binary.BigEndian.Uint16(prefix[3:5])
+	return length > 0 && length <= maxTLSRecord && prefix[5] == 0x01
+}
+
+// InitiateTLS runs the client side of the TLS handshake
+func InitiateTLS(conn net.Conn, config *tls.Config) (*ProtocolConn, error) {
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return NewStream(tlsConn), nil
+}
+
+// AcceptTLS runs the server side of the TLS handshake
+func AcceptTLS(conn net.Conn, config *tls.Config) (*ProtocolConn, error) {
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return NewStream(tlsConn), nil
+}
@@ -0,0 +1,54 @@
+package protocolconn
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first bytes a TLS client sends
+func clientHello(t *testing.T) []byte {
+	t.Helper()
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		tls.Client(a, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		a.Close()
+	}()
+	prefix := make([]byte, 20)
+	if _, err := io.ReadFull(b, prefix); err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+func TestIsTLS(t *testing.T) {
+	hello := clientHello(t)
+	with := func(i int, v ...byte) []byte {
+		p := append([]byte(nil), hello...)
+		copy(p[i:], v)
+		return p
+	}
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   bool
+	}{
+		{"client hello", hello, true},
+		{"short", hello[:5], false},
+		{"alert record", with(0, 0x15), false},
+		{"unknown version", with(2, 0x05), false},
+		{"empty record", with(3, 0x00, 0x00), false},
+		{"record too long", with(3, 0x40, 0x01), false},
+		{"server hello", with(5, 0x02), false},
+		{"random key", []byte{0x16, 0x03, 0xa7, 0x5c, 0x21, 0x9e, 0x44, 0x0b}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTLS(tt.prefix); got != tt.want {
+				t.Errorf("IsTLS(%x) = %v, want %v", tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type is the protocol spoken to the proxy server
+type Type int
+
+const (
+	None   Type = iota // Connect directly
+	SOCKS5             // SOCKS5, which also relays UDP through UDP ASSOCIATE
+	HTTP               // HTTP CONNECT, TCP only
+)
+
+var typeNames = []string{"NONE", "SOCKS5", "HTTP"}
+
+func (t Type) String() string {
+	if t < 0 || int(t) >= len(typeNames) {
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+	return typeNames[t]
+}
+
+func (t Type) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Type) UnmarshalText(text []byte) error {
+	for i, name := range typeNames {
+		if name == string(text) {
+			*t = Type(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown proxy type %q", text)
+}
+
+// ParseType converts a name from String back into a Type
+func ParseType(name string) (Type, error) {
+	var t Type
+	err := t.UnmarshalText([]byte(name))
+	return t, err
+}
+
+// Config describes the proxy outgoing connections are routed through
+type Config struct {
+	Type     Type   `json:"type"`
+	Address  string `json:"address"` // host:port of the proxy server
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Only     bool   `json:"only"` // Refuse direct connections when the proxy is unavailable
+}
+
+// ErrUnavailable is returned when the proxy server cannot be reached or refuses us
+var ErrUnavailable = errors.New("proxy unavailable")
+
+// ErrUnbound is returned while the address connections must be bound to cannot be resolved
+var ErrUnbound = errors.New("bind address unavailable")
+
+// ErrUnsupported is returned for traffic the configured proxy cannot carry, e.g. UDP over HTTP CONNECT
+var ErrUnsupported = errors.New("not supported by the proxy")
+
+// Dialer opens outgoing connections through the configured proxy. With no proxy, or when the
+// proxy is unavailable and Only is not set, it connects directly.
+type Dialer struct {
+	mu      sync.RWMutex
+	config  Config
+	localIP func() (net.IP, error) // Source address of every connection, nil to let the kernel pick
+	shared  func(addr string) (net.Conn, error)
+}
+
+// NewDialer creates a dialer that connects directly
+func NewDialer() *Dialer {
+	return &Dialer{}
+}
+
+// Configure replaces the proxy settings used by later dials
+func (d *Dialer) Configure(config Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config = config
+}
+
+// Config returns the current proxy settings
+func (d *Dialer) Config() Config {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.config
+}
+
+// SetLocalIP binds later connections, including those to the proxy, to the address resolve
+// returns at the time of each dial. Dials fail with ErrUnbound while it returns an error, so
+// that traffic never leaves through another interface. A nil resolve or IP unbinds them.
+func (d *Dialer) SetLocalIP(resolve func() (net.IP, error)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.localIP = resolve
+}
+
+// SetSharedUDP makes direct UDP connections use the socket dial returns a connection over, such
+// as the socket uTP listens on, so that they leave from the torrent port. When dial returns nil
+// the connection gets a socket of its own.
+func (d *Dialer) SetSharedUDP(dial func(addr string) (net.Conn, error)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.shared = dial
+}
+
+// Enabled tells if connections are routed through a proxy
+func (d *Dialer) Enabled() bool {
+	return d.Config().Type != None
+}
+
+// DialContext connects to addr over TCP. network is only used for direct connections, so that
+// callers can still force e.g. "tcp4".
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	config := d.Config()
+	if config.Type == None {
+		return d.dialDirect(ctx, network, addr)
+	}
+	conn, err := d.dialProxy(ctx, config)
+	if err == nil {
+		tunnel := conn
+		switch config.Type {
+		case SOCKS5:
+			err = socksConnect(conn, config, addr)
+		case HTTP:
+			tunnel, err = httpConnect(conn, config, addr)
+		}
+		if err == nil {
+			tunnel.SetDeadline(time.Time{})
+			return tunnel, nil
+		}
+		conn.Close()
+	}
+	return d.fallback(ctx, config, network, addr, err)
+}
+
+// DialTimeout is DialContext with a timeout instead of a context
+func (d *Dialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialUDP returns a connection whose writes are sent as datagrams to addr and whose reads return
+// the datagrams received from it. Through SOCKS5 the datagrams are relayed by UDP ASSOCIATE.
+func (d *Dialer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	config := d.Config()
+	switch config.Type {
+	case None:
+		d.mu.RLock()
+		shared := d.shared
+		d.mu.RUnlock()
+		if shared != nil {
+			if conn, err := shared(addr); conn != nil || err != nil {
+				return conn, err
+			}
+		}
+		return d.dialDirect(ctx, "udp", addr)
+	case SOCKS5:
+		conn, err := d.dialProxy(ctx, config)
+		if err == nil {
+			var relayed net.Conn
+			if relayed, err = d.socksAssociate(ctx, conn, config, addr); err == nil {
+				return relayed, nil
+			}
+			conn.Close()
+		}
+		return d.fallback(ctx, config, "udp", addr, err)
+	default:
+		return d.fallback(ctx, config, "udp", addr, fmt.Errorf("UDP: %w", ErrUnsupported))
+	}
+}
+
+// dialDirect connects to addr from the local IP, if one is set
+func (d *Dialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.RLock()
+	resolve := d.localIP
+	d.mu.RUnlock()
+	var localIP net.IP
+	if resolve != nil {
+		var err error
+		if localIP, err = resolve(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnbound, err)
+		}
+	}
+	var dialer net.Dialer
+	if localIP != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: localIP}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialProxy opens the TCP connection to the proxy server. The context deadline also bounds the
+// proxy handshake that follows.
+func (d *Dialer) dialProxy(ctx context.Context, config Config) (net.Conn, error) {
+	conn, err := d.dialDirect(ctx, "tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// fallback connects directly after the proxy failed, unless direct connections are refused or
+// the proxy was reached and the failure lies beyond it.
+func (d *Dialer) fallback(ctx context.Context, config Config, network, addr string, err error) (net.Conn, error) {
+	if config.Only || !(errors.Is(err, ErrUnavailable) || errors.Is(err, ErrUnsupported)) {
+		return nil, err
+	}
+	return d.dialDirect(ctx, network, addr)
+}
@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenTCP starts a loopback listener that serves every connection with handle
+func listenTCP(t *testing.T, handle func(net.Conn)) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// echoTCP starts a server echoing everything back, counting its connections
+func echoTCP(t *testing.T) (string, *counter) {
+	n := new(counter)
+	ln := listenTCP(t, func(conn net.Conn) {
+		n.add()
+		io.Copy(conn, conn)
+	})
+	return ln.Addr().String(), n
+}
+
+// echoUDP starts a server echoing every datagram back to its sender
+func echoUDP(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+type counter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *counter) add() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+}
+
+func (c *counter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// socksServer is a minimal SOCKS5 server supporting CONNECT and UDP ASSOCIATE
+type socksServer struct {
+	username, password string
+	refuse             byte     // Reply code for every request, 0 to serve them
+	commands           *counter // Requests served
+	datagrams          chan []byte
+}
+
+func startSOCKS(t *testing.T, s *socksServer) string {
+	s.commands = new(counter)
+	s.datagrams = make(chan []byte, 8)
+	return listenTCP(t, s.serve).Addr().String()
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var greeting [2]byte
+	if _, err := io.ReadFull(r, greeting[:]); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	want := byte(authNone)
+	if s.username != "" {
+		want = authPassword
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{socksVersion, 0xff})
+		return
+	}
+	conn.Write([]byte{socksVersion, want})
+	if want == authPassword {
+		var ver [1]byte
+		io.ReadFull(r, ver[:])
+		user, _ := readField(r)
+		pass, _ := readField(r)
+		if user != s.username || pass != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+	var req [3]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return
+	}
+	dst, err := readSocksAddr(r)
+	if err != nil {
+		return
+	}
+	if s.refuse != 0 {
+		conn.Write([]byte{socksVersion, s.refuse, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	s.commands.add()
+	switch req[1] {
+	case cmdConnect:
+		target, err := net.Dial("tcp", dst)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{socksVersion, 0, 0, atypIPv4, 127, 0, 0, 1, 0, 0})
+		go io.Copy(target, r)
+		io.Copy(conn, target)
+	case cmdAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		// Answer with the unspecified address, which the client replaces with the proxy's
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		reply := []byte{socksVersion, 0, 0, atypIPv4, 0, 0, 0, 0}
+		conn.Write(binary.BigEndian.AppendUint16(reply, uint16(port)))
+		go s.relay(relay)
+		io.Copy(io.Discard, r) // The relay lasts as long as the control connection
+	}
+}
+
+// relay forwards datagrams between the client and their destinations
+func (s *socksServer) relay(relay net.PacketConn) {
+	buf := make([]byte, 65535)
+	var client net.Addr
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			s.datagrams <- append([]byte(nil), buf[:n]...)
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			udpAddr, _ := net.ResolveUDPAddr("udp", dst)
+			relay.WriteTo(buf[n-r.Len():n], udpAddr)
+			continue
+		}
+		header, _ := socksAddr(from.String())
+		datagram := append(append([]byte{0, 0, 0}, header...), buf[:n]...)
+		relay.WriteTo(datagram, client)
+	}
+}
+
+func readField(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+// httpProxy is a minimal HTTP CONNECT proxy
+type httpProxy struct {
+	auth     string // Expected Proxy-Authorization, empty for none
+	greeting string // Sent right after the 200 reply, as a peer speaking first would
+	tunnels  *counter
+}
+
+func startHTTP(t *testing.T, p *httpProxy) string {
+	p.tunnels = new(counter)
+	return listenTCP(t, p.serve).Addr().String()
+}
+
+func (p *httpProxy) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	p.tunnels.add()
+	// Reply and greeting in one write, so that the client reads them together
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+p.greeting)
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+// roundTrip writes msg to conn and checks it comes back
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("read %q, want %q", buf, msg)
+	}
+}
+
+func dialer(config Config) *Dialer {
+	d := NewDialer()
+	d.Configure(config)
+	return d
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	target, direct := echoTCP(t)
+	server := &socksServer{}
+	d := dialer(Config{Type: SOCKS5, Address: startSOCKS(t, server)})
+	conn, err := d.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "through socks")
+	if server.commands.get() != 1 {
+		t.Errorf("proxy served %d requests, want 1", server.commands.get())
+	}
+	if direct.get() != 1 {
+		t.Errorf("target saw %d connections, want 1 from the proxy", direct.get())
+	}
+}
+
+func TestSOCKS5Password(t *testing.T) {
+	target, _ := echoTCP(t)
+	server := &socksServer{username: "user", password: "secret"}
+	address := startSOCKS(t, server)
+
+	d := dialer(Config{Type: SOCKS5, Address: address, Username: "user", Password: "secret", Only: true})
+	conn, err := d.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn, "authenticated")
+	conn.Close()
+
+	d = dialer(Config{Type: SOCKS5, Address: address, Username: "user", Password: "wrong", Only: true})
+	if _, err := d.DialTimeout("tcp", target, 5*time.Second); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("dial with a wrong password = %v, want ErrUnavailable", err)
+	}
+	if server.commands.get() != 1 {
+		t.Errorf("proxy served %d requests, want only the authenticated one", server.commands.get())
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	target := echoUDP(t)
+	server := &socksServer{}
+	d := dialer(Config{Type: SOCKS5, Address: startSOCKS(t, server), Only: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialUDP(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "datagram")
+
+	// The relay got RSV, FRAG, the destination and then the payload
+	datagram := <-server.datagrams
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	want := append([]byte{0, 0, 0, atypIPv4}, net.ParseIP(host).To4()...)
+	want = binary.BigEndian.AppendUint16(want, uint16(portNum))
+	want = append(want, "datagram"...)
+	if !bytes.Equal(datagram, want) {
+		t.Errorf("relay got % x, want % x", datagram, want)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target, _ := echoTCP(t)
+	proxy := &httpProxy{
+		auth:     "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")),
+		greeting: "hi",
+	}
+	address := startHTTP(t, proxy)
+
+	d := dialer(Config{Type: HTTP, Address: address, Username: "user", Password: "secret", Only: true})
+	conn, err := d.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Bytes that arrived with the reply are not lost
+	buf := make([]byte, 2)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("read %q, %v, want the greeting", buf, err)
+	}
+	roundTrip(t, conn, "through http")
+
+	d = dialer(Config{Type: HTTP, Address: address, Only: true})
+	if _, err := d.DialTimeout("tcp", target, 5*time.Second); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("dial without credentials = %v, want ErrUnavailable", err)
+	}
+}
+
+// closedAddr returns a loopback address nothing listens on
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestUnavailableProxy(t *testing.T) {
+	target, direct := echoTCP(t)
+	for _, typ := range []Type{SOCKS5, HTTP} {
+		t.Run(typ.String(), func(t *testing.T) {
+			d := dialer(Config{Type: typ, Address: closedAddr(t), Only: true})
+			if _, err := d.DialTimeout("tcp", target, 5*time.Second); !errors.Is(err, ErrUnavailable) {
+				t.Errorf("Only dial = %v, want ErrUnavailable", err)
+			}
+			before := direct.get()
+			d = dialer(Config{Type: typ, Address: closedAddr(t)})
+			conn, err := d.DialTimeout("tcp", target, 5*time.Second)
+			if err != nil {
+				t.Fatalf("fallback dial: %v", err)
+			}
+			defer conn.Close()
+			roundTrip(t, conn, "direct")
+			if direct.get() != before+1 {
+				t.Error("fallback did not connect directly")
+			}
+		})
+	}
+}
+
+func TestFallbackAfterFailedAuthentication(t *testing.T) {
+	target, _ := echoTCP(t)
+	server := &socksServer{username: "user", password: "secret"}
+	d := dialer(Config{Type: SOCKS5, Address: startSOCKS(t, server), Username: "user", Password: "wrong"})
+	conn, err := d.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		t.Fatalf("fallback dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "direct")
+	if server.commands.get() != 0 {
+		t.Error("the proxy served a request it should have refused")
+	}
+}
+
+func TestNoFallbackBeyondProxy(t *testing.T) {
+	target, direct := echoTCP(t)
+	server := &socksServer{refuse: 2} // Connection not allowed by ruleset
+	d := dialer(Config{Type: SOCKS5, Address: startSOCKS(t, server)})
+	_, err := d.DialTimeout("tcp", target, 5*time.Second)
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		t.Fatalf("dial refused by the proxy = %v, want the proxy's reason", err)
+	}
+	if direct.get() != 0 {
+		t.Error("a refusal by a working proxy fell back to a direct connection")
+	}
+}
+
+func TestHTTPProxyUDP(t *testing.T) {
+	target := echoUDP(t)
+	address := startHTTP(t, &httpProxy{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := dialer(Config{Type: HTTP, Address: address, Only: true})
+	if _, err := d.DialUDP(ctx, target); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Only UDP dial through HTTP = %v, want ErrUnsupported", err)
+	}
+	d = dialer(Config{Type: HTTP, Address: address})
+	conn, err := d.DialUDP(ctx, target)
+	if err != nil {
+		t.Fatalf("fallback UDP dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "direct datagram")
+}
+
+func TestTypeText(t *testing.T) {
+	for _, typ := range []Type{None, SOCKS5, HTTP} {
+		got, err := ParseType(typ.String())
+		if err != nil || got != typ {
+			t.Errorf("ParseType(%q) = %v, %v", typ.String(), got, err)
+		}
+	}
+	if _, err := ParseType("SOCKS4"); err == nil {
+		t.Error("ParseType accepted an unknown type")
+	}
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 constants from RFC 1928 and RFC 1929
+const (
+	socksVersion = 5
+
+	authNone     = 0
+	authPassword = 2
+
+	cmdConnect   = 1
+	cmdAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+var socksReplies = []string{
+	1: "general server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksConnect asks the proxy on conn to connect it to addr
+func socksConnect(conn net.Conn, config Config, addr string) error {
+	if err := socksAuthenticate(conn, config); err != nil {
+		return err
+	}
+	_, err := socksRequest(conn, cmdConnect, addr)
+	return err
+}
+
+// socksAuthenticate negotiates no authentication, or username/password when a username is set
+func socksAuthenticate(conn net.Conn, config Config) error {
+	method := byte(authNone)
+	if config.Username != "" {
+		method = authPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("%w: not a SOCKS5 server", ErrUnavailable)
+	}
+	if reply[1] != method {
+		return fmt.Errorf("%w: no acceptable SOCKS5 authentication method", ErrUnavailable)
+	}
+	if method != authPassword {
+		return nil
+	}
+	if len(config.Username) > 255 || len(config.Password) > 255 {
+		return errors.New("SOCKS5 username and password are limited to 255 bytes")
+	}
+	req := []byte{1, byte(len(config.Username))}
+	req = append(req, config.Username...)
+	req = append(req, byte(len(config.Password)))
+	req = append(req, config.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("%w: SOCKS5 authentication failed", ErrUnavailable)
+	}
+	return nil
+}
+
+// socksRequest sends a command for addr and returns the address bound by the proxy
+func socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	dst, err := socksAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	req := append([]byte{socksVersion, cmd, 0}, dst...)
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errors.New("malformed SOCKS5 reply")
+	}
+	if header[1] != 0 {
+		reason := "unknown error"
+		if int(header[1]) < len(socksReplies) {
+			reason = socksReplies[header[1]]
+		}
+		if cmd == cmdAssociate && header[1] == 7 {
+			return "", fmt.Errorf("SOCKS5 UDP ASSOCIATE: %w", ErrUnsupported)
+		}
+		return "", fmt.Errorf("SOCKS5 proxy: %s", reason)
+	}
+	return readSocksAddr(conn)
+}
+
+// socksAddr encodes addr as ATYP, DST.ADDR and DST.PORT. Host names are left to the proxy to
+// resolve, so that lookups do not leak around it.
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %q", host)
+		}
+		b = append([]byte{atypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{atypIPv4}, ip4...)
+	} else {
+		b = append([]byte{atypIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocksAddr reads an ATYP, ADDR and PORT triple and returns it as host:port
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown SOCKS5 address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksAssociate sets up a UDP relay for datagrams to addr. The relay lasts as long as the control
+// connection, so the returned conn owns it.
+func (d *Dialer) socksAssociate(ctx context.Context, ctrl net.Conn, config Config, addr string) (net.Conn, error) {
+	if err := socksAuthenticate(ctrl, config); err != nil {
+		return nil, err
+	}
+	header, err := socksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	// We do not know the address our datagrams will come from, so leave it to the proxy
+	relayAddr, err := socksRequest(ctrl, cmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	relayHost, relayPort, _ := net.SplitHostPort(relayAddr)
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		// The relay listens on the proxy's own address
+		proxyHost, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+		relayAddr = net.JoinHostPort(proxyHost, relayPort)
+	}
+	relay, err := d.dialDirect(ctx, "udp", relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+	c := &udpConn{Conn: relay, ctrl: ctrl, header: append([]byte{0, 0, 0}, header...)}
+	// The proxy closes the control connection when it drops the relay
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// udpConn carries datagrams for one destination through a SOCKS5 UDP relay
+type udpConn struct {
+	net.Conn          // The UDP socket connected to the relay
+	ctrl     net.Conn // The TCP connection that keeps the relay alive
+	header   []byte   // RSV, FRAG, ATYP, DST.ADDR and DST.PORT prepended to every datagram
+	once     sync.Once
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	datagram := append(append(make([]byte, 0, len(c.header)+len(p)), c.header...), p...)
+	if _, err := c.Conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the payload of the next datagram from the relay. Fragmented datagrams are
+// dropped, which RFC 1928 allows.
+func (c *udpConn) Read(p []byte) (int, error) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err := readSocksAddr(r); err != nil {
+			continue
+		}
+		return copy(p, buf[n-r.Len():n]), nil
+	}
+}
+
+func (c *udpConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = errors.Join(c.Conn.Close(), c.ctrl.Close())
+	})
+	return err
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+)
+
+// maxChunk bounds a single read or write so waits stay short and fair between peers
+const maxChunk = 0x4000
+
+// Conn is a net.Conn whose reads and writes pass through a set of limiters,
+// e.g. the session, torrent and peer limits
+type Conn struct {
+	net.Conn
+	mu    sync.RWMutex
+	read  []*Limiter
+	write []*Limiter
+}
+
+// NewConn wraps conn so reads wait on read and writes wait on write
+func NewConn(conn net.Conn, read, write *Limiter) *Conn {
+	c := &Conn{Conn: conn}
+	c.Attach(read, write)
+	return c
+}
+
+// Attach adds another pair of limiters to the connection. Nil limiters are ignored.
+func (c *Conn) Attach(read, write *Limiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read != nil {
+		c.read = append(c.read, read)
+	}
+	if write != nil {
+		c.write = append(c.write, write)
+	}
+}
+
+func (c *Conn) limiters(read bool) []*Limiter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if read {
+		return c.read
+	}
+	return c.write
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := c.Conn.Read(p)
+	for _, l := range c.limiters(true) {
+		l.WaitN(n)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		for _, l := range c.limiters(false) {
+			l.WaitN(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
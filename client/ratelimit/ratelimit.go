@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket that caps throughput in bytes per second.
+// A rate of 0 means unlimited. A nil *Limiter is also unlimited.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter allowing rate bytes per second
+func New(rate int64) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Rate returns the current limit in bytes per second
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit, taking effect for the next reservation
+func (l *Limiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// refill adds the tokens earned since the last call, capped at one second of burst
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if l.rate <= 0 {
+		l.tokens = 0
+		return
+	}
+	l.tokens += elapsed * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+// reserve takes n tokens and returns how long the caller must wait before using them.
+// The bucket is allowed to go into debt so requests larger than the burst still pass.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		return 0
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may pass the limiter
+func (l *Limiter) WaitN(n int) {
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
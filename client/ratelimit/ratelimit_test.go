@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int64
+		tokens  float64
+		elapsed time.Duration
+		n       int
+		want    time.Duration
+	}{
+		{"unlimited", 0, 0, 0, 1 << 20, 0},
+		{"within burst", 1000, 1000, 0, 500, 0},
+		{"whole burst", 1000, 1000, 0, 1000, 0},
+		{"empty bucket", 1000, 0, 0, 250, 250 * time.Millisecond},
+
+		// Requests larger than the burst pass and leave the bucket in debt
+		{"beyond burst", 1000, 1000, 0, 3000, 2 * time.Second},
+		{"in debt", 1000, -1000, 0, 500, 1500 * time.Millisecond},
+		{"debt paid off", 1000, -1000, time.Second, 500, 500 * time.Millisecond},
+
+		// An idle bucket earns at most one second of tokens
+		{"refilled", 1000, 0, 500 * time.Millisecond, 500, 0},
+		{"refill capped", 1000, 0, 10 * time.Second, 1500, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate)
+			l.tokens = tt.tokens
+			l.last = time.Now().Add(-tt.elapsed)
+			got := l.reserve(tt.n)
+			// The time passing while the test runs refills the bucket a little
+			if got > tt.want || got < tt.want-50*time.Millisecond {
+				t.Errorf("reserve(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if got := l.reserve(1 << 20); got != 0 {
+		t.Errorf("reserve on nil limiter = %v, want 0", got)
+	}
+	l.SetRate(1000)
+	if got := l.Rate(); got != 0 {
+		t.Errorf("Rate of nil limiter = %d, want 0", got)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := New(1000)
+	l.SetRate(100)
+	if l.tokens > 100 {
+		t.Errorf("tokens = %v after lowering the rate to 100, want at most 100", l.tokens)
+	}
+	if got := l.reserve(200); got < 900*time.Millisecond || got > time.Second {
+		t.Errorf("reserve(200) at 100 B/s = %v, want about 1s", got)
+	}
+	l.SetRate(0)
+	if got := l.reserve(1 << 20); got != 0 {
+		t.Errorf("reserve after SetRate(0) = %v, want 0", got)
+	}
+}
@@ -0,0 +1,223 @@
+package scheduler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeOfDay is a number of minutes after midnight, written as "HH:MM"
+type TimeOfDay int
+
+// ParseTimeOfDay parses a "HH:MM" string
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("time %q is not in HH:MM form", s)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid minute in %q", s)
+	}
+	return TimeOfDay(h*60 + m), nil
+}
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", int(t)/60, int(t)%60)
+}
+
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *TimeOfDay) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseTimeOfDay(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Rule applies rate limits, and optionally pauses torrents, during a daily time window
+type Rule struct {
+	Days         []time.Weekday `json:"days"`          // Days the window starts on, empty for every day
+	Start        TimeOfDay      `json:"start"`         // Start of the window
+	End          TimeOfDay      `json:"end"`           // End of the window, before Start if it crosses midnight, equal to it for all day
+	UploadRate   int64          `json:"upload_rate"`   // Session upload cap in bytes per second, 0 is unlimited
+	DownloadRate int64          `json:"download_rate"` // Session download cap in bytes per second, 0 is unlimited
+	Pause        bool           `json:"pause"`         // Pause torrents during the window
+	Torrents     []string       `json:"torrents"`      // Hex infohashes Pause applies to, empty for all
+}
+
+func (r *Rule) onDay(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, d := range r.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains tells if the rule's window covers the given moment
+func (r *Rule) Contains(now time.Time) bool {
+	minute := TimeOfDay(now.Hour()*60 + now.Minute())
+	today := now.Weekday()
+	if r.Start == r.End {
+		return r.onDay(today)
+	}
+	if r.Start < r.End {
+		return r.onDay(today) && minute >= r.Start && minute < r.End
+	}
+	// The window crosses midnight, so the early hours belong to the previous day's window
+	yesterday := (today + 6) % 7
+	return (r.onDay(today) && minute >= r.Start) || (r.onDay(yesterday) && minute < r.End)
+}
+
+// Pauses tells if the rule pauses the torrent with the given infohash
+func (r *Rule) Pauses(infoHash [20]byte) bool {
+	if !r.Pause {
+		return false
+	}
+	if len(r.Torrents) == 0 {
+		return true
+	}
+	encoded := hex.EncodeToString(infoHash[:])
+	for _, t := range r.Torrents {
+		if strings.EqualFold(t, encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+var dayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+func parseDay(s string) (time.Weekday, error) {
+	for i, name := range dayNames {
+		if strings.EqualFold(s, name) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", s)
+}
+
+// parseDays parses "*", "Mon-Fri" or "Sat,Sun" style day lists
+func parseDays(s string) ([]time.Weekday, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := parseDay(from)
+		if err != nil {
+			return nil, err
+		}
+		if !isRange {
+			days = append(days, first)
+			continue
+		}
+		last, err := parseDay(to)
+		if err != nil {
+			return nil, err
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// ParseRule parses a rule written as
+// "<days> <HH:MM>-<HH:MM> [up=<KiB/s>] [down=<KiB/s>] [pause] [torrent=<infohash>]...",
+// e.g. "Mon-Fri 09:00-18:00 up=1024 down=1024"
+func ParseRule(line string) (Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Rule{}, fmt.Errorf("rule %q needs days and a time window", line)
+	}
+	var r Rule
+	var err error
+	if r.Days, err = parseDays(fields[0]); err != nil {
+		return Rule{}, err
+	}
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return Rule{}, fmt.Errorf("time window %q is not in HH:MM-HH:MM form", fields[1])
+	}
+	if r.Start, err = ParseTimeOfDay(start); err != nil {
+		return Rule{}, err
+	}
+	if r.End, err = ParseTimeOfDay(end); err != nil {
+		return Rule{}, err
+	}
+	for _, field := range fields[2:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "up", "down":
+			kib, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || kib < 0 {
+				return Rule{}, fmt.Errorf("invalid rate %q", field)
+			}
+			if key == "up" {
+				r.UploadRate = kib * 1024
+			} else {
+				r.DownloadRate = kib * 1024
+			}
+		case "pause":
+			r.Pause = true
+		case "torrent":
+			if decoded, err := hex.DecodeString(value); err != nil || len(decoded) != 20 {
+				return Rule{}, fmt.Errorf("invalid infohash %q", value)
+			}
+			r.Torrents = append(r.Torrents, value)
+		default:
+			return Rule{}, fmt.Errorf("unknown option %q", field)
+		}
+	}
+	return r, nil
+}
+
+// String formats the rule in the form accepted by ParseRule
+func (r Rule) String() string {
+	days := "*"
+	if len(r.Days) > 0 {
+		names := make([]string, len(r.Days))
+		for i, d := range r.Days {
+			names[i] = dayNames[d]
+		}
+		days = strings.Join(names, ",")
+	}
+	parts := []string{days, r.Start.String() + "-" + r.End.String()}
+	if r.UploadRate > 0 {
+		parts = append(parts, fmt.Sprintf("up=%d", r.UploadRate/1024))
+	}
+	if r.DownloadRate > 0 {
+		parts = append(parts, fmt.Sprintf("down=%d", r.DownloadRate/1024))
+	}
+	if r.Pause {
+		parts = append(parts, "pause")
+	}
+	for _, t := range r.Torrents {
+		parts = append(parts, "torrent="+t)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// at returns a moment in the week of Sunday 2024-06-02
+func at(day time.Weekday, clock string) time.Time {
+	tod, err := ParseTimeOfDay(clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2024, 6, 2+int(day), 0, int(tod), 0, 0, time.Local)
+}
+
+func TestContains(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	tests := []struct {
+		name string
+		rule Rule
+		now  time.Time
+		want bool
+	}{
+		{"inside", Rule{Start: 9 * 60, End: 18 * 60}, at(time.Monday, "12:00"), true},
+		{"at start", Rule{Start: 9 * 60, End: 18 * 60}, at(time.Monday, "09:00"), true},
+		{"at end", Rule{Start: 9 * 60, End: 18 * 60}, at(time.Monday, "18:00"), false},
+		{"before", Rule{Start: 9 * 60, End: 18 * 60}, at(time.Monday, "08:59"), false},
+		{"until midnight", Rule{Start: 20 * 60, End: 24 * 60}, at(time.Monday, "23:59"), true},
+		{"weekday", Rule{Days: weekdays, Start: 9 * 60, End: 18 * 60}, at(time.Friday, "10:00"), true},
+		{"weekend", Rule{Days: weekdays, Start: 9 * 60, End: 18 * 60}, at(time.Saturday, "10:00"), false},
+
+		// 22:00-06:00 wraps past midnight into the next day
+		{"wrap evening", Rule{Start: 22 * 60, End: 6 * 60}, at(time.Monday, "23:00"), true},
+		{"wrap morning", Rule{Start: 22 * 60, End: 6 * 60}, at(time.Tuesday, "05:59"), true},
+		{"wrap end", Rule{Start: 22 * 60, End: 6 * 60}, at(time.Tuesday, "06:00"), false},
+		{"wrap midday", Rule{Start: 22 * 60, End: 6 * 60}, at(time.Tuesday, "12:00"), false},
+		{"wrap from Friday", Rule{Days: weekdays, Start: 22 * 60, End: 6 * 60}, at(time.Saturday, "03:00"), true},
+		{"wrap Saturday night", Rule{Days: weekdays, Start: 22 * 60, End: 6 * 60}, at(time.Saturday, "23:00"), false},
+		{"wrap into Monday", Rule{Days: weekdays, Start: 22 * 60, End: 6 * 60}, at(time.Monday, "03:00"), false},
+		{"wrap from Sunday", Rule{Days: []time.Weekday{time.Sunday}, Start: 22 * 60, End: 6 * 60}, at(time.Monday, "03:00"), true},
+
+		// Start == End covers the whole of each day
+		{"all day midnight", Rule{Start: 0, End: 0}, at(time.Wednesday, "00:00"), true},
+		{"all day late", Rule{Start: 9 * 60, End: 9 * 60}, at(time.Wednesday, "23:59"), true},
+		{"all day early", Rule{Start: 9 * 60, End: 9 * 60}, at(time.Wednesday, "08:00"), true},
+		{"all day other day", Rule{Days: []time.Weekday{time.Sunday}, Start: 9 * 60, End: 9 * 60}, at(time.Monday, "08:00"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Contains(tt.now); got != tt.want {
+				t.Errorf("%v Contains %v = %v, want %v", tt.rule, tt.now.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []time.Weekday
+		wantErr bool
+	}{
+		{"*", nil, false},
+		{"Mon-Wed", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday}, false},
+		{"Fri-Mon", []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, false},
+		{"sat,Sun", []time.Weekday{time.Saturday, time.Sunday}, false},
+		{"Mon-Tue,Thu", []time.Weekday{time.Monday, time.Tuesday, time.Thursday}, false},
+		{"Monday", nil, true},
+		{"Mon-", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDays(tt.in)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseDays(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	infoHash := "0123456789abcdef0123456789abcdef01234567"
+	valid := []string{
+		"Mon-Fri 09:00-18:00 up=1024 down=512",
+		"* 22:00-06:00 pause",
+		"Sat,Sun 00:00-24:00 down=100 pause torrent=" + infoHash,
+		"Wed 07:30-07:30 up=10",
+	}
+	for _, line := range valid {
+		r, err := ParseRule(line)
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", line, err)
+			continue
+		}
+		again, err := ParseRule(r.String())
+		if err != nil || !reflect.DeepEqual(again, r) {
+			t.Errorf("ParseRule(%q) does not round trip through %q", line, r.String())
+		}
+	}
+	r, _ := ParseRule("* 09:00-10:00 up=2")
+	if r.UploadRate != 2048 {
+		t.Errorf("up=2 parsed as %d bytes per second", r.UploadRate)
+	}
+
+	invalid := []string{
+		"Mon-Fri",
+		"Mon 09:00",
+		"Mon 9-18",
+		"Mon 25:00-26:00",
+		"Mon 09:60-10:00",
+		"Mon 24:30-10:00",
+		"Mon 09:00-10:00 up=-1",
+		"Mon 09:00-10:00 turbo",
+		"Mon 09:00-10:00 torrent=abc",
+	}
+	for _, line := range invalid {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("ParseRule(%q) accepted an invalid rule", line)
+		}
+	}
+}
+
+func TestPauses(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], "\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67")
+	tests := []struct {
+		rule Rule
+		want bool
+	}{
+		{Rule{}, false},
+		{Rule{Pause: true}, true},
+		{Rule{Pause: true, Torrents: []string{"0123456789ABCDEF0123456789ABCDEF01234567"}}, true},
+		{Rule{Pause: true, Torrents: []string{"ffffffffffffffffffffffffffffffffffffffff"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Pauses(infoHash); got != tt.want {
+			t.Errorf("%v Pauses = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. It is injected so schedules can be tested at any moment.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real wall clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// Schedule is an ordered list of rules. The first rule covering the current time is active.
+type Schedule struct {
+	Enabled bool   `json:"enabled"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Active returns the index of the rule active at now, or -1 if none is
+func (s *Schedule) Active(now time.Time) int {
+	if !s.Enabled {
+		return -1
+	}
+	for i := range s.Rules {
+		if s.Rules[i].Contains(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Scheduler evaluates a schedule against a clock and reports whenever the active rule changes
+type Scheduler struct {
+	mu       sync.Mutex
+	clock    Clock
+	schedule Schedule
+	apply    func(active *Rule)
+	applied  bool
+	last     int
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a scheduler. apply is called with the newly active rule, or nil once no rule is active.
+func New(clock Clock, schedule Schedule, apply func(active *Rule)) *Scheduler {
+	return &Scheduler{clock: clock, schedule: schedule, apply: apply, quit: make(chan struct{})}
+}
+
+// SetSchedule replaces the schedule and applies it immediately
+func (s *Scheduler) SetSchedule(schedule Schedule) {
+	s.mu.Lock()
+	s.schedule = schedule
+	s.applied = false
+	s.mu.Unlock()
+	s.Tick()
+}
+
+// Tick evaluates the schedule once, calling apply if the active rule changed
+func (s *Scheduler) Tick() {
+	s.mu.Lock()
+	active := s.schedule.Active(s.clock.Now())
+	if s.applied && active == s.last {
+		s.mu.Unlock()
+		return
+	}
+	s.applied = true
+	s.last = active
+	var rule *Rule
+	if active >= 0 {
+		r := s.schedule.Rules[active]
+		rule = &r
+	}
+	s.mu.Unlock()
+	s.apply(rule)
+}
+
+// Run ticks every interval until Stop is called
+func (s *Scheduler) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	s.Tick()
+	for {
+		select {
+		case <-ticker.C:
+			s.Tick()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Stop ends Run. It is safe to call more than once.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
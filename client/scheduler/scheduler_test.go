@@ -0,0 +1,94 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock the test moves by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestScheduler(t *testing.T) {
+	night, _ := ParseRule("* 22:00-06:00 down=100")
+	work, _ := ParseRule("Mon-Fri 09:00-18:00 up=10 pause")
+	schedule := Schedule{Enabled: true, Rules: []Rule{night, work}}
+
+	clock := &fakeClock{now: at(time.Monday, "08:00")}
+	var applied []string
+	s := New(clock, schedule, func(active *Rule) {
+		if active == nil {
+			applied = append(applied, "none")
+		} else {
+			applied = append(applied, active.String())
+		}
+	})
+
+	steps := []struct {
+		now  time.Time
+		want []string // Rules applied by the tick
+	}{
+		{at(time.Monday, "08:00"), []string{"none"}},
+		{at(time.Monday, "08:30"), nil},
+		{at(time.Monday, "09:00"), []string{work.String()}},
+		{at(time.Monday, "17:59"), nil},
+		{at(time.Monday, "18:00"), []string{"none"}},
+		{at(time.Monday, "22:00"), []string{night.String()}},
+		{at(time.Tuesday, "05:00"), nil},
+		{at(time.Tuesday, "06:00"), []string{"none"}},
+		{at(time.Saturday, "12:00"), nil},
+	}
+	for _, step := range steps {
+		applied = nil
+		clock.now = step.now
+		s.Tick()
+		if len(applied) != len(step.want) || (len(applied) > 0 && applied[0] != step.want[0]) {
+			t.Errorf("tick at %v applied %q, want %q", step.now.Format("Mon 15:04"), applied, step.want)
+		}
+	}
+
+	// An earlier rule wins over a later one covering the same moment
+	applied = nil
+	clock.now = at(time.Tuesday, "12:00")
+	s.SetSchedule(Schedule{Enabled: true, Rules: []Rule{{Start: 0, End: 0, UploadRate: 1024}, work}})
+	if len(applied) != 1 || applied[0] != "* 00:00-00:00 up=1" {
+		t.Errorf("SetSchedule applied %q, want the all-day rule", applied)
+	}
+
+	// A replaced schedule is applied even when the active index does not change
+	applied = nil
+	s.SetSchedule(Schedule{Enabled: true, Rules: []Rule{{Start: 0, End: 0, UploadRate: 2048}}})
+	if len(applied) != 1 || applied[0] != "* 00:00-00:00 up=2" {
+		t.Errorf("SetSchedule applied %q, want the new all-day rule", applied)
+	}
+
+	applied = nil
+	s.SetSchedule(Schedule{Enabled: false, Rules: schedule.Rules})
+	if len(applied) != 1 || applied[0] != "none" {
+		t.Errorf("disabling the schedule applied %q, want none", applied)
+	}
+}
+
+func TestRunAndStop(t *testing.T) {
+	ticks := make(chan *Rule, 10)
+	s := New(&fakeClock{now: at(time.Monday, "10:00")}, Schedule{Enabled: true, Rules: []Rule{{}}},
+		func(active *Rule) { ticks <- active })
+	done := make(chan struct{})
+	go func() {
+		s.Run(time.Millisecond)
+		close(done)
+	}()
+	if active := <-ticks; active == nil {
+		t.Error("Run did not apply the all-day rule")
+	}
+	s.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+	s.Stop() // Stopping again is harmless
+}
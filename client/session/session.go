@@ -0,0 +1,323 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"client/common"
+	"client/connection"
+	"client/connlimit"
+	"client/handshake"
+	"client/mse"
+	"client/peer"
+	"client/protocolconn"
+	"client/ratelimit"
+	"client/utp"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Handler is a torrent that serves peers accepted by the shared listener
+type Handler interface {
+	HandleInbound(conn net.Conn, pc *protocolconn.ProtocolConn, hs *handshake.Handshake)
+	RateLimiters() (download, upload *ratelimit.Limiter)
+	EncryptionPolicy() common.EncryptionPolicy
+	SwarmSecret() []byte // Empty unless the torrent is a private swarm
+}
+
+var (
+	mu        sync.RWMutex
+	handlers  = make(map[[20]byte]Handler)
+	listener  net.Listener
+	utpSocket *utp.Socket // Accepts uTP peers and dials them from the listening port
+)
+
+// Register routes inbound connections for infoHash to h
+func Register(infoHash [20]byte, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[infoHash] = h
+}
+
+// Unregister stops routing inbound connections for infoHash
+func Unregister(infoHash [20]byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(handlers, infoHash)
+}
+
+func lookup(infoHash [20]byte) (Handler, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	h, ok := handlers[infoHash]
+	return h, ok
+}
+
+// Listen starts the session-wide TCP listener on port, and the uTP socket on the same UDP
+// port when uTP is enabled, both on the configured bind address. It is a no-op if they are
+// already running.
+func Listen(port uint16) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if listener == nil {
+		addr, err := common.ListenAddr(port)
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		listener = ln
+		go acceptLoop(ln)
+	}
+	if common.AppState.EnableUTP {
+		return listenUTPLocked(port)
+	}
+	return nil
+}
+
+func listenUTPLocked(port uint16) error {
+	if utpSocket != nil {
+		return nil
+	}
+	addr, err := common.ListenAddr(port)
+	if err != nil {
+		return err
+	}
+	socket, err := utp.Listen(addr)
+	if err != nil {
+		return err
+	}
+	utpSocket = socket
+	socket.HandleOther(routeUDP)
+	go acceptLoop(socket)
+	return nil
+}
+
+// ApplyUTP opens or closes the uTP socket to follow common.AppState.EnableUTP. Closing it resets
+// the uTP connections on it. While no TCP listener runs, the socket is left for Listen or a dial
+// to open.
+func ApplyUTP() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if !common.AppState.EnableUTP {
+		if utpSocket == nil {
+			return nil
+		}
+		err := utpSocket.Close()
+		utpSocket = nil
+		return err
+	}
+	if listener == nil {
+		return nil
+	}
+	return listenUTPLocked(common.AppState.Port)
+}
+
+// UTP returns the session's uTP socket, opening it on the session port if needed. It returns
+// nil when uTP is disabled or the socket cannot be opened.
+func UTP() *utp.Socket {
+	if !common.AppState.EnableUTP {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := listenUTPLocked(common.AppState.Port); err != nil {
+		// log.Printf("[Session] Failed to open the uTP socket: %v", err)
+		return nil
+	}
+	return utpSocket
+}
+
+// Close stops the shared listener and uTP socket. TCP connections already being served are not affected.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	var errs []error
+	if listener != nil {
+		errs = append(errs, listener.Close())
+		listener = nil
+	}
+	if utpSocket != nil {
+		errs = append(errs, utpSocket.Close())
+		utpSocket = nil
+	}
+	return errors.Join(errs...)
+}
+
+func acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// log.Printf("[Session] Failed to accept connection: %v", err)
+			continue
+		}
+		// log.Printf("[Session] Accepted connection from %v", conn.RemoteAddr())
+		go handleConn(conn)
+	}
+}
+
+// handleConn detects the encryption the peer chose, reads its handshake and hands the
+// connection to the torrent that matches its infohash
+func handleConn(rawConn net.Conn) {
+	defer rawConn.Close()
+	remote, err := peer.FromAddr(rawConn.RemoteAddr())
+	if err != nil {
+		return
+	}
+	if !common.AppState.IPFilter.Allows(remote.IP) {
+		// log.Printf("[Session] %v is blocked by the IP filter", rawConn.RemoteAddr())
+		return
+	}
+	slot, ok := connlimit.Acquire(remote.IP, common.AppState.ConnectionsPerIP, common.AppState.Connections)
+	if !ok {
+		// log.Printf("[Session] Connection limit reached, rejecting %v", rawConn.RemoteAddr())
+		return
+	}
+	defer slot.Release()
+	limitedConn := common.NewPeerConn(rawConn)
+	limitedConn.SetDeadline(time.Now().Add(connection.HandshakeTimeout))
+	conn, mode, err := detectMode(limitedConn)
+	if err != nil {
+		// log.Printf("[Session] Could not detect the encryption of %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	pc, expected, encrypted, err := readPreamble(conn, mode)
+	if err != nil {
+		// log.Printf("[Session] Encryption preamble failed for %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	hs, err := handshake.Read(pc)
+	if err != nil {
+		// log.Printf("[Session] Handshake failed for %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if *hs.PeerID == common.AppState.PeerID {
+		// Answer before hanging up so the dialing side sees its own ID and stops dialing the address
+		// log.Printf("[Session] %v is ourselves", conn.RemoteAddr())
+		sendHandshake(pc, hs.InfoHash)
+		return
+	}
+	if expected != nil && *expected != *hs.InfoHash {
+		// log.Printf("[Session] Handshake infohash %x does not match the encryption key", hs.InfoHash)
+		return
+	}
+	h, ok := lookup(*hs.InfoHash)
+	if !ok {
+		// log.Printf("[Session] No torrent for infohash %x", hs.InfoHash)
+		return
+	}
+	if len(h.SwarmSecret()) > 0 && mode != common.EncryptionAES {
+		// log.Printf("[Session] %v did not prove knowledge of the swarm secret of %x", conn.RemoteAddr(), hs.InfoHash)
+		return
+	}
+	if !h.EncryptionPolicy().Allows(encrypted) {
+		// log.Printf("[Session] Torrent %x encryption policy rejects %v", hs.InfoHash, conn.RemoteAddr())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	limitedConn.Attach(h.RateLimiters())
+	h.HandleInbound(conn, pc, hs)
+}
+
+// sendHandshake answers a handshake with our own peer ID
+func sendHandshake(pc *protocolconn.ProtocolConn, infoHash *[20]byte) error {
+	serialized := handshake.New(infoHash, &common.AppState.PeerID).Serialize()
+	if _, err := pc.RawReadWriter.Write(serialized[:1]); err != nil {
+		return err
+	}
+	_, err := pc.EncryptedWriter.Write(serialized[1:])
+	return err
+}
+
+// infoHashes lists the public registered torrents, the keys an MSE peer may ask for
+func infoHashes() [][20]byte {
+	mu.RLock()
+	defer mu.RUnlock()
+	hashes := make([][20]byte, 0, len(handlers))
+	for infoHash, h := range handlers {
+		if len(h.SwarmSecret()) == 0 {
+			hashes = append(hashes, infoHash)
+		}
+	}
+	return hashes
+}
+
+// swarms lists every registered torrent with its secret, the swarms an AES peer may ask for
+func swarms() []protocolconn.Swarm {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]protocolconn.Swarm, 0, len(handlers))
+	for infoHash, h := range handlers {
+		list = append(list, protocolconn.Swarm{InfoHash: infoHash, Secret: h.SwarmSecret()})
+	}
+	return list
+}
+
+// peekConn is a connection whose first bytes were peeked to detect the encryption
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// pstr opens a plaintext BitTorrent handshake
+var pstr = []byte("\x13BitTorrent protocol")
+
+// detectMode peeks at the first bytes the peer sent. A plaintext handshake, the AES key
+// exchange and a TLS ClientHello start with known bytes, anything else is taken as the random
+// MSE public key.
+func detectMode(conn net.Conn) (net.Conn, common.EncryptionMode, error) {
+	pc := &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+	prefix, err := pc.r.Peek(len(pstr))
+	if err != nil {
+		return nil, common.EncryptionNone, err
+	}
+	switch {
+	case bytes.Equal(prefix, pstr):
+		return pc, common.EncryptionNone, nil
+	case protocolconn.IsKeyExchange(prefix):
+		return pc, common.EncryptionAES, nil
+	case protocolconn.IsTLS(prefix):
+		return pc, common.EncryptionTLS, nil
+	default:
+		return pc, common.EncryptionMSE, nil
+	}
+}
+
+// readPreamble runs the receiving side of the encryption preamble selected by mode.
+// When the preamble already identified the torrent, its infohash is returned as well.
+// encrypted reports whether the rest of the connection is encrypted.
+func readPreamble(conn net.Conn, mode common.EncryptionMode) (pc *protocolconn.ProtocolConn, infoHash *[20]byte,
+	encrypted bool, err error) {
+	switch mode {
+	case common.EncryptionAES:
+		pc, infoHash, err := protocolconn.Accept(conn, swarms())
+		if err != nil {
+			return nil, nil, false, err
+		}
+		return pc, &infoHash, true, nil
+	case common.EncryptionMSE:
+		mseConn, infoHash, err := mse.Accept(conn, infoHashes(), common.MSEMethods())
+		if err != nil {
+			return nil, nil, false, err
+		}
+		return protocolconn.NewStream(mseConn), &infoHash, mseConn.Method == mse.CryptoRC4, nil
+	case common.EncryptionTLS:
+		if common.AppState.TLS == nil {
+			return nil, nil, false, errors.New("the TLS transport is not configured")
+		}
+		pc, err := protocolconn.AcceptTLS(conn, common.AppState.TLS)
+		return pc, nil, err == nil, err
+	default:
+		return protocolconn.NewStream(conn), nil, false, nil
+	}
+}
@@ -0,0 +1,134 @@
+package session
+
+import (
+	"client/utp"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// udpPacketQueue is how many datagrams a shared UDP connection holds before dropping more
+const udpPacketQueue = 16
+
+var (
+	udpMu    sync.Mutex
+	udpConns = make(map[string]*udpConn) // Shared UDP connections by remote address
+)
+
+// DialUDP returns a connection to addr that sends and receives its datagrams on the uTP socket,
+// which is how protocols such as UDP trackers or a DHT share the torrent port. It returns nil
+// when uTP is disabled or addr already has a shared connection; the caller then uses a socket of
+// its own. Datagrams reach the connection only if they are not uTP packets, which holds for
+// UDP tracker replies as their first byte is always zero.
+func DialUDP(addr string) (net.Conn, error) {
+	socket := UTP()
+	if socket == nil {
+		return nil, nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpMu.Lock()
+	defer udpMu.Unlock()
+	key := raddr.String()
+	if _, taken := udpConns[key]; taken {
+		return nil, nil
+	}
+	c := &udpConn{
+		socket:  socket,
+		raddr:   raddr,
+		packets: make(chan []byte, udpPacketQueue),
+		closed:  make(chan struct{}),
+	}
+	udpConns[key] = c
+	return c, nil
+}
+
+// routeUDP hands a datagram that is not uTP to the shared connection dialed to its sender
+func routeUDP(packet []byte, from net.Addr) {
+	udpMu.Lock()
+	c := udpConns[from.String()]
+	udpMu.Unlock()
+	if c == nil {
+		return
+	}
+	select {
+	case c.packets <- append([]byte(nil), packet...):
+	default:
+		// Dropped like on a full socket buffer
+	}
+}
+
+// udpConn is a connected UDP socket over the uTP socket. Each Read returns one datagram.
+type udpConn struct {
+	socket    *utp.Socket
+	raddr     *net.UDPAddr
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.socket.WriteTo(p, c.raddr)
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		udpMu.Lock()
+		defer udpMu.Unlock()
+		if udpConns[c.raddr.String()] == c {
+			delete(udpConns, c.raddr.String())
+		}
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr  { return c.socket.Addr() }
+func (c *udpConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline has nothing to do, datagrams are sent without waiting
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package smartban
+
+import (
+	"crypto/sha1"
+	"sync"
+)
+
+// Block is one block of a piece and the peer that sent it
+type Block struct {
+	Peer string // The sender's IP address, the unit peers are banned by
+	Hash [20]byte
+}
+
+// Blocks splits a downloaded piece into blocks of blockSize, all sent by peer
+func Blocks(buf []byte, blockSize int, peer string) []Block {
+	blocks := make([]Block, 0, (len(buf)+blockSize-1)/blockSize)
+	for begin := 0; begin < len(buf); begin += blockSize {
+		end := min(begin+blockSize, len(buf))
+		blocks = append(blocks, Block{Peer: peer, Hash: sha1.Sum(buf[begin:end])})
+	}
+	return blocks
+}
+
+// Tracker counts the hash failures each peer contributed to. Failed pieces are remembered block
+// by block, so once the piece passes the peers that actually sent corrupt blocks can be told apart
+// from peers that only sent good blocks of a bad piece.
+type Tracker struct {
+	mu        sync.Mutex
+	threshold int
+	failures  map[string]int
+	failed    map[int][][]Block // Block lists of the failed attempts of each piece
+}
+
+// New creates a tracker that reports a peer for banning once it contributed to threshold failures
+func New(threshold int) *Tracker {
+	return &Tracker{
+		threshold: threshold,
+		failures:  make(map[string]int),
+		failed:    make(map[int][][]Block),
+	}
+}
+
+// Failed records a piece that failed its hash check and returns the peers that reached the threshold
+func (t *Tracker) Failed(index int, blocks []Block) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed[index] = append(t.failed[index], blocks)
+	var ban []string
+	for peer := range contributors(blocks) {
+		t.failures[peer]++
+		if t.failures[peer] == t.threshold {
+			ban = append(ban, peer)
+		}
+	}
+	return ban
+}
+
+// Passed records a piece that passed its hash check. Earlier failed attempts of the piece are
+// compared with the good blocks: peers whose blocks were all good have those failures taken back,
+// and peers that sent a differing block keep them. A piece comes from a single peer as often as
+// not, so one proven bad block is not enough for a ban: culprits are returned only once their
+// failures reach the threshold.
+func (t *Tracker) Passed(index int, good []Block) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	attempts := t.failed[index]
+	delete(t.failed, index)
+
+	culprits := make(map[string]bool)
+	innocent := make(map[string]int)
+	for _, blocks := range attempts {
+		bad := make(map[string]bool)
+		for i, b := range blocks {
+			if i < len(good) && b.Hash != good[i].Hash {
+				bad[b.Peer] = true
+			}
+		}
+		for peer := range contributors(blocks) {
+			if bad[peer] {
+				culprits[peer] = true
+			} else {
+				innocent[peer]++
+			}
+		}
+	}
+	for peer, n := range innocent {
+		t.failures[peer] = max(t.failures[peer]-n, 0)
+	}
+	var ban []string
+	for peer := range culprits {
+		if t.failures[peer] >= t.threshold {
+			ban = append(ban, peer)
+		}
+	}
+	return ban
+}
+
+// Failures returns the hash failures peer contributed to and has not been cleared of
+func (t *Tracker) Failures(peer string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures[peer]
+}
+
+func contributors(blocks []Block) map[string]bool {
+	peers := make(map[string]bool)
+	for _, b := range blocks {
+		peers[b.Peer] = true
+	}
+	return peers
+}
@@ -0,0 +1,131 @@
+package smartban
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// attempt is one download of a piece, its blocks sent by the given peers in turn. Each corrupt
+// block carries the wrong data.
+type attempt struct {
+	peers   []string
+	corrupt []bool
+	passed  bool
+}
+
+func (a attempt) blocks() []Block {
+	var buf []byte
+	for i := range a.peers {
+		fill := byte(i)
+		if a.corrupt[i] {
+			fill = 0xff
+		}
+		buf = append(buf, bytes.Repeat([]byte{fill}, 4)...)
+	}
+	blocks := Blocks(buf, 4, "")
+	for i := range blocks {
+		blocks[i].Peer = a.peers[i]
+	}
+	return blocks
+}
+
+func TestBlocks(t *testing.T) {
+	blocks := Blocks(make([]byte, 10), 4, "1.2.3.4")
+	if len(blocks) != 3 || blocks[0].Hash != blocks[1].Hash || blocks[1].Hash == blocks[2].Hash {
+		t.Errorf("Blocks split 10 bytes into %d blocks of 4", len(blocks))
+	}
+	for _, b := range blocks {
+		if b.Peer != "1.2.3.4" {
+			t.Errorf("block from %q", b.Peer)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	bad, good := []bool{true}, []bool{false}
+	tests := []struct {
+		name     string
+		attempts []attempt // Downloads of piece 0, in order
+		banned   []string  // Peers reported for banning by the whole sequence
+		failures map[string]int
+	}{
+		{
+			"one bad piece is tolerated",
+			[]attempt{{[]string{"a"}, bad, false}},
+			nil,
+			map[string]int{"a": 1},
+		},
+		{
+			"bad piece replaced by the same peer",
+			[]attempt{{[]string{"a"}, bad, false}, {[]string{"a"}, good, true}},
+			nil,
+			map[string]int{"a": 1},
+		},
+		{
+			"failures reach the threshold",
+			[]attempt{{[]string{"a"}, bad, false}, {[]string{"a"}, bad, false}, {[]string{"a"}, bad, false}},
+			[]string{"a"},
+			map[string]int{"a": 3},
+		},
+		{
+			"proven culprit below the threshold",
+			[]attempt{{[]string{"a"}, bad, false}, {[]string{"b"}, good, true}},
+			nil,
+			map[string]int{"a": 1, "b": 0},
+		},
+		{
+			"proven culprit at the threshold",
+			[]attempt{
+				{[]string{"a"}, bad, false}, {[]string{"b"}, good, true},
+				{[]string{"a"}, bad, false}, {[]string{"b"}, good, true},
+				{[]string{"a"}, bad, false}, {[]string{"b"}, good, true},
+			},
+			[]string{"a"},
+			map[string]int{"a": 3, "b": 0},
+		},
+		{
+			"innocent contributor is cleared",
+			[]attempt{
+				{[]string{"a", "b"}, []bool{false, true}, false},
+				{[]string{"a", "c"}, []bool{false, false}, true},
+			},
+			nil,
+			map[string]int{"a": 0, "b": 1, "c": 0},
+		},
+		{
+			"culprit among contributors",
+			[]attempt{
+				{[]string{"a", "b"}, []bool{false, true}, false},
+				{[]string{"a", "b"}, []bool{false, true}, false},
+				{[]string{"a", "b"}, []bool{false, true}, false},
+				{[]string{"a", "c"}, []bool{false, false}, true},
+			},
+			[]string{"a", "b"}, // a reaches the failure threshold before it is cleared
+			map[string]int{"a": 0, "b": 3, "c": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := New(3)
+			var banned []string
+			for _, a := range tt.attempts {
+				if a.passed {
+					banned = append(banned, tracker.Passed(0, a.blocks())...)
+				} else {
+					banned = append(banned, tracker.Failed(0, a.blocks())...)
+				}
+			}
+			slices.Sort(banned)
+			banned = slices.Compact(banned)
+			if !slices.Equal(banned, tt.banned) {
+				t.Errorf("banned %v, want %v", banned, tt.banned)
+			}
+			for peer, want := range tt.failures {
+				if got := tracker.Failures(peer); got != want {
+					t.Errorf("Failures(%s) = %d, want %d", peer, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"client/torrentfile"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Dir keeps the content of a multi-file torrent as its files below a directory. Files are
+// opened on first use and kept open until Close.
+type Dir struct {
+	root  string
+	tf    *torrentfile.TorrentFile
+	paths []string
+
+	mu    sync.Mutex
+	files []*os.File
+}
+
+// OpenDir creates the directories and empty files of tf below root, keeping existing files
+func OpenDir(root string, tf *torrentfile.TorrentFile) (*Dir, error) {
+	d := &Dir{root: root, tf: tf, files: make([]*os.File, len(tf.Files))}
+	for _, f := range tf.Files {
+		path, err := filePath(root, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		file, err := openFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		d.paths = append(d.paths, path)
+	}
+	return d, nil
+}
+
+// filePath joins a file's path components below root, refusing any that would leave it
+func filePath(root string, components []string) (string, error) {
+	if len(components) == 0 {
+		return "", errors.New("file with an empty path")
+	}
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, `/\`) {
+			return "", fmt.Errorf("unsafe file path %q", strings.Join(components, "/"))
+		}
+	}
+	return filepath.Join(append([]string{root}, components...)...), nil
+}
+
+func (d *Dir) file(index int) (*os.File, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files == nil {
+		return nil, os.ErrClosed
+	}
+	if d.files[index] == nil {
+		f, err := openFile(d.paths[index])
+		if err != nil {
+			return nil, err
+		}
+		d.files[index] = f
+	}
+	return d.files[index], nil
+}
+
+func (d *Dir) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(d.tf.Length) {
+		return 0, io.EOF
+	}
+	want := min(len(p), d.tf.Length-int(off))
+	n := 0
+	for _, seg := range d.tf.Segments(int(off), want) {
+		f, err := d.file(seg.File)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.ReadAt(p[n:n+seg.Length], int64(seg.Offset))
+		n += m
+		if m < seg.Length {
+			// A file shorter than it should be ends the content read so far
+			if err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *Dir) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(d.tf.Length) {
+		return 0, ErrOutOfRange
+	}
+	n := 0
+	for _, seg := range d.tf.Segments(int(off), len(p)) {
+		f, err := d.file(seg.File)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.WriteAt(p[n:n+seg.Length], int64(seg.Offset))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (d *Dir) MarkComplete(index int) error {
+	return nil
+}
+
+func (d *Dir) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, f := range d.files {
+		if f != nil {
+			errs = append(errs, f.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Dir) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, f := range d.files {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+	d.files = nil
+	return errors.Join(errs...)
+}
+
+func (d *Dir) Paths() []string {
+	return d.paths
+}
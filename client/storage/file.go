@@ -0,0 +1,41 @@
+package storage
+
+import "os"
+
+// File keeps the content of a single-file torrent in one file
+type File struct {
+	f *os.File
+}
+
+// OpenFile opens the file at path, creating it if needed
+func OpenFile(path string) (*File, error) {
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{f: f}, nil
+}
+
+func (s *File) ReadAt(p []byte, off int64) (int, error) {
+	return s.f.ReadAt(p, off)
+}
+
+func (s *File) WriteAt(p []byte, off int64) (int, error) {
+	return s.f.WriteAt(p, off)
+}
+
+func (s *File) MarkComplete(index int) error {
+	return nil
+}
+
+func (s *File) Flush() error {
+	return s.f.Sync()
+}
+
+func (s *File) Close() error {
+	return s.f.Close()
+}
+
+func (s *File) Paths() []string {
+	return []string{s.f.Name()}
+}
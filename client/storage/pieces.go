@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pieces keeps each piece in a file of its own below a directory. A piece is written to
+// <index>.part and renamed to <index>.piece once it is verified, so a partly written piece
+// never passes for a complete one.
+type Pieces struct {
+	dir         string
+	pieceLength int
+	length      int
+
+	mu    sync.Mutex
+	dirty map[int]bool // Pieces written or renamed since the last Flush
+}
+
+// OpenPieces creates dir if needed and keeps content of the given length in it
+func OpenPieces(dir string, pieceLength, length int) (*Pieces, error) {
+	if pieceLength <= 0 {
+		return nil, errors.New("piece length must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Pieces{dir: dir, pieceLength: pieceLength, length: length, dirty: make(map[int]bool)}, nil
+}
+
+func (s *Pieces) path(index int, complete bool) string {
+	if complete {
+		return filepath.Join(s.dir, fmt.Sprintf("%d.piece", index))
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%d.part", index))
+}
+
+// isPieceFile tells if name is that of a piece file, complete or not
+func isPieceFile(name string) bool {
+	index, ext, ok := strings.Cut(name, ".")
+	_, err := strconv.Atoi(index)
+	return ok && err == nil && (ext == "piece" || ext == "part")
+}
+
+// openPiece opens the piece's file, the complete one if there is one
+func (s *Pieces) openPiece(index int, flag int) (*os.File, error) {
+	f, err := os.OpenFile(s.path(index, true), flag&^os.O_CREATE, 0666)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.OpenFile(s.path(index, false), flag, 0666)
+	}
+	return f, err
+}
+
+// forEachPiece calls fn with each piece the range spans, the offset within it and the bytes of
+// the range it holds
+func (s *Pieces) forEachPiece(off, length int, fn func(index, pieceOffset, n int) error) error {
+	for length > 0 {
+		index := off / s.pieceLength
+		pieceOffset := off % s.pieceLength
+		n := min(length, s.pieceLength-pieceOffset)
+		if err := fn(index, pieceOffset, n); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+func (s *Pieces) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(s.length) {
+		return 0, io.EOF
+	}
+	want := min(len(p), s.length-int(off))
+	n := 0
+	err := s.forEachPiece(int(off), want, func(index, pieceOffset, length int) error {
+		f, err := s.openPiece(index, os.O_RDONLY)
+		if errors.Is(err, fs.ErrNotExist) {
+			return io.EOF // Not downloaded yet
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		m, err := f.ReadAt(p[n:n+length], int64(pieceOffset))
+		n += m
+		if m < length {
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+		return nil
+	})
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *Pieces) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(s.length) {
+		return 0, ErrOutOfRange
+	}
+	n := 0
+	err := s.forEachPiece(int(off), len(p), func(index, pieceOffset, length int) error {
+		f, err := s.openPiece(index, os.O_RDWR|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+		m, err := f.WriteAt(p[n:n+length], int64(pieceOffset))
+		n += m
+		s.markDirty(index)
+		return errors.Join(err, f.Close())
+	})
+	return n, err
+}
+
+func (s *Pieces) markDirty(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty[index] = true
+}
+
+func (s *Pieces) MarkComplete(index int) error {
+	s.markDirty(index)
+	err := os.Rename(s.path(index, false), s.path(index, true))
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, statErr := os.Stat(s.path(index, true)); statErr == nil {
+			return nil // Already complete
+		}
+	}
+	return err
+}
+
+// Flush syncs the piece files written since the last Flush, and the directory so that their
+// names, renames included, are committed too
+func (s *Pieces) Flush() error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[int]bool)
+	s.mu.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	var errs []error
+	for index := range dirty {
+		f, err := s.openPiece(index, os.O_RDONLY)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, f.Sync(), f.Close())
+	}
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	errs = append(errs, dir.Sync(), dir.Close())
+	return errors.Join(errs...)
+}
+
+func (s *Pieces) Close() error {
+	return nil
+}
+
+// Paths returns the piece files that exist now
+func (s *Pieces) Paths() []string {
+	var paths []string
+	for _, pattern := range []string{"*.piece", "*.part"} {
+		matches, _ := filepath.Glob(filepath.Join(s.dir, pattern))
+		paths = append(paths, matches...)
+	}
+	slices.Sort(paths)
+	return paths
+}
@@ -0,0 +1,87 @@
+// Package storage keeps the content of torrents. Content is addressed as one range of bytes, the
+// torrent's files laid end to end, so the protocol code never deals with how it is laid out.
+package storage
+
+import (
+	"client/torrentfile"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Storage holds the content of one torrent
+type Storage interface {
+	// ReadAt reads content that was written before. Reading past what exists returns io.EOF.
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete is called once the piece has been written in full and verified
+	MarkComplete(index int) error
+	// Flush commits written content to stable storage
+	Flush() error
+	Close() error
+	// Paths returns the files holding the content, nil if it is not kept on disk
+	Paths() []string
+}
+
+// ErrOutOfRange is returned for writes past the end of the content
+var ErrOutOfRange = errors.New("write past the end of the content")
+
+// Layout selects how content is kept on disk
+type Layout int
+
+const (
+	LayoutFiles  Layout = iota // The torrent's own files, see Open
+	LayoutPieces               // A file per piece in a directory, see OpenPieces
+)
+
+// Open opens the content of tf at path: the file itself for a single-file torrent, or the
+// directory holding the files of a multi-file one.
+func Open(path string, tf *torrentfile.TorrentFile) (Storage, error) {
+	if len(tf.Files) == 0 {
+		return OpenFile(path)
+	}
+	return OpenDir(path, tf)
+}
+
+// OpenLayout opens the content of tf at path in the given layout
+func OpenLayout(layout Layout, path string, tf *torrentfile.TorrentFile) (Storage, error) {
+	if layout == LayoutPieces {
+		return OpenPieces(path, tf.PieceLength, tf.Length)
+	}
+	return Open(path, tf)
+}
+
+// DetectLayout tells how existing content of tf at path is laid out. A directory holding piece
+// files and none of the torrent's own files is in LayoutPieces, anything else in LayoutFiles.
+func DetectLayout(path string, tf *torrentfile.TorrentFile) Layout {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return LayoutFiles // A file, or nothing there yet
+	}
+	for _, f := range tf.Files {
+		if len(f.Path) == 0 {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(path, f.Path[0])); err == nil {
+			return LayoutFiles
+		}
+	}
+	for _, entry := range entries {
+		if isPieceFile(entry.Name()) {
+			return LayoutPieces
+		}
+	}
+	return LayoutFiles
+}
+
+// openFile opens path for reading and writing, creating it if needed. Content we may only read,
+// e.g. a read-only file being seeded, is opened read-only and fails on write.
+func openFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if errors.Is(err, fs.ErrPermission) {
+		return os.Open(path)
+	}
+	return f, err
+}
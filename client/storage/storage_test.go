@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"bytes"
+	"client/torrentfile"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// multiFile has an empty file between two others and an empty one at the end
+var multiFile = &torrentfile.TorrentFile{
+	Name:        "album",
+	PieceLength: 8,
+	Length:      20,
+	Files: []torrentfile.File{
+		{Path: []string{"a"}, Length: 6},
+		{Path: []string{"sub", "empty"}, Length: 0},
+		{Path: []string{"sub", "b"}, Length: 14},
+		{Path: []string{"last"}, Length: 0},
+	},
+}
+
+func content(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	return data
+}
+
+// roundTrip writes data to s in writes of the given size and reads it back whole
+func roundTrip(t *testing.T, s Storage, data []byte, writeSize int) {
+	t.Helper()
+	for off := 0; off < len(data); off += writeSize {
+		end := min(off+writeSize, len(data))
+		if n, err := s.WriteAt(data[off:end], int64(off)); err != nil || n != end-off {
+			t.Fatalf("WriteAt(%d) = %d, %v", off, n, err)
+		}
+	}
+	got := make([]byte, len(data))
+	if n, err := s.ReadAt(got, 0); err != nil || n != len(data) {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %q, want %q", got, data)
+	}
+}
+
+func TestDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "album")
+	d, err := OpenDir(root, multiFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// Writes of 5 bytes straddle every file boundary
+	data := content(multiFile.Length)
+	roundTrip(t, d, data, 5)
+
+	// A read spanning the empty file
+	buf := make([]byte, 4)
+	if _, err := d.ReadAt(buf, 4); err != nil || string(buf) != string(data[4:8]) {
+		t.Errorf("ReadAt across files = %q, %v, want %q", buf, err, data[4:8])
+	}
+	if _, err := d.WriteAt([]byte("x"), int64(multiFile.Length)); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("WriteAt past the end = %v, want ErrOutOfRange", err)
+	}
+	if n, err := d.ReadAt(make([]byte, 4), 18); n != 2 || err != io.EOF {
+		t.Errorf("ReadAt over the end = %d, %v, want 2, io.EOF", n, err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file holds its own part of the content
+	want := map[string]string{
+		"a":         string(data[:6]),
+		"sub/empty": "",
+		"sub/b":     string(data[6:]),
+		"last":      "",
+	}
+	for name, w := range want {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || string(got) != w {
+			t.Errorf("%s holds %q, %v, want %q", name, got, err, w)
+		}
+	}
+	if len(d.Paths()) != len(multiFile.Files) {
+		t.Errorf("Paths = %v, want one per file", d.Paths())
+	}
+}
+
+func TestDirRejectsUnsafePaths(t *testing.T) {
+	for _, path := range [][]string{{".."}, {"sub", "..", ".."}, {"a/b"}, {""}, {}} {
+		tf := &torrentfile.TorrentFile{Length: 1, Files: []torrentfile.File{{Path: path, Length: 1}}}
+		if _, err := OpenDir(t.TempDir(), tf); err == nil {
+			t.Errorf("OpenDir accepted the file path %q", path)
+		}
+	}
+}
+
+func TestPieces(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pieces")
+	s, err := OpenPieces(dir, 8, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := content(20)
+	roundTrip(t, s, data, 5)
+
+	partPaths := []string{filepath.Join(dir, "0.part"), filepath.Join(dir, "1.part"), filepath.Join(dir, "2.part")}
+	if got := s.Paths(); !reflect.DeepEqual(got, partPaths) {
+		t.Errorf("Paths before completion = %v, want %v", got, partPaths)
+	}
+	if err := s.MarkComplete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkComplete(1); err != nil {
+		t.Errorf("completing a piece twice = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.part")); !os.IsNotExist(err) {
+		t.Errorf("1.part still exists after completion: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "1.piece"))
+	if err != nil || string(got) != string(data[8:16]) {
+		t.Errorf("1.piece holds %q, %v, want %q", got, err, data[8:16])
+	}
+	// The complete piece is read in place of the part
+	buf := make([]byte, 20)
+	if _, err := s.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt after completion = %q, %v", buf, err)
+	}
+	if err := s.MarkComplete(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("Flush = %v", err)
+	}
+
+	// Reopening finds the pieces again
+	s, err = OpenPieces(dir, 8, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt after reopening = %q, %v", buf, err)
+	}
+}
+
+func TestPiecesMissing(t *testing.T) {
+	s, err := OpenPieces(t.TempDir(), 8, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt(content(8), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Piece 1 was never written
+	if n, err := s.ReadAt(make([]byte, 12), 0); err != io.EOF || n != 8 {
+		t.Errorf("ReadAt over a missing piece = %d, %v, want 8, io.EOF", n, err)
+	}
+	if err := s.MarkComplete(2); err == nil {
+		t.Error("completing a piece that was never written succeeded")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	s := NewMemory(20)
+	roundTrip(t, s, content(20), 7)
+	if _, err := s.WriteAt([]byte("xy"), 19); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("WriteAt past the end = %v, want ErrOutOfRange", err)
+	}
+	if s.Paths() != nil {
+		t.Errorf("Paths = %v, want nil", s.Paths())
+	}
+}
+
+func TestOpenLayout(t *testing.T) {
+	dir := t.TempDir()
+	single := &torrentfile.TorrentFile{Name: "f", PieceLength: 8, Length: 20}
+	tests := []struct {
+		layout Layout
+		tf     *torrentfile.TorrentFile
+		want   Storage
+	}{
+		{LayoutFiles, single, &File{}},
+		{LayoutFiles, multiFile, &Dir{}},
+		{LayoutPieces, single, &Pieces{}},
+		{LayoutPieces, multiFile, &Pieces{}},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		s, err := OpenLayout(tt.layout, path, tt.tf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(s) != reflect.TypeOf(tt.want) {
+			t.Errorf("OpenLayout(%d) opened a %T, want a %T", tt.layout, s, tt.want)
+		}
+		roundTrip(t, s, content(tt.tf.Length), 3)
+		s.Close()
+		// The layout is found again from what was written
+		if got := DetectLayout(path, tt.tf); got != tt.layout {
+			t.Errorf("DetectLayout after writing layout %d = %d", tt.layout, got)
+		}
+	}
+	if got := DetectLayout(filepath.Join(dir, "missing"), single); got != LayoutFiles {
+		t.Errorf("DetectLayout of missing content = %d, want LayoutFiles", got)
+	}
+	if got := DetectLayout(t.TempDir(), multiFile); got != LayoutFiles {
+		t.Errorf("DetectLayout of an empty directory = %d, want LayoutFiles", got)
+	}
+}
@@ -0,0 +1,91 @@
+package torrent
+
+import (
+	"client/bitfield"
+	"client/torrent/torrentstatus"
+	"client/verify"
+	"context"
+	"errors"
+	"io"
+	"log"
+)
+
+// ErrChecking is returned when a hash check is started while another one runs
+var ErrChecking = errors.New("torrent is already being checked")
+
+// checkPieces hashes every piece of r on the verify pool into a scratch bitfield, which replaces
+// the torrent's bitfield only once the check completes. A cancelled or failed check leaves the
+// previous bitfield in place.
+func (t *Torrent) checkPieces(r io.ReaderAt) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	status := &torrentstatus.CheckStatus{Total: len(t.PieceHashes)}
+	t.checkMu.Lock()
+	if t.checkStatus != nil {
+		t.checkMu.Unlock()
+		return ErrChecking
+	}
+	t.checkStatus, t.checkCancel = status, cancel
+	t.checkMu.Unlock()
+	defer func() {
+		t.checkMu.Lock()
+		t.checkStatus, t.checkCancel = nil, nil
+		t.checkMu.Unlock()
+	}()
+
+	checked := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	err := verify.Check(ctx, r, t.PieceHashes, t.PieceLength, t.Length, verify.Options{Progress: status.Update},
+		func(index int, ok bool) {
+			if ok {
+				checked.SetPiece(index)
+			}
+		})
+	if err != nil {
+		return err
+	}
+	t.Bitfield = checked
+	if t.DownloadStatus != nil {
+		t.DownloadStatus.SetDonePieces(t.countPieces())
+	}
+	return nil
+}
+
+// CheckProgress returns how far the running hash check is, with running false if none runs
+func (t *Torrent) CheckProgress() (checked, total int, running bool) {
+	t.checkMu.Lock()
+	status := t.checkStatus
+	t.checkMu.Unlock()
+	if status == nil {
+		return 0, 0, false
+	}
+	checked, total = status.Get()
+	return checked, total, true
+}
+
+// CancelCheck stops the running hash check, and tells if there was one
+func (t *Torrent) CancelCheck() bool {
+	t.checkMu.Lock()
+	defer t.checkMu.Unlock()
+	if t.checkCancel == nil {
+		return false
+	}
+	t.checkCancel()
+	return true
+}
+
+// ForceRecheck hashes the torrent's content again regardless of its resume data, saves the
+// result as the new resume data and returns how many pieces are intact. The torrent must not be
+// downloading or seeding meanwhile.
+func (t *Torrent) ForceRecheck() (int, error) {
+	store, err := t.openStorage()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[Torrent] Rechecking %s", t.Name)
+	if err := t.checkPieces(store); err != nil {
+		return 0, err
+	}
+	donePieces := t.countPieces()
+	log.Printf("[Torrent] Recheck of %s found %d/%d pieces", t.Name, donePieces, len(t.PieceHashes))
+	return donePieces, t.SaveResume()
+}
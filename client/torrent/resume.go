@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"client/bitfield"
+	"client/common"
+	"client/storage"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resumeData is what a torrent remembers between runs so that it does not have to hash its
+// files again. It is only trusted while the files keep the recorded sizes and mtimes.
+type resumeData struct {
+	InfoHash   string            `json:"info_hash"`
+	Files      []resumeFile      `json:"files"`
+	Bitfield   bitfield.Bitfield `json:"bitfield"`
+	Downloaded int64             `json:"downloaded"` // Bytes of verified pieces received
+	Uploaded   int64             `json:"uploaded"`   // Bytes served to peers
+	Layout     storage.Layout    `json:"layout"`     // How the files hold the content
+}
+
+type resumeFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func resumePath(infoHash [20]byte) (string, error) {
+	dir, err := common.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "resume", hex.EncodeToString(infoHash[:])+".json"), nil
+}
+
+// statFiles records the current size and mtime of the files at paths
+func statFiles(paths []string) ([]resumeFile, error) {
+	files := make([]resumeFile, 0, len(paths))
+	for _, path := range paths {
+		file, err := statFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// statFile records the current size and mtime of the file at path
+func statFile(path string) (resumeFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return resumeFile{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return resumeFile{}, err
+	}
+	return resumeFile{Path: path, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// readResume returns the saved resume data of the torrent, whatever state its files are in
+func (t *Torrent) readResume() (*resumeData, error) {
+	path, err := resumePath(t.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rd resumeData
+	if err := json.Unmarshal(data, &rd); err != nil {
+		return nil, fmt.Errorf("corrupt resume data: %w", err)
+	}
+	if rd.InfoHash != hex.EncodeToString(t.InfoHash[:]) || len(rd.Bitfield) != (len(t.PieceHashes)+7)/8 {
+		return nil, errors.New("resume data is for another torrent")
+	}
+	return &rd, nil
+}
+
+// SavedLayout returns the layout the torrent's content was saved in by an earlier run, if any
+func (t *Torrent) SavedLayout() (storage.Layout, bool) {
+	rd, err := t.readResume()
+	if err != nil {
+		return storage.LayoutFiles, false
+	}
+	return rd.Layout, true
+}
+
+// loadResume returns the saved resume data if it describes the files of store as they are now,
+// and nil if the files must be checked
+func (t *Torrent) loadResume(store storage.Storage) *resumeData {
+	rd, err := t.readResume()
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[Resume] Ignoring resume data for %s: %v", t.Name, err)
+		}
+		return nil
+	}
+	current, err := statFiles(store.Paths())
+	if err != nil || len(current) == 0 || len(current) != len(rd.Files) {
+		return nil
+	}
+	for i, saved := range rd.Files {
+		if saved.Path != current[i].Path || saved.Size != current[i].Size || !saved.ModTime.Equal(current[i].ModTime) {
+			log.Printf("[Resume] %s changed since it was last saved, checking it", current[i].Path)
+			return nil
+		}
+	}
+	return rd
+}
+
+// SaveResume records the torrent's pieces and counters along with the current state of its
+// files. Content that is not kept on disk has nothing to resume from.
+func (t *Torrent) SaveResume() error {
+	if _, _, checking := t.CheckProgress(); checking || t.Storage == nil || t.Bitfield == nil {
+		return nil
+	}
+	paths := t.Storage.Paths()
+	if len(paths) == 0 {
+		return nil
+	}
+	files, err := statFiles(paths)
+	if err != nil {
+		return err
+	}
+	rd := resumeData{
+		InfoHash: hex.EncodeToString(t.InfoHash[:]),
+		Files:    files,
+		Bitfield: t.Bitfield,
+		Layout:   t.Layout,
+	}
+	if t.DownloadStatus != nil {
+		rd.Downloaded = t.DownloadStatus.GetDownloadedBytes()
+	}
+	if t.SeedingStatus != nil {
+		rd.Uploaded = t.SeedingStatus.GetSeededBytes()
+	}
+	data, err := json.Marshal(&rd)
+	if err != nil {
+		return err
+	}
+	path, err := resumePath(t.InfoHash)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Replace the old data atomically, so a crash while saving leaves a usable file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restorePieces sets the bitfield from resume data when the files are unchanged, and hashes
+// every piece of store otherwise. It returns the resume data used, or nil after a check.
+func (t *Torrent) restorePieces(store storage.Storage) (*resumeData, error) {
+	if rd := t.loadResume(store); rd != nil {
+		log.Printf("[Resume] Restored %s without checking it", t.Name)
+		t.Bitfield = rd.Bitfield
+		return rd, nil
+	}
+	if err := t.checkPieces(store); err != nil {
+		return nil, err
+	}
+	// Save right away, so that the next start does not check again
+	if err := t.SaveResume(); err != nil {
+		log.Printf("[Resume] Error saving resume data for %s: %v", t.Name, err)
+	}
+	return nil, nil
+}
+
+// countPieces returns how many pieces the bitfield has
+func (t *Torrent) countPieces() int {
+	done := 0
+	for i := range t.PieceHashes {
+		if t.Bitfield.HasPiece(i) {
+			done++
+		}
+	}
+	return done
+}
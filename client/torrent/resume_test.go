@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"client/bitfield"
+	"client/storage"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeKeepsLayout(t *testing.T) {
+	tf, content := newSwarmTorrent("http://127.0.0.1:1/announce", 16, 40)
+	fresh, err := New(tf, newPeerID("resume"), 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fresh.SavedLayout(); ok {
+		t.Fatal("a new torrent has a saved layout")
+	}
+	for _, layout := range []storage.Layout{storage.LayoutPieces, storage.LayoutFiles} {
+		tr, err := New(tf, newPeerID("resume"), 6881)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Path = filepath.Join(t.TempDir(), "content")
+		tr.Layout = layout
+		store, err := tr.openStorage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.WriteAt(content, 0)
+		tr.Bitfield = make(bitfield.Bitfield, 1)
+		if err := tr.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A later run finds the layout both in the resume data and on disk
+		again, err := New(tf, newPeerID("resume"), 6881)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := again.SavedLayout(); !ok || got != layout {
+			t.Errorf("SavedLayout = %d, %v, want %d", got, ok, layout)
+		}
+		if got := storage.DetectLayout(tr.Path, tf); got != layout {
+			t.Errorf("DetectLayout = %d, want %d", got, layout)
+		}
+	}
+}
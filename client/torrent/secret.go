@@ -0,0 +1,63 @@
+package torrent
+
+import (
+	"client/common"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A private swarm's secret is kept by infohash, so that the torrent rejoins its swarm when it is
+// added again after a restart
+
+func secretPath(infoHash [20]byte) (string, error) {
+	dir, err := common.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "secrets", hex.EncodeToString(infoHash[:])), nil
+}
+
+// loadSecret restores the saved swarm secret of the torrent, if there is one
+func (t *Torrent) loadSecret() {
+	path, err := secretPath(t.InfoHash)
+	if err != nil {
+		return
+	}
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[Torrent] Error reading swarm secret of %s: %v", t.Name, err)
+		}
+		return
+	}
+	if len(secret) > 0 {
+		t.Secret = secret
+	}
+}
+
+// SetSecret makes the torrent private to the swarm that knows secret, or public if secret is
+// empty, and saves the choice
+func (t *Torrent) SetSecret(secret []byte) error {
+	t.Secret = nil
+	if len(secret) > 0 {
+		t.Secret = secret
+	}
+	path, err := secretPath(t.InfoHash)
+	if err != nil {
+		return err
+	}
+	if t.Secret == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, t.Secret, 0600)
+}
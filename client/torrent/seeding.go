@@ -1,161 +1,159 @@
 package torrent
 
 import (
-	"client/bitfield"
 	"client/common"
 	"client/handshake"
+	"client/lsd"
 	"client/message"
+	"client/peer"
 	"client/protocolconn"
+	"client/session"
+	"client/storage"
 	"client/torrent/seedingstatus"
 	"client/view/viewutils"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
-	"os"
 	"time"
 )
 
-const MAX_PORT = 6889
-
-// StartSeeder listens for incoming connections and seeds the torrent file to peers.
+// StartSeeder registers the torrent with the shared listener and seeds the torrent file to peers.
 func (t *Torrent) StartSeeder() {
-	defer func() { t.IsSeedingPaused = true }()
+	started := false
+	defer func() {
+		if !started {
+			t.IsSeedingPaused = true
+		}
+	}()
 
 	// log.Printf("[Seeder] StartSeeder called for torrent: %s", t.Name)
 	// If seeding is paused, do not start
 	if t.IsSeedingPaused {
 		t.IsSeedingPaused = false // resume it
+		started = true
 		return
 	}
-	file, err := os.Open(t.Path)
+	// The storage stays open for the peers served from now on
+	store, err := t.openStorage()
 	if err != nil {
 		viewutils.ShowMessage("Error opening file seeding - " + err.Error())
-		// log.Printf("[Seeder] Error opening file for seeding: %v", err)
+		// log.Printf("[Seeder] Error opening storage for seeding: %v", err)
 		return
 	}
-	t.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
-	// Set bitfield for existing pieces
-	for i := range t.PieceHashes {
-		exists, err := t.checkExistingPiece(i, file)
-		if err != nil {
-			// log.Printf("[Seeder] error reading file - %v", err)
-			return
-		}
-		if exists {
-			t.Bitfield.SetPiece(i)
-		}
+	// Set bitfield for existing pieces, from the resume data while the file is unchanged
+	rd, err := t.restorePieces(store)
+	if err != nil {
+		// log.Printf("[Seeder] error reading file - %v", err)
+		return
 	}
 
-	var ln net.Listener
-	for t.Port <= MAX_PORT {
-		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", t.Port))
-		if err != nil {
-			// log.Printf("[Seeder] failed to listen on port %d: %v", t.Port, err)
-			if t.Port >= MAX_PORT {
-				// log.Printf("[Seeder] gave up on listening")
-				viewutils.ShowMessage("No ports are available for listening")
-				return
-			}
-			t.Port++
-		} else {
-			break
+	// Initialize seeding status if not already
+	if t.SeedingStatus == nil {
+		// log.Printf("[Seeder] Initializing SeedingStatus for torrent: %s", t.Name)
+		t.SeedingStatus = &seedingstatus.SeedingStatus{SeededBytes: 0, ActivePeers: 0}
+		if rd != nil {
+			t.SeedingStatus.SeededBytes = rd.Uploaded
 		}
 	}
 
-	defer ln.Close()
+	t.Port = common.AppState.Port
+	if err := session.Listen(t.Port); err != nil {
+		// log.Printf("[Seeder] failed to listen on port %d: %v", t.Port, err)
+		viewutils.ShowMessage(fmt.Sprintf("Could not listen on port %d: %v", t.Port, err))
+		return
+	}
+	session.Register(t.InfoHash, t)
+	if t.AllowsPeerDiscovery() {
+		lsd.Register(t.InfoHash, t)
+	}
 
 	err = t.SendSeedingAnnounce(t.AnnounceList[0], t.Port, &t.PeerID, uint64(t.Length), 0)
 	if err != nil {
 		// log.Printf("[Seeder] error sending seeding announce - %v", err)
+		t.unregister()
 		viewutils.ShowMessage("error sending seeding announce: " + err.Error())
 		return
 	}
+	started = true
+	// log.Printf("[Seeder] Seeding on shared port %d", t.Port)
+}
 
-	// Initialize seeding status if not already
-	if t.SeedingStatus == nil {
-		// log.Printf("[Seeder] Initializing SeedingStatus for torrent: %s", t.Name)
-		t.SeedingStatus = &seedingstatus.SeedingStatus{SeededBytes: 0, ActivePeers: 0}
-	}
-	// log.Printf("[Seeder] Seeder listening on port %d", t.Port)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			// log.Printf("[Seeder] Failed to accept connection: %v", err)
-			continue
-		}
-		// log.Printf("[Seeder] Accepted connection from %v", conn.RemoteAddr())
-		go t.handleSeederConn(conn, common.AppState.IsTrafficAESEncrypted)
-	}
+// PauseSeeding stops serving peers. The shared listener no longer hands the torrent new
+// connections, and the ones being served wait until seeding resumes.
+func (t *Torrent) PauseSeeding() {
+	t.IsSeedingPaused = true
+	t.unregister()
 }
 
-func (t *Torrent) handleSeederConn(conn net.Conn, encrypted bool) {
-	defer conn.Close()
-	t.SeedingStatus.IncrementActivePeers()
-	defer t.SeedingStatus.DecrementActivePeers()
-	// log.Printf("[Seeder] Connected to peer: %v", conn.RemoteAddr())
-	var encConn *protocolconn.ProtocolConn = &protocolconn.ProtocolConn{
-		EncryptedReader: conn,
-		EncryptedWriter: conn,
-		RawReadWriter:   conn,
+// ResumeSeeding serves peers again after PauseSeeding, registering and announcing the torrent
+// again
+func (t *Torrent) ResumeSeeding() {
+	t.IsSeedingPaused = false
+	t.StartSeeder()
+}
+
+// unregister stops the shared listener and local discovery from routing peers to the torrent
+func (t *Torrent) unregister() {
+	session.Unregister(t.InfoHash)
+	lsd.Unregister(t.InfoHash)
+}
+
+// HandleInbound serves a peer whose handshake was matched to this torrent by the shared listener
+func (t *Torrent) HandleInbound(conn net.Conn, pc *protocolconn.ProtocolConn, hs *handshake.Handshake) {
+	store := t.Storage
+	if store == nil {
+		// log.Printf("[Seeder] Torrent was closed, rejecting %v", conn.RemoteAddr())
+		return
 	}
-	var err error
-	if encrypted {
-		// log.Printf("[Seeder] Starting encrypted handshake with peer: %v", conn.RemoteAddr())
-		// --- Encryption handshake: receive key/iv ---
-		key := make([]byte, 32)
-		iv := make([]byte, 16)
-		if _, err := io.ReadFull(conn, key); err != nil {
-			// log.Printf("[Seeder] Failed to read key: %v", err)
-			return
-		}
-		if _, err := io.ReadFull(conn, iv); err != nil {
-			// log.Printf("[Seeder] Failed to read iv: %v", err)
-			return
-		}
-		encConn, err = protocolconn.New(conn, key, key, iv, iv)
-		if err != nil {
-			// log.Printf("[Seeder] Failed to wrap conn with AES: %v", err)
-			return
-		}
+	remote, err := peer.FromAddr(conn.RemoteAddr())
+	if err != nil || t.PeerPool.Banned(remote.IP) {
+		// log.Printf("[Seeder] Rejecting banned peer %v", conn.RemoteAddr())
+		return
+	}
+	// A ban while the peer is served closes the connection
+	defer t.PeerPool.Track(remote.IP, conn)()
+	if !t.PeerPool.ClaimID(*hs.PeerID) {
+		// log.Printf("[Seeder] Peer ID %x is already connected, rejecting %v", *hs.PeerID, conn.RemoteAddr())
+		return
 	}
-	// Use encConn for both reading and writing
-	if !t.performHandshake(encConn) {
-		// log.Printf("[Seeder] performHandshake failed for peer: %v", conn.RemoteAddr())
+	defer t.PeerPool.ReleaseID(*hs.PeerID)
+	if !t.Connections.TryAcquire() {
+		// log.Printf("[Seeder] Torrent connection limit reached, rejecting %v", conn.RemoteAddr())
 		return
 	}
+	defer t.Connections.Release()
+	t.SeedingStatus.IncrementActivePeers()
+	defer t.SeedingStatus.DecrementActivePeers()
+	// log.Printf("[Seeder] Connected to peer: %v", conn.RemoteAddr())
 
-	if !t.sendBitfield(encConn) {
-		// log.Printf("[Seeder] sendBitfield failed for peer: %v", conn.RemoteAddr())
+	if !t.sendHandshake(pc) {
+		// log.Printf("[Seeder] sendHandshake failed for peer: %v", conn.RemoteAddr())
 		return
 	}
 
-	file, err := os.Open(t.Path)
-	if err != nil {
-		// log.Printf("[Seeder] Failed to open file: %v", err)
+	if !t.sendBitfield(pc) {
+		// log.Printf("[Seeder] sendBitfield failed for peer: %v", conn.RemoteAddr())
 		return
 	}
-	defer file.Close()
 
 	// log.Printf("[Seeder] Serving peer: %v", conn.RemoteAddr())
-	t.servePeer(encConn, file)
+	err = t.servePeer(pc, store)
+	if errors.Is(err, message.ErrTooLarge) {
+		log.Printf("[Seeder] Banning %s: %v", remote.IP, err)
+		t.PeerPool.Ban(remote.IP, err.Error())
+	}
 }
 
-func (t *Torrent) performHandshake(rw *protocolconn.ProtocolConn) bool {
-	// log.Printf("[Seeder] Performing handshake")
-	hs, err := handshake.Read(rw)
-	if err != nil {
-		// log.Printf("[Seeder] Handshake failed: %v", err)
-		return false
-	}
-	if *hs.InfoHash != t.InfoHash {
-		// log.Printf("[Seeder] InfoHash mismatch: got %x, expected %x", hs.InfoHash, t.InfoHash)
-		return false
-	}
+func (t *Torrent) sendHandshake(rw *protocolconn.ProtocolConn) bool {
+	// log.Printf("[Seeder] Sending handshake")
 	resp := handshake.New(&t.InfoHash, &t.PeerID)
+	resp.SetUTP(common.AppState.EnableUTP)
 	serialized := resp.Serialize()
-	_, err = rw.RawReadWriter.Write(serialized[:1])
+	_, err := rw.RawReadWriter.Write(serialized[:1])
 	if err != nil {
 		// log.Printf("[Seeder] Failed to send handshake: %v", err)
 		return false
@@ -182,36 +180,42 @@ func (t *Torrent) sendBitfield(rw io.ReadWriter) bool {
 	return true
 }
 
-func (t *Torrent) servePeer(rw *protocolconn.ProtocolConn, file *os.File) {
+// servePeer answers the peer's requests until the connection ends. Requests are served one at a
+// time as they are read, so none queue up on our side and what a peer can make us hold is one
+// message of at most maxLength and the block sent in reply.
+func (t *Torrent) servePeer(rw *protocolconn.ProtocolConn, store storage.Storage) error {
 	// log.Printf("[Seeder] servePeer started")
+	maxLength := message.MaxLength(len(t.PieceHashes))
 	interested := false
 	for {
 		for t.IsSeedingPaused {
 			time.Sleep(500 * time.Millisecond)
 		}
 
-		msg, err := message.Read(rw)
+		msg, err := message.Read(rw, maxLength)
 		for t.IsSeedingPaused {
 			time.Sleep(500 * time.Millisecond)
 		}
 		if err != nil {
 			if err == io.EOF {
 				// log.Printf("[Seeder] Peer closed connection (EOF)")
-				return
+				return nil
 			}
 			// log.Printf("[Seeder] Read error from peer: %v", err)
-			return
+			return err
 		}
 		if msg == nil {
 			// log.Printf("[Seeder] Received keep-alive from peer")
 			continue // keep-alive
 		}
 		// log.Printf("[Seeder] Received message from peer: ID=%d", msg.ID)
-		t.handlePeerMessage(msg, rw, file, &interested)
+		if err := t.handlePeerMessage(msg, rw, store, &interested); err != nil {
+			return err
+		}
 	}
 }
 
-func (t *Torrent) handlePeerMessage(msg *message.Message, rw io.ReadWriter, file *os.File, interested *bool) {
+func (t *Torrent) handlePeerMessage(msg *message.Message, rw io.ReadWriter, store storage.Storage, interested *bool) error {
 	switch msg.ID {
 	case message.MsgUnchoke:
 		// log.Printf("[Seeder] Received UNCHOKE from peer")
@@ -220,10 +224,11 @@ func (t *Torrent) handlePeerMessage(msg *message.Message, rw io.ReadWriter, file
 		t.handleInterested(rw, interested)
 	case message.MsgRequest:
 		// log.Printf("[Seeder] Received REQUEST from peer")
-		t.handleRequest(msg, rw, file, *interested)
+		return t.handleRequest(msg, rw, store, *interested)
 	default:
 		// log.Printf("[Seeder] Received unknown message ID: %d", msg.ID)
 	}
+	return nil
 }
 
 func (t *Torrent) handleInterested(rw io.ReadWriter, interested *bool) {
@@ -237,22 +242,28 @@ func (t *Torrent) handleInterested(rw io.ReadWriter, interested *bool) {
 	}
 }
 
-func (t *Torrent) handleRequest(msg *message.Message, rw io.ReadWriter, file *os.File, interested bool) {
+// handleRequest sends the requested block. Invalid requests are ignored, but a request for more
+// than a block is an attempt to make us buffer whole pieces and ends the connection. The piece
+// message is read straight into the buffer it is sent from.
+func (t *Torrent) handleRequest(msg *message.Message, rw io.ReadWriter, store storage.Storage, interested bool) error {
 	if !interested {
 		// log.Printf("[Seeder] Received request from uninterested peer")
-		return
+		return nil
 	}
 	if len(msg.Payload) != 12 {
 		// log.Printf("[Seeder] Received request with invalid payload length: %d", len(msg.Payload))
-		return
+		return nil
 	}
 	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
 	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
 	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
 	// log.Printf("[Seeder] Received request: index=%d, begin=%d, length=%d", index, begin, length)
+	if length > message.MaxBlockSize {
+		return fmt.Errorf("%w: request for %d bytes", message.ErrTooLarge, length)
+	}
 	if index < 0 || index >= len(t.PieceHashes) {
 		// log.Printf("[Seeder] Received request for invalid piece index: %d", index)
-		return
+		return nil
 	}
 	pieceBegin := index * t.PieceLength
 	pieceEnd := pieceBegin + t.PieceLength
@@ -261,29 +272,30 @@ func (t *Torrent) handleRequest(msg *message.Message, rw io.ReadWriter, file *os
 	}
 	if begin+length > pieceEnd-pieceBegin {
 		// log.Printf("[Seeder] Received request with invalid begin/length: begin=%d, length=%d, piece size=%d", begin, length, pieceEnd-pieceBegin)
-		return
+		return nil
 	}
-	buf := make([]byte, length)
-	_, err := file.ReadAt(buf, int64(pieceBegin+begin))
+	pieceMsgLength := 4 + 1 + 8 + length
+	pieceMsg := make([]byte, pieceMsgLength)
+	binary.BigEndian.PutUint32(pieceMsg[0:4], uint32(pieceMsgLength-4))
+	pieceMsg[4] = byte(message.MsgPiece)
+	binary.BigEndian.PutUint32(pieceMsg[5:9], uint32(index))
+	binary.BigEndian.PutUint32(pieceMsg[9:13], uint32(begin))
+	buf := pieceMsg[13:]
+	_, err := store.ReadAt(buf, int64(pieceBegin+begin))
 	if err != nil {
-		// log.Printf("[Seeder] Failed to read from file: %v", err)
-		return
+		// log.Printf("[Seeder] Failed to read from storage: %v", err)
+		return nil
 	}
 	// Optionally verify hash
 	if begin == 0 && length == pieceEnd-pieceBegin {
 		h := sha1.Sum(buf)
 		if h != t.PieceHashes[index] {
 			// log.Printf("[Seeder] Hash mismatch for piece %d", index)
-			return
+			return nil
 		}
 	}
 	// Send piece
-	payload := make([]byte, 8+len(buf))
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	copy(payload[8:], buf)
-	pieceMsg := &message.Message{ID: message.MsgPiece, Payload: payload}
-	_, err = rw.Write(pieceMsg.Serialize())
+	_, err = rw.Write(pieceMsg)
 	if err != nil {
 		// log.Printf("[Seeder] Failed to send piece: %v", err)
 	} else {
@@ -293,4 +305,5 @@ func (t *Torrent) handleRequest(msg *message.Message, rw io.ReadWriter, file *os
 	if t.SeedingStatus != nil {
 		t.SeedingStatus.IncrementSeededBytes(int64(len(buf)))
 	}
+	return nil
 }
@@ -0,0 +1,261 @@
+package torrent
+
+import (
+	"bytes"
+	"client/common"
+	hs "client/handshake"
+	"client/session"
+	"client/storage"
+	"client/torrentfile"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestMain(m *testing.M) {
+	common.InitAppState()
+	// Resume data and secrets go to a scratch config directory
+	dir, err := os.MkdirTemp("", "torrent-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	os.Setenv("HOME", dir)
+	code := m.Run()
+	session.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// tracker is an HTTP tracker that hands every announcing peer the others of its torrent
+type tracker struct {
+	mu    sync.Mutex
+	peers map[string]map[string][]byte // Compact peers by infohash and peer ID
+}
+
+func (tr *tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	port, err := strconv.Atoi(q.Get("port"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	compact := binary.BigEndian.AppendUint16(net.ParseIP(host).To4(), uint16(port))
+
+	tr.mu.Lock()
+	swarm := tr.peers[q.Get("info_hash")]
+	if swarm == nil {
+		swarm = make(map[string][]byte)
+		tr.peers[q.Get("info_hash")] = swarm
+	}
+	swarm[q.Get("peer_id")] = compact
+	var others []byte
+	for id, p := range swarm {
+		if id != q.Get("peer_id") {
+			others = append(others, p...)
+		}
+	}
+	tr.mu.Unlock()
+	bencode.NewEncoder(w).Encode(map[string]any{"interval": 60, "peers": string(others)})
+}
+
+// newSwarmTorrent describes random content of the given length with the tracker at announce
+func newSwarmTorrent(announce string, pieceLength, length int) (*torrentfile.TorrentFile, []byte) {
+	content := make([]byte, length)
+	for i := range content {
+		content[i] = byte(rand.Uint32())
+	}
+	tf := &torrentfile.TorrentFile{
+		AnnounceList: []string{announce},
+		PieceLength:  pieceLength,
+		Length:       length,
+		Name:         "swarm",
+	}
+	for begin := 0; begin < length; begin += pieceLength {
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(content[begin:min(begin+pieceLength, length)]))
+	}
+	tf.InfoHash = sha1.Sum(content)
+	return tf, content
+}
+
+func newPeerID(name string) *[20]byte {
+	var id [20]byte
+	copy(id[:], fmt.Sprintf("-TS0001-%s-%d", name, rand.Uint32()))
+	return &id
+}
+
+// listenOnFreePort moves the session to a port nothing else listens on, once for all tests since
+// the shared listener keeps running
+func listenOnFreePort(t *testing.T) {
+	t.Helper()
+	if common.AppState.Port != 6881 {
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	common.AppState.Port = uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// TestSwarm has a seeder keep its content in memory and leechers download it into each kind of
+// storage, all in this process over the shared listener
+func TestSwarm(t *testing.T) {
+	srv := httptest.NewServer(&tracker{peers: make(map[string]map[string][]byte)})
+	defer srv.Close()
+	listenOnFreePort(t)
+	common.AppState.ConnectionsPerIP.SetMax(0)
+
+	leechers := []struct {
+		name string
+		open func(t *testing.T, tf *torrentfile.TorrentFile) storage.Storage
+	}{
+		{"memory", func(t *testing.T, tf *torrentfile.TorrentFile) storage.Storage {
+			return storage.NewMemory(tf.Length)
+		}},
+		{"pieces", func(t *testing.T, tf *torrentfile.TorrentFile) storage.Storage {
+			s, err := storage.OpenPieces(filepath.Join(t.TempDir(), "pieces"), tf.PieceLength, tf.Length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+		{"file", func(t *testing.T, tf *torrentfile.TorrentFile) storage.Storage {
+			s, err := storage.OpenFile(filepath.Join(t.TempDir(), "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+	}
+	for _, l := range leechers {
+		t.Run(l.name, func(t *testing.T) {
+			// Several pieces of two blocks and a short last piece
+			tf, content := newSwarmTorrent(srv.URL+"/announce", 2*MaxBlockSize, 7*2*MaxBlockSize+1000)
+
+			seeder, err := New(tf, newPeerID("seed"), common.AppState.Port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seedStore := storage.NewMemory(tf.Length)
+			seedStore.WriteAt(content, 0)
+			seeder.Storage = seedStore
+			seeder.StartSeeder()
+			if seeder.IsSeedingPaused {
+				t.Fatal("the seeder did not start")
+			}
+			defer session.Unregister(tf.InfoHash)
+			if n := seeder.countPieces(); n != len(tf.PieceHashes) {
+				t.Fatalf("the seeder has %d of %d pieces", n, len(tf.PieceHashes))
+			}
+
+			leecher, err := New(tf, newPeerID("leech"), common.AppState.Port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := l.open(t, tf)
+			done := make(chan error, 1)
+			go func() { done <- leecher.StartDownload(store) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(30 * time.Second):
+				leecher.PauseDownload()
+				t.Fatalf("download stalled at %d of %d pieces", leecher.DownloadStatus.GetDonePieces(), len(tf.PieceHashes))
+			}
+			defer leecher.Close()
+
+			got := make([]byte, tf.Length)
+			if _, err := store.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Error("downloaded content differs from the seeder's")
+			}
+			if n := leecher.countPieces(); n != len(tf.PieceHashes) {
+				t.Errorf("the leecher has %d of %d pieces", n, len(tf.PieceHashes))
+			}
+			if seeder.SeedingStatus.GetSeededBytes() != int64(tf.Length) {
+				t.Errorf("the seeder uploaded %d bytes, want %d", seeder.SeedingStatus.GetSeededBytes(), tf.Length)
+			}
+		})
+	}
+}
+
+// TestClosedTorrentRefusesPeers checks that the shared listener stops handing connections to a
+// seeder once it is paused or closed
+func TestClosedTorrentRefusesPeers(t *testing.T) {
+	srv := httptest.NewServer(&tracker{peers: make(map[string]map[string][]byte)})
+	defer srv.Close()
+	listenOnFreePort(t)
+	tf, content := newSwarmTorrent(srv.URL+"/announce", MaxBlockSize, 3*MaxBlockSize)
+	seeder, err := New(tf, newPeerID("seed"), common.AppState.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedStore := storage.NewMemory(tf.Length)
+	seedStore.WriteAt(content, 0)
+	seeder.Storage = seedStore
+
+	// handshake reports whether the seeder answers a handshake for the torrent. It returns once
+	// the seeder is done with the connection.
+	handshake := func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(common.AppState.Port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		answered := false
+		if _, err := conn.Write(hs.New(&tf.InfoHash, newPeerID("peer")).Serialize()); err == nil {
+			_, err = io.ReadFull(conn, make([]byte, 68))
+			answered = err == nil
+		}
+		conn.Close()
+		for deadline := time.Now().Add(5 * time.Second); seeder.SeedingStatus.GetActivePeers() > 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("the seeder kept serving a closed connection")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return answered
+	}
+
+	seeder.StartSeeder()
+	if seeder.IsSeedingPaused {
+		t.Fatal("the seeder did not start")
+	}
+	if !handshake() {
+		t.Fatal("the seeder refused a peer while seeding")
+	}
+	seeder.PauseSeeding()
+	if handshake() {
+		t.Error("a paused seeder was handed a peer")
+	}
+	seeder.ResumeSeeding()
+	if !handshake() {
+		t.Error("the seeder refused a peer after resuming")
+	}
+	if err := seeder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if handshake() {
+		t.Error("a closed seeder was handed a peer")
+	}
+}
@@ -4,16 +4,26 @@ import (
 	"client/bitfield"
 	"client/common"
 	"client/connection"
+	"client/connlimit"
+	"client/lsd"
 	"client/message"
 	"client/peer"
+	"client/peerpool"
+	"client/ratelimit"
+	"client/session"
+	"client/smartban"
+	"client/storage"
 	"client/torrent/seedingstatus"
 	"client/torrent/torrentstatus"
 	"client/torrentfile"
+	"client/utp"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os"
+	"net"
+	"sync"
 	"time"
 )
 
@@ -25,8 +35,20 @@ type Torrent struct {
 	PeerID          [20]byte
 	Port            uint16
 	Paused          bool
-	IsSeedingPaused bool              // true if seeding is paused, false if active
-	Bitfield        bitfield.Bitfield // Bitfield representing downloaded pieces
+	IsSeedingPaused bool                    // true if seeding is paused, false if active
+	Bitfield        bitfield.Bitfield       // Bitfield representing downloaded pieces
+	UploadLimiter   *ratelimit.Limiter      // Caps upload across all peers of this torrent
+	DownloadLimiter *ratelimit.Limiter      // Caps download across all peers of this torrent
+	Connections     *connlimit.Group        // Established connections of this torrent
+	PeerPool        *peerpool.Pool          // Every peer address known for this torrent
+	Encryption      common.EncryptionPolicy // Per-torrent override, PolicyDefault follows the session
+	Secret          []byte                  // Pre-shared secret of a private swarm, nil for a public torrent
+	HashFailures    *smartban.Tracker       // Which peers sent pieces that failed their hash check
+	Storage         storage.Storage         // Holds the content, opened from Path when first needed
+	Layout          storage.Layout          // How the content at Path is laid out
+	checkMu         sync.Mutex
+	checkStatus     *torrentstatus.CheckStatus // Progress of the running hash check, nil if none runs
+	checkCancel     context.CancelFunc         // Cancels the running hash check
 	// Retrieved from TorrentFile:
 	// InfoHash       [20]byte
 	// PieceHashes    [][20]byte
@@ -36,9 +58,27 @@ type Torrent struct {
 }
 
 type pieceWork struct {
-	index  int
-	length int
-	hash   *[20]byte
+	index    int
+	length   int
+	hash     *[20]byte
+	failedBy map[string]time.Time // IPs that sent a corrupt copy of the piece, and when
+}
+
+// retryDelay returns how long ip must wait before providing the piece again, 0 if it may. A
+// source that sent a corrupt copy waits so that another peer gets the chance to provide it.
+func (pw *pieceWork) retryDelay(ip string, now time.Time) time.Duration {
+	failed, ok := pw.failedBy[ip]
+	if !ok {
+		return 0
+	}
+	return max(failed.Add(FailedPieceRetryDelay).Sub(now), 0)
+}
+
+// park puts a piece the worker may not take yet back on the queue after delay, at most
+// ReplenishInterval so that other peers see it again soon. Putting it back right away would
+// have the worker pull it again in a tight loop when nobody else can take it.
+func park(workQueue chan *pieceWork, pw *pieceWork, delay time.Duration) {
+	time.AfterFunc(min(delay, ReplenishInterval), func() { workQueue <- pw })
 }
 
 type pieceResult struct {
@@ -56,20 +96,65 @@ type pieceStatus struct {
 }
 
 // MaxBlockSize is the largest number of bytes a request can ask for
-const MaxBlockSize = 0x4000
+const MaxBlockSize = message.MaxBlockSize
 
 // MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 const MaxBacklog = 5
 
+// MaxHashFailures is the number of failed pieces a peer may contribute to before it is banned
+const MaxHashFailures = 3
+
+// FailedPieceRetryDelay is how long a peer that sent a corrupt piece waits before it may
+// provide the same piece again, so that the piece is re-downloaded from a different peer
+const FailedPieceRetryDelay = time.Minute
+
+// ReplenishInterval is how often a download retries backed-off peers to fill free connection slots
+const ReplenishInterval = 5 * time.Second
+
+// ReannounceInterval is the minimum time between tracker announces made to find more peers
+const ReannounceInterval = 2 * time.Minute
+
 func New(tf *torrentfile.TorrentFile, peerID *[20]byte, port uint16) (*Torrent, error) {
-	return &Torrent{
-		TorrentFile:    tf,
-		DownloadStatus: nil,
-		Peers:          nil,
-		PeerID:         *peerID,
-		Port:           port,
-		Bitfield:       nil,
-	}, nil
+	t := &Torrent{
+		TorrentFile:     tf,
+		DownloadStatus:  nil,
+		Peers:           nil,
+		PeerID:          *peerID,
+		Port:            port,
+		Bitfield:        nil,
+		UploadLimiter:   ratelimit.New(0),
+		DownloadLimiter: ratelimit.New(0),
+		Connections:     connlimit.NewGroup(common.AppState.MaxTorrentConnections),
+		PeerPool:        peerpool.New(),
+		HashFailures:    smartban.New(MaxHashFailures),
+	}
+	t.loadSecret()
+	return t, nil
+}
+
+// SetRateLimits changes the torrent's caps in bytes per second, 0 meaning unlimited
+func (t *Torrent) SetRateLimits(upload, download int64) {
+	t.UploadLimiter.SetRate(upload)
+	t.DownloadLimiter.SetRate(download)
+}
+
+// RateLimiters returns the limiters applied to every connection of the torrent
+func (t *Torrent) RateLimiters() (download, upload *ratelimit.Limiter) {
+	return t.DownloadLimiter, t.UploadLimiter
+}
+
+// EncryptionPolicy returns the policy that applies to the torrent's connections.
+// A private swarm always requires encryption.
+func (t *Torrent) EncryptionPolicy() common.EncryptionPolicy {
+	if len(t.Secret) > 0 {
+		return common.PolicyRequire
+	}
+	return t.Encryption.Resolve()
+}
+
+// SwarmSecret returns the pre-shared secret peers must know to join the torrent's swarm
+func (t *Torrent) SwarmSecret() []byte {
+	return t.Secret
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
@@ -125,12 +210,13 @@ func attemptDownloadPiece(c *connection.Connection, pw *pieceWork) ([]byte, erro
 		buf:        make([]byte, pw.length),
 	}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
 	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	for state.downloaded < pw.length {
+		// Setting a deadline helps get unresponsive peers unstuck.
+		// It is renewed for every message since rate limits may slow the whole piece down
+		c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+
 		// If unchoked, send requests until we have enough unfulfilled requests
 		if !state.connection.Choked {
 			for state.backlog < MaxBacklog && state.requested < pw.length {
@@ -166,16 +252,136 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peer.Peer, workQueue chan *pieceWork,
-	resultsQueue chan *pieceResult) {
+// notify signals ch without blocking if a signal is already pending
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// connectPeers starts download workers for peers from the pool that are due for an attempt,
+// while connection slots are free
+func (t *Torrent) connectPeers(workQueue chan *pieceWork, resultsQueue chan *pieceResult, slotFreed chan struct{}) {
+	for _, p := range t.PeerPool.Ready(time.Now()) {
+		if !common.AppState.IPFilter.Allows(p.IP) {
+			// Back off like a failed dial, so the peer is checked again after a filter reload
+			t.PeerPool.Failed(p)
+			continue
+		}
+		if !common.AppState.HalfOpen.TryAcquire() {
+			return
+		}
+		slot, ok := connlimit.Acquire(p.IP, common.AppState.ConnectionsPerIP, common.AppState.Connections, t.Connections)
+		if !ok {
+			common.AppState.HalfOpen.Release()
+			continue
+		}
+		t.PeerPool.Attempt(p, time.Now())
+		go t.startDownloadWorker(p, slot, workQueue, resultsQueue, slotFreed)
+	}
+}
+
+// announceForPeers asks the trackers for more peers and adds them to the pool
+func (t *Torrent) announceForPeers() error {
+	peers, err := t.RequestPeers(&t.PeerID, t.Port)
+	if err != nil {
+		return err
+	}
+	t.Peers = peers
+	added := t.addPeers(peers, peerpool.SourceTracker)
+	log.Printf("[Torrent] Announce returned %d peers, %d new", len(peers), added)
+	return nil
+}
+
+// addPeers records peers in the pool. Private torrents drop peers that did not come from
+// their trackers or connect to us directly.
+func (t *Torrent) addPeers(peers []peer.Peer, source peerpool.Source) int {
+	if !t.AllowsPeerDiscovery() && source != peerpool.SourceTracker && source != peerpool.SourceIncoming {
+		return 0
+	}
+	return t.PeerPool.Add(peers, source)
+}
+
+// HandleLocalPeer adds a peer announced on the local network
+func (t *Torrent) HandleLocalPeer(pr peer.Peer) {
+	if t.addPeers([]peer.Peer{pr}, peerpool.SourceLSD) > 0 {
+		log.Printf("[Torrent] Found local peer %s", pr.String())
+	}
+}
+
+// peerFailed records a failed connection, banning the peer if it broke the protocol's limits
+// and forgetting the address if it turned out to be ourselves
+func (t *Torrent) peerFailed(peer peer.Peer, err error) {
+	if errors.Is(err, connection.ErrSelfConnection) {
+		log.Printf("[Torrent] %s is ourselves, not dialing it again", peer.String())
+		t.PeerPool.Drop(peer)
+		return
+	}
+	t.PeerPool.Failed(peer)
+	if errors.Is(err, message.ErrTooLarge) {
+		log.Printf("[Torrent] Banning %s: %v", peer.IP, err)
+		t.PeerPool.Ban(peer.IP, err.Error())
+	}
+}
+
+// banPeers bans every IP in ips, returning them as a set
+func (t *Torrent) banPeers(ips []string, reason string) map[string]bool {
+	banned := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		log.Printf("[Torrent] Banning %s: %s", ip, reason)
+		t.PeerPool.Ban(net.ParseIP(ip), reason)
+		banned[ip] = true
+	}
+	return banned
+}
+
+// startDownloadWorker connects to a peer and downloads pieces from it until the queue is closed.
+// The half-open slot is released once the handshake completes, and slot when the worker exits.
+func (t *Torrent) startDownloadWorker(peer peer.Peer, slot *connlimit.Slot, workQueue chan *pieceWork,
+	resultsQueue chan *pieceResult, slotFreed chan struct{}) {
+	defer notify(slotFreed)
+	defer slot.Release()
+
 	log.Printf("[DownloadWorker] Starting download worker for peer: %s", peer.String())
-	c, err := connection.New(peer, &t.PeerID, &t.InfoHash, common.AppState.IsTrafficAESEncrypted) // IS ENCRYPTED
+	var utpSocket *utp.Socket
+	// uTP cannot go through the proxy, so it would leak our address around it
+	if !common.AppState.Proxy.Enabled() && t.PeerPool.TriesUTP(peer) {
+		utpSocket = session.UTP()
+	}
+	c, err := connection.New(peer, &t.PeerID, &t.InfoHash, connection.Options{
+		Encryption:       common.AppState.Encryption,
+		Policy:           t.EncryptionPolicy(),
+		SwarmSecret:      t.Secret,
+		DownloadLimiter:  t.DownloadLimiter,
+		UploadLimiter:    t.UploadLimiter,
+		MaxMessageLength: message.MaxLength(len(t.PieceHashes)),
+		VerifyPeerID:     common.AppState.VerifyPeerIDs,
+		UTP:              utpSocket,
+	})
+	common.AppState.HalfOpen.Release()
+	notify(slotFreed)
 	if err != nil {
 		log.Printf("[DownloadWorker] Could not handshake with %s - %s", peer.IP, err)
-		t.DownloadStatus.DecrementPeersAmount()
+		t.peerFailed(peer, err)
 		return
 	}
 	defer c.Conn.Close()
+	defer t.PeerPool.Track(peer.IP, c.Conn)()
+	// A peer that does not advertise uTP, or advertises it but did not answer it, is dialed
+	// over TCP from now on
+	if !c.UTP && (utpSocket != nil || !c.RemoteUTP) {
+		t.PeerPool.SetNoUTP(peer)
+	}
+	if !t.PeerPool.ClaimID(*c.RemoteID) {
+		log.Printf("[DownloadWorker] Already connected to peer ID %x, dropping %s", *c.RemoteID, peer.String())
+		t.PeerPool.Failed(peer)
+		return
+	}
+	defer t.PeerPool.ReleaseID(*c.RemoteID)
+	t.PeerPool.Connected(peer)
+	t.DownloadStatus.IncrementPeersAmount()
+	defer t.DownloadStatus.DecrementPeersAmount()
 
 	c.SendUnchoke()
 	c.SendInterested()
@@ -184,6 +390,7 @@ func (t *Torrent) startDownloadWorker(peer peer.Peer, workQueue chan *pieceWork,
 		if t.Paused {
 			log.Printf("[DownloadWorker] Download paused, putting piece %d back on queue", pw.index)
 			workQueue <- pw // Put piece back on the queue
+			t.PeerPool.Disconnected(peer)
 			return
 		}
 
@@ -192,6 +399,10 @@ func (t *Torrent) startDownloadWorker(peer peer.Peer, workQueue chan *pieceWork,
 			workQueue <- pw // Put piece back on the queue
 			continue
 		}
+		if delay := pw.retryDelay(peer.IP.String(), time.Now()); delay > 0 {
+			park(workQueue, pw, delay)
+			continue
+		}
 
 		// log.Printf("[DownloadWorker] Attempting to download piece %d from peer %s", pw.index, peer.String())
 		// Download the piece
@@ -199,62 +410,66 @@ func (t *Torrent) startDownloadWorker(peer peer.Peer, workQueue chan *pieceWork,
 		if err != nil {
 			log.Printf("[DownloadWorker] Exiting worker for peer %s: %v", peer.String(), err)
 			workQueue <- pw // Put piece back on the queue
-			t.DownloadStatus.DecrementPeersAmount()
+			t.peerFailed(peer, err)
 			return
 		}
 
+		blocks := smartban.Blocks(buf, MaxBlockSize, peer.IP.String())
 		err = checkIntegrity(pw, buf)
 		if err != nil {
-			// log.Printf("[DownloadWorker] Piece #%d failed integrity check", pw.index)
+			log.Printf("[DownloadWorker] Piece #%d from %s failed integrity check", pw.index, peer.IP)
+			if pw.failedBy == nil {
+				pw.failedBy = make(map[string]time.Time)
+			}
+			pw.failedBy[peer.IP.String()] = time.Now()
+			banned := t.banPeers(t.HashFailures.Failed(pw.index, blocks), "too many hash failures")
 			workQueue <- pw // Put piece back on the queue
+			if banned[peer.IP.String()] {
+				t.PeerPool.Failed(peer)
+				return
+			}
 			continue
 		}
+		t.banPeers(t.HashFailures.Passed(pw.index, blocks), "sent corrupt blocks")
 
 		// log.Printf("[DownloadWorker] Downloaded and verified piece %d from peer %s", pw.index, peer.String())
 		c.SendHave(pw.index)
-		t.Bitfield.SetPiece(pw.index) // Update bitfield when piece is downloaded
 		resultsQueue <- &pieceResult{pw.index, buf}
 	}
 	log.Printf("[DownloadWorker] Worker for peer %s finished", peer.String())
-	t.DownloadStatus.DecrementPeersAmount()
+	t.PeerPool.Disconnected(peer)
 }
 
-// checkExistingPiece verifies if a piece already exists in the file and is valid
-func (t *Torrent) checkExistingPiece(index int, file *os.File) (bool, error) {
-	begin, end := t.calculateBoundsForPiece(index)
-	pieceSize := end - begin
-
-	// Read the piece from the file
-	buf := make([]byte, pieceSize)
-	_, err := file.ReadAt(buf, int64(begin))
+// openStorage returns the torrent's storage, opening the content at Path if there is none yet
+func (t *Torrent) openStorage() (storage.Storage, error) {
+	if t.Storage != nil {
+		return t.Storage, nil
+	}
+	if t.Path == "" {
+		return nil, errors.New("torrent has no file")
+	}
+	store, err := storage.OpenLayout(t.Layout, t.Path, t.TorrentFile)
 	if err != nil {
-		if err == io.EOF {
-			return false, nil
-		}
-		return false, err
+		return nil, err
 	}
-
-	// Verify the piece hash
-	h := sha1.Sum(buf)
-	return h == t.PieceHashes[index], nil
+	t.Storage = store
+	return store, nil
 }
 
-// scanExistingPieces checks which pieces are already downloaded and valid
-func (t *Torrent) scanExistingPieces(file *os.File) (int, error) {
-	donePieces := 0
-	for i := range t.PieceHashes {
-		exists, err := t.checkExistingPiece(i, file)
-		if err != nil {
-			return donePieces, err
-		}
-		if exists {
-			donePieces++
-		}
+// Close stops routing peers to the torrent, saves its resume data and closes its storage
+func (t *Torrent) Close() error {
+	t.unregister()
+	if t.Storage == nil {
+		return nil
 	}
-	return donePieces, nil
+	err := errors.Join(t.Storage.Flush(), t.SaveResume(), t.Storage.Close())
+	t.Storage = nil
+	return err
 }
 
-func (t *Torrent) StartDownload(output *os.File) error {
+// StartDownload downloads the missing pieces into store, or into the torrent's storage if store
+// is nil
+func (t *Torrent) StartDownload(store storage.Storage) error {
 	log.Printf("[Torrent] StartDownload called for %s", t.Name)
 	var err error
 
@@ -268,46 +483,42 @@ func (t *Torrent) StartDownload(output *os.File) error {
 		}
 	}
 
-	if output != nil {
-		t.Path = output.Name()
-	} else if t.Path != "" {
-		output, err = os.OpenFile(t.Path, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			log.Printf("[Torrent] Error opening file for download: %v", err)
-			return err
+	if store != nil {
+		if t.Storage != nil && t.Storage != store {
+			// The content moved, e.g. to a location chosen again on resume
+			if err := errors.Join(t.Storage.Flush(), t.Storage.Close()); err != nil {
+				log.Printf("[Torrent] Error closing the previous storage: %v", err)
+			}
 		}
-	} else {
-		log.Printf("[Torrent] No file is presented to StartDownload")
-		return fmt.Errorf("no file is presented to StartDownload")
+		t.Storage = store
+	} else if store, err = t.openStorage(); err != nil {
+		log.Printf("[Torrent] Error opening storage for download: %v", err)
+		return err
 	}
-	defer output.Close()
 
 	log.Printf("[Torrent] Initializing download status")
 	t.DownloadStatus = &torrentstatus.TorrentStatus{DonePieces: 0, PeersAmount: 0}
 
-	log.Printf("[Torrent] Initializing bitfield")
-	t.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
-
-	// Check for existing pieces
-	log.Printf("[Torrent] Scanning for existing pieces in file")
-	existingPieces, err := t.scanExistingPieces(output)
+	// Take the pieces from the resume data, or check the file if it changed since
+	log.Printf("[Torrent] Restoring existing pieces")
+	rd, err := t.restorePieces(store)
 	if err != nil {
-		log.Printf("[Torrent] error scanning existing pieces: %v", err)
-		return fmt.Errorf("error scanning existing pieces: %v", err)
+		log.Printf("[Torrent] error checking existing pieces: %v", err)
+		return fmt.Errorf("error checking existing pieces: %v", err)
 	}
+	if rd != nil {
+		t.DownloadStatus.DownloadedBytes = rd.Downloaded
+	}
+	existingPieces := t.countPieces()
 	t.DownloadStatus.DonePieces = existingPieces
-
-	// Set bitfield for existing pieces
-	for i := range t.PieceHashes {
-		exists, err := t.checkExistingPiece(i, output)
-		if err != nil {
-			log.Printf("[Torrent] Error checking existing piece %d: %v", i, err)
-			return err
+	defer func() {
+		if err := store.Flush(); err != nil {
+			log.Printf("[Torrent] Error flushing storage: %v", err)
 		}
-		if exists {
-			t.Bitfield.SetPiece(i)
+		if err := t.SaveResume(); err != nil {
+			log.Printf("[Torrent] Error saving resume data: %v", err)
 		}
-	}
+	}()
 
 	// If all pieces are already downloaded, we're done
 	if existingPieces == len(t.PieceHashes) {
@@ -315,38 +526,43 @@ func (t *Torrent) StartDownload(output *os.File) error {
 		return nil
 	}
 
-	// Get peers
+	if t.AllowsPeerDiscovery() {
+		lsd.Register(t.InfoHash, t)
+		defer lsd.Unregister(t.InfoHash)
+	}
+
+	// Get peers, carrying on with the ones already known if the trackers fail
 	log.Printf("[Torrent] Requesting peers for download")
-	t.Peers, err = t.RequestPeers(&t.PeerID, t.Port)
-	if err != nil {
+	if err := t.announceForPeers(); err != nil {
 		log.Printf("[Torrent] Error requesting peers: %v", err)
-		return err
+		if t.PeerPool.Len() == 0 && len(t.URLList) == 0 {
+			return err
+		}
 	}
-	t.DownloadStatus.PeersAmount = len(t.Peers)
+	lastAnnounce := time.Now()
 
 	// Init queues for workers to retrieve work and send results
 	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
+	// Room for every piece, so that workers never block on a download that returned early
+	results := make(chan *pieceResult, len(t.PieceHashes))
 	t.Paused = false
 
 	// Only queue pieces that haven't been downloaded yet
 	for index, hash := range t.PieceHashes {
-		exists, err := t.checkExistingPiece(index, output)
-		if err != nil {
-			log.Printf("[Torrent] Error checking existing piece %d: %v", index, err)
-			return err
-		}
-		if !exists {
+		if !t.Bitfield.HasPiece(index) {
 			length := t.calculatePieceSize(index)
-			workQueue <- &pieceWork{index, length, &hash}
+			workQueue <- &pieceWork{index: index, length: length, hash: &hash}
 		}
 	}
 
-	log.Printf("[Torrent] Starting download workers for %d peers", len(t.Peers))
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
-	}
+	log.Printf("[Torrent] Starting download workers for %d known peers", t.PeerPool.Len())
+	// Start workers for as many peers as the connection limits allow. The rest wait for a free slot,
+	// failed peers are retried after a backoff and the trackers are asked again when the pool runs dry.
+	slotFreed := make(chan struct{}, 1)
+	t.connectPeers(workQueue, results, slotFreed)
+	t.startWebSeedWorkers(workQueue, results)
+	replenish := time.NewTicker(ReplenishInterval)
+	defer replenish.Stop()
 
 	// Collect results into a buffer until full
 	for t.DownloadStatus.DonePieces < len(t.PieceHashes) {
@@ -355,16 +571,39 @@ func (t *Torrent) StartDownload(output *os.File) error {
 			return nil
 		}
 
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
+		select {
+		case <-slotFreed:
+			t.connectPeers(workQueue, results, slotFreed)
+		case <-replenish.C:
+			t.connectPeers(workQueue, results, slotFreed)
+			if len(t.PeerPool.Ready(time.Now())) == 0 && time.Since(lastAnnounce) >= ReannounceInterval {
+				lastAnnounce = time.Now()
+				go func() {
+					if err := t.announceForPeers(); err != nil {
+						log.Printf("[Torrent] Error requesting more peers: %v", err)
+						return
+					}
+					notify(slotFreed)
+				}()
+			}
+		case res := <-results:
+			begin, end := t.calculateBoundsForPiece(res.index)
 
-		t.DownloadStatus.IncrementDonePieces()
-		// percent := t.CalculateDownloadPercentage()
+			// percent := t.CalculateDownloadPercentage()
 
-		// log.Printf("[Torrent] (%0.2f%%) Downloaded piece #%d from %d peers", percent, res.index, t.DownloadStatus.GetPeersAmount())
-		if _, err := output.WriteAt(res.buf[:end-begin], int64(begin)); err != nil {
-			log.Printf("[Torrent] Error writing piece %d to file: %v", res.index, err)
-			return err
+			// log.Printf("[Torrent] (%0.2f%%) Downloaded piece #%d from %d peers", percent, res.index, t.DownloadStatus.GetPeersAmount())
+			if _, err := store.WriteAt(res.buf[:end-begin], int64(begin)); err != nil {
+				log.Printf("[Torrent] Error writing piece %d to storage: %v", res.index, err)
+				return err
+			}
+			if err := store.MarkComplete(res.index); err != nil {
+				log.Printf("[Torrent] Error completing piece %d in storage: %v", res.index, err)
+				return err
+			}
+			// Only a piece that is on disk may be saved in the resume data or offered to peers
+			t.Bitfield.SetPiece(res.index)
+			t.DownloadStatus.IncrementDonePieces()
+			t.DownloadStatus.AddDownloadedBytes(int64(end - begin))
 		}
 	}
 	close(workQueue)
@@ -378,9 +617,7 @@ func (t *Torrent) PauseDownload() error {
 }
 
 func (t *Torrent) ResumeDownload() error {
-	var err error
-	t.Peers, err = t.RequestPeers(&t.PeerID, t.Port)
-	if err != nil {
+	if err := t.announceForPeers(); err != nil {
 		log.Printf("[Torrent] Error requesting peers: %v", err)
 		return err
 	}
@@ -3,9 +3,10 @@ package torrentstatus
 import "sync"
 
 type TorrentStatus struct {
-	DonePieces  int
-	PeersAmount int
-	mu          sync.RWMutex
+	DonePieces      int
+	PeersAmount     int
+	DownloadedBytes int64 // Bytes of verified pieces received, kept across restarts
+	mu              sync.RWMutex
 }
 
 func (s *TorrentStatus) GetPeersAmount() int {
@@ -20,6 +21,18 @@ func (s *TorrentStatus) GetDonePieces() int {
 	return s.DonePieces
 }
 
+func (s *TorrentStatus) GetDownloadedBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.DownloadedBytes
+}
+
+func (s *TorrentStatus) AddDownloadedBytes(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DownloadedBytes += bytes
+}
+
 func (s *TorrentStatus) IncrementDonePieces() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -31,3 +44,35 @@ func (s *TorrentStatus) DecrementPeersAmount() {
 	defer s.mu.Unlock()
 	s.PeersAmount--
 }
+
+func (s *TorrentStatus) IncrementPeersAmount() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PeersAmount++
+}
+
+func (s *TorrentStatus) SetDonePieces(donePieces int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DonePieces = donePieces
+}
+
+// CheckStatus is the progress of a hash check of a torrent's files
+type CheckStatus struct {
+	Checked int
+	Total   int
+	mu      sync.RWMutex
+}
+
+func (s *CheckStatus) Get() (checked, total int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Checked, s.Total
+}
+
+func (s *CheckStatus) Update(checked, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Checked = checked
+	s.Total = total
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"client/common"
+	"client/webseed"
+	"context"
+	"log"
+	"time"
+)
+
+// WebSeedPeerThreshold is the number of connected peers below which web seeds are used, so
+// that the HTTP mirrors only carry the load when the swarm is thin
+const WebSeedPeerThreshold = 5
+
+// startWebSeedWorkers starts a worker for every web seed of the torrent
+func (t *Torrent) startWebSeedWorkers(workQueue chan *pieceWork, resultsQueue chan *pieceResult) {
+	for _, u := range t.URLList {
+		go t.startWebSeedWorker(webseed.New(u, t.TorrentFile), workQueue, resultsQueue)
+	}
+}
+
+// startWebSeedWorker downloads pieces from an HTTP seed until the queue is closed. The seed
+// rests while enough peers are connected and backs off after failures.
+func (t *Torrent) startWebSeedWorker(seed *webseed.Seed, workQueue chan *pieceWork, resultsQueue chan *pieceResult) {
+	log.Printf("[WebSeed] Starting web seed worker for %s", seed.URL)
+	for pw := range workQueue {
+		if t.Paused {
+			workQueue <- pw
+			return
+		}
+		now := time.Now()
+		if wait := seed.RetryAt().Sub(now); wait > 0 {
+			// Park the piece instead of cycling it through the queue, and rest for as long so
+			// the worker does not go on to park every other piece too
+			park(workQueue, pw, wait)
+			time.Sleep(min(wait, ReplenishInterval))
+			continue
+		}
+		if t.DownloadStatus.GetPeersAmount() >= WebSeedPeerThreshold {
+			workQueue <- pw
+			time.Sleep(ReplenishInterval)
+			continue
+		}
+		if delay := pw.retryDelay(seed.URL, now); delay > 0 {
+			park(workQueue, pw, delay)
+			continue
+		}
+
+		begin, _ := t.calculateBoundsForPiece(pw.index)
+		ctx, cancel := context.WithTimeout(context.Background(), webseed.RequestTimeout)
+		buf, err := seed.Fetch(ctx, begin, pw.length, common.AppState.DownloadLimiter, t.DownloadLimiter)
+		cancel()
+		if err == nil {
+			err = checkIntegrity(pw, buf)
+			if err != nil {
+				if pw.failedBy == nil {
+					pw.failedBy = make(map[string]time.Time)
+				}
+				pw.failedBy[seed.URL] = time.Now()
+			}
+		}
+		if err != nil {
+			workQueue <- pw
+			delay := seed.Failed(time.Now(), err)
+			log.Printf("[WebSeed] Piece #%d from %s failed, retrying in %s: %v", pw.index, seed.URL, delay, err)
+			continue
+		}
+		seed.Succeeded()
+		resultsQueue <- &pieceResult{pw.index, buf}
+	}
+	log.Printf("[WebSeed] Worker for %s finished", seed.URL)
+}
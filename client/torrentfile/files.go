@@ -0,0 +1,35 @@
+package torrentfile
+
+// File is one file of a multi-file torrent
+type File struct {
+	Path   []string // Path components below the directory named after the torrent
+	Length int
+}
+
+// Segment is the part of a byte range of the torrent's content that lies in a single file
+type Segment struct {
+	File   int // Index into Files, 0 for a single-file torrent
+	Offset int // Offset of the segment within the file
+	Length int
+}
+
+// Segments splits the length bytes at offset into the torrent's content into per-file
+// segments, skipping empty files. The range must lie within the content.
+func (tf *TorrentFile) Segments(offset, length int) []Segment {
+	if len(tf.Files) == 0 {
+		return []Segment{{File: 0, Offset: offset, Length: length}}
+	}
+	var segments []Segment
+	fileStart := 0
+	for i, f := range tf.Files {
+		fileEnd := fileStart + f.Length
+		if length > 0 && offset < fileEnd && f.Length > 0 {
+			n := min(length, fileEnd-offset)
+			segments = append(segments, Segment{File: i, Offset: offset - fileStart, Length: n})
+			offset += n
+			length -= n
+		}
+		fileStart = fileEnd
+	}
+	return segments
+}
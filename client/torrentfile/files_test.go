@@ -0,0 +1,40 @@
+package torrentfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	multi := &TorrentFile{
+		Length: 30,
+		Files: []File{
+			{Path: []string{"a"}, Length: 10},
+			{Path: []string{"empty"}, Length: 0},
+			{Path: []string{"b"}, Length: 5},
+			{Path: []string{"c"}, Length: 15},
+		},
+	}
+	tests := []struct {
+		name           string
+		tf             *TorrentFile
+		offset, length int
+		want           []Segment
+	}{
+		{"single file", &TorrentFile{Length: 100}, 40, 20, []Segment{{0, 40, 20}}},
+		{"within first file", multi, 2, 5, []Segment{{0, 2, 5}}},
+		{"ends at file end", multi, 5, 5, []Segment{{0, 5, 5}}},
+		{"across empty file", multi, 8, 4, []Segment{{0, 8, 2}, {2, 0, 2}}},
+		{"starts at file start", multi, 10, 3, []Segment{{2, 0, 3}}},
+		{"spans three files", multi, 9, 10, []Segment{{0, 9, 1}, {2, 0, 5}, {3, 0, 4}}},
+		{"whole content", multi, 0, 30, []Segment{{0, 0, 10}, {2, 0, 5}, {3, 0, 15}}},
+		{"last byte", multi, 29, 1, []Segment{{3, 14, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tf.Segments(tt.offset, tt.length); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Segments(%d, %d) = %v, want %v", tt.offset, tt.length, got, tt.want)
+			}
+		})
+	}
+}
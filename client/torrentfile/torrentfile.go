@@ -2,9 +2,10 @@ package torrentfile
 
 import (
 	"bytes"
+	"client/verify"
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"io"
 	"os"
 
 	"github.com/zeebo/bencode"
@@ -18,19 +19,30 @@ type TorrentFile struct {
 	PieceLength  int
 	Length       int
 	Name         string
-	Path         string // Path to the actual file to seed (not bencoded)
+	Private      bool     // BEP 27: peers may only come from the torrent's own trackers
+	Files        []File   // The files of a multi-file torrent in content order, nil for a single file
+	URLList      []string // BEP 19 web seeds serving the torrent's files over HTTP
+	Path         string   // Path to the actual file to seed (not bencoded)
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Files       []bencodeFile `bencode:"files"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private"`
 }
 
 type bencodeTorrent struct {
 	Announce     string             `bencode:"announce"`
 	AnnounceList [][]string         `bencode:"announce-list"`
+	URLList      bencode.RawMessage `bencode:"url-list"` // A single URL or a list of them
 	InfoRaw      bencode.RawMessage `bencode:"info"`
 }
 
@@ -104,12 +116,54 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 		PieceLength:  info.PieceLength,
 		Length:       info.Length,
 		Name:         info.Name,
+		Private:      info.Private == 1,
+		URLList:      bto.urlList(),
+	}
+	if len(info.Files) > 0 {
+		t.Length = 0
+		for _, f := range info.Files {
+			if f.Length < 0 || len(f.Path) == 0 {
+				return TorrentFile{}, fmt.Errorf("malformed file entry %v", f.Path)
+			}
+			t.Files = append(t.Files, File{Path: f.Path, Length: f.Length})
+			t.Length += f.Length
+		}
 	}
 	return t, nil
 }
 
-// CreateFromFile creates a TorrentFile from a file and metadata
-func CreateFromFile(filePath, announce, torrentName, description string, pieceLength int) (*TorrentFile, error) {
+// urlList decodes url-list, which is either a single URL or a list of them. Empty entries
+// are dropped.
+func (bto *bencodeTorrent) urlList() []string {
+	if len(bto.URLList) == 0 {
+		return nil
+	}
+	var urls []string
+	var single string
+	if err := bencode.DecodeBytes(bto.URLList, &single); err == nil {
+		urls = []string{single}
+	} else if err := bencode.DecodeBytes(bto.URLList, &urls); err != nil {
+		return nil
+	}
+	kept := urls[:0]
+	for _, u := range urls {
+		if u != "" {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// AllowsPeerDiscovery tells if peers may be found outside the torrent's trackers,
+// through DHT, peer exchange or local discovery. Private torrents only use their trackers.
+func (tf *TorrentFile) AllowsPeerDiscovery() bool {
+	return !tf.Private
+}
+
+// CreateFromFile creates a TorrentFile from a file and metadata. The pieces are hashed in
+// parallel, reporting to progress if it is not nil, and hashing stops when ctx is done.
+func CreateFromFile(ctx context.Context, filePath, announce, torrentName, description string, pieceLength int,
+	progress func(done, total int)) (*TorrentFile, error) {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return nil, err
@@ -122,20 +176,9 @@ func CreateFromFile(filePath, announce, torrentName, description string, pieceLe
 
 	length := int(fileInfo.Size())
 	name := torrentName
-	var pieceHashes [][20]byte
-	buf := make([]byte, pieceLength)
-	for {
-		n, err := file.Read(buf)
-		if n > 0 {
-			hash := sha1.Sum(buf[:n])
-			pieceHashes = append(pieceHashes, hash)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+	pieceHashes, err := verify.Hash(ctx, file, pieceLength, length, verify.Options{Progress: progress})
+	if err != nil {
+		return nil, err
 	}
 
 	tf := TorrentFile{
@@ -174,6 +217,9 @@ func (tf *TorrentFile) SaveToFile(path string) error {
 		"announce": tf.AnnounceList[0],
 		"info":     infoDict,
 	}
+	if len(tf.URLList) > 0 {
+		torrent["url-list"] = tf.URLList
+	}
 	out, err := os.Create(path)
 	if err != nil {
 		return err
@@ -33,6 +33,9 @@ func (t *TorrentFile) RequestPeers(peerID *[20]byte, port uint16) ([]peer.Peer,
 
 func (t *TorrentFile) requestPeersFromAnnounce(announce string, port uint16,
 	peerID *[20]byte) ([]peer.Peer, error) {
+	if isWebSocket(announce) {
+		return t.requestPeersWS(peerID, announce)
+	}
 	announce, isUDP := strings.CutPrefix(announce, "udp://")
 	if isUDP {
 		announce, _ = strings.CutSuffix(announce, "/announce")
@@ -43,6 +46,9 @@ func (t *TorrentFile) requestPeersFromAnnounce(announce string, port uint16,
 
 func (t *TorrentFile) SendSeedingAnnounce(announce string, port uint16,
 	peerID *[20]byte, downloaded, uploaded uint64) error {
+	if isWebSocket(announce) {
+		return t.sendSeedingAnnounceWS(peerID, announce, uploaded, downloaded)
+	}
 	announce, isUDP := strings.CutPrefix(announce, "udp://")
 	if isUDP {
 		announce, _ = strings.CutSuffix(announce, "/announce")
@@ -52,6 +58,15 @@ func (t *TorrentFile) SendSeedingAnnounce(announce string, port uint16,
 
 }
 
+// Scrape asks a tracker for the torrent's seeder and leecher counts. Only WebSocket trackers
+// are supported.
+func (t *TorrentFile) Scrape(announce string) (ScrapeStats, error) {
+	if !isWebSocket(announce) {
+		return ScrapeStats{}, fmt.Errorf("scrape is not supported for %s", announce)
+	}
+	return t.scrapeWS(announce)
+}
+
 func removeDuplicates(sliceList []peer.Peer) []peer.Peer {
 	allKeys := make(map[[4]byte]bool)
 	list := []peer.Peer{}
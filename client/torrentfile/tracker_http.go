@@ -1,21 +1,21 @@
 package torrentfile
 
 import (
+	"client/common"
 	"client/peer"
 	"context"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/zeebo/bencode"
 )
 
 type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	Interval int                `bencode:"interval"`
+	Peers    bencode.RawMessage `bencode:"peers"` // A compact string or a list of dictionaries
 }
 
 func (t *TorrentFile) buildTrackerURL(peerID *[20]byte, port uint16, announce, uploaded, downloaded, event string) (string, error) {
@@ -23,6 +23,11 @@ func (t *TorrentFile) buildTrackerURL(peerID *[20]byte, port uint16, announce, u
 	if err != nil {
 		return "", err
 	}
+	// Only the dictionary model carries peer IDs, so ask for it when they are verified
+	compact := "1"
+	if common.AppState.VerifyPeerIDs {
+		compact = "0"
+	}
 	params := url.Values{
 		"info_hash":  []string{string(t.InfoHash[:])},
 		"peer_id":    []string{string((*peerID)[:])},
@@ -30,10 +35,15 @@ func (t *TorrentFile) buildTrackerURL(peerID *[20]byte, port uint16, announce, u
 		"uploaded":   []string{uploaded},
 		"downloaded": []string{downloaded},
 		"event":      []string{event},
-		"compact":    []string{"1"},
+		"compact":    []string{compact},
 		"left":       []string{strconv.Itoa(t.Length)},
 	}
-	base.RawQuery = params.Encode()
+	// Keep the announce URL's own parameters, such as a private tracker's passkey, as they are
+	if base.RawQuery != "" {
+		base.RawQuery += "&" + params.Encode()
+	} else {
+		base.RawQuery = params.Encode()
+	}
 	return base.String(), nil
 }
 
@@ -45,12 +55,14 @@ func (t *TorrentFile) sendAnnounceHTTP(port uint16, peerID *[20]byte, announce,
 	}
 	// log.Printf("Url - %s", url)
 
-	var zeroDialer net.Dialer
 	c := &http.Client{Timeout: 15 * time.Second}
 	// force ipv4
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return zeroDialer.DialContext(ctx, "tcp4", addr)
+		return common.AppState.Proxy.DialContext(ctx, "tcp4", addr)
+	}
+	if common.AppState.Proxy.Enabled() {
+		transport.Proxy = nil // Our own proxy replaces any from the environment
 	}
 	c.Transport = transport
 
@@ -65,16 +77,16 @@ func (t *TorrentFile) sendAnnounceHTTP(port uint16, peerID *[20]byte, announce,
 		return nil, err
 	}
 
-	peers, err := peer.UnmarshalBinary([]byte(trackerResp.Peers))
-	if err == nil {
-		return peers, nil
+	var compactPeers string
+	if err := bencode.DecodeBytes(trackerResp.Peers, &compactPeers); err == nil {
+		return peer.UnmarshalBinary([]byte(compactPeers))
 	}
 
 	// log.Printf("Couldnt decode as binary, resolving to dict")
 
 	// Fallback: try to decode as dictionary model
 	var dictPeers []map[string]interface{}
-	err = bencode.NewDecoder(strings.NewReader(trackerResp.Peers)).Decode(&dictPeers)
+	err = bencode.DecodeBytes(trackerResp.Peers, &dictPeers)
 	// log.Printf("dictpeers - %v", dictPeers)
 	if err != nil {
 		// log.Printf("Couldnt decode as dict - %v, DATA=%s", err, trackerResp.Peers)
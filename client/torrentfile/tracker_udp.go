@@ -2,7 +2,9 @@ package torrentfile
 
 import (
 	"bytes"
+	"client/common"
 	"client/peer"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -61,7 +63,7 @@ func newAnnounceRequestUDP(connectionID uint64, infoHash [20]byte, peerID [20]by
 		TransactionID: rand.Uint32(), Action: 1}
 }
 
-func sendConnectUDP(conn *net.UDPConn) (connectionID uint64, err error) {
+func sendConnectUDP(conn net.Conn) (connectionID uint64, err error) {
 	reqObject := newConnectRequestUDP()
 	err = binary.Write(conn, binary.BigEndian, reqObject)
 	if err != nil {
@@ -84,7 +86,7 @@ func sendConnectUDP(conn *net.UDPConn) (connectionID uint64, err error) {
 	return
 }
 
-func sendAnnounceUDP(conn *net.UDPConn, connectionID uint64, infoHash *[20]byte,
+func sendAnnounceUDP(conn net.Conn, connectionID uint64, infoHash *[20]byte,
 	port uint16, peerID *[20]byte, downloaded, uploaded uint64, event uint32) (peers []peer.Peer, err error) {
 	const BUFF_SIZE = 1024
 	const HEADER_LENGTH = 20
@@ -136,16 +138,13 @@ func sendAnnounceUDP(conn *net.UDPConn, connectionID uint64, infoHash *[20]byte,
 
 func (t *TorrentFile) sendFullAnnounceUDP(port uint16, peerID *[20]byte,
 	announce string, downloaded, uploaded uint64, event uint32) (peers []peer.Peer, err error) {
-	raddr, err := net.ResolveUDPAddr("udp", announce)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := common.AppState.Proxy.DialUDP(ctx, announce)
 	if err != nil {
 		return
 	}
-
-	conn, err := net.DialUDP("udp", nil, raddr)
-	if err != nil {
-		return
-	}
-	// log.Printf("Dialed to %v", raddr)
+	// log.Printf("Dialed to %v", announce)
 	defer conn.Close()
 
 	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
@@ -0,0 +1,319 @@
+package torrentfile
+
+import (
+	"client/common"
+	"client/peer"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket trackers speak the WebTorrent JSON protocol. Its peers connect over WebRTC, which
+// this client cannot do, so announces return no peers. They still put us in the tracker's
+// swarm listing, and the tracker drops us from it when the socket closes, so each tracker's
+// socket is kept open and shared by all torrents. When it drops, it is reopened and the torrents
+// announced on it are announced again.
+
+// wsTimeout bounds connecting to a WebSocket tracker and waiting for each of its replies
+const wsTimeout = 15 * time.Second
+
+// wsMaxReconnectDelay caps the wait between attempts to reopen a dropped socket
+const wsMaxReconnectDelay = 10 * time.Minute
+
+// wsReconnectDelay is the wait before the first attempt to reopen a dropped socket
+var wsReconnectDelay = wsTimeout
+
+// ScrapeStats are a tracker's counts for one torrent
+type ScrapeStats struct {
+	Complete   int `json:"complete"`   // Seeders
+	Incomplete int `json:"incomplete"` // Leechers
+	Downloaded int `json:"downloaded"` // Completed downloads
+}
+
+type wsAnnounceRequest struct {
+	Action     string `json:"action"`
+	InfoHash   string `json:"info_hash"`
+	PeerID     string `json:"peer_id"`
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+	Left       int    `json:"left"`
+	Event      string `json:"event,omitempty"`
+	NumWant    int    `json:"numwant"`
+	Offers     []any  `json:"offers"` // Always empty, we cannot make WebRTC offers
+}
+
+type wsScrapeRequest struct {
+	Action   string   `json:"action"`
+	InfoHash []string `json:"info_hash"`
+}
+
+type wsResponse struct {
+	Action   string                 `json:"action"`
+	InfoHash string                 `json:"info_hash"`
+	Files    map[string]ScrapeStats `json:"files"` // Scrape replies, keyed by infohash
+	Failure  string                 `json:"failure reason"`
+	Offer    any                    `json:"offer"`  // Relayed from a browser peer
+	Answer   any                    `json:"answer"` // Relayed from a browser peer
+}
+
+// wsTracker is an open socket to a WebSocket tracker. Replies are matched to requests by
+// action and infohash, in the order the requests were sent.
+type wsTracker struct {
+	announce  string
+	conn      *websocket.Conn
+	mu        sync.Mutex
+	waiting   map[string][]chan *wsResponse
+	announced map[string]*wsAnnounceRequest // Last announce of each torrent, by infohash
+	closed    chan struct{}
+}
+
+var (
+	wsMu       sync.Mutex
+	wsTrackers = make(map[string]*wsTracker)
+)
+
+func isWebSocket(announce string) bool {
+	return strings.HasPrefix(announce, "ws://") || strings.HasPrefix(announce, "wss://")
+}
+
+// binaryString encodes bytes the way WebTorrent puts infohashes and peer IDs in JSON, one
+// character per byte
+func binaryString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// parseBinaryString reverses binaryString
+func parseBinaryString(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, fmt.Errorf("invalid binary string character %U", r)
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// getWSTracker returns the open socket to announce, connecting if there is none
+func getWSTracker(announce string) (*wsTracker, error) {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	if tr, ok := wsTrackers[announce]; ok {
+		select {
+		case <-tr.closed:
+		default:
+			return tr, nil
+		}
+	}
+	conn, err := dialWS(announce)
+	if err != nil {
+		return nil, err
+	}
+	tr := &wsTracker{
+		announce:  announce,
+		conn:      conn,
+		waiting:   make(map[string][]chan *wsResponse),
+		announced: make(map[string]*wsAnnounceRequest),
+		closed:    make(chan struct{}),
+	}
+	wsTrackers[announce] = tr
+	go tr.readLoop()
+	return tr, nil
+}
+
+// dialWS opens the socket through the session's proxy and bind address
+func dialWS(announce string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(announce, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	host := config.Location.Hostname()
+	port := config.Location.Port()
+	secure := config.Location.Scheme == "wss"
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wsTimeout)
+	defer cancel()
+	conn, err := common.AppState.Proxy.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(wsTimeout))
+	if secure {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+func (tr *wsTracker) readLoop() {
+	defer tr.reconnect()
+	defer tr.close()
+	for {
+		var resp wsResponse
+		if err := websocket.JSON.Receive(tr.conn, &resp); err != nil {
+			// log.Printf("[WSTracker] Socket closed: %v", err)
+			return
+		}
+		if resp.Offer != nil || resp.Answer != nil {
+			continue // WebRTC signalling we cannot take part in
+		}
+		key := resp.Action + resp.InfoHash
+		if resp.Action == "scrape" {
+			key = resp.Action
+		}
+		tr.mu.Lock()
+		if queue := tr.waiting[key]; len(queue) > 0 {
+			queue[0] <- &resp
+			tr.waiting[key] = queue[1:]
+		}
+		tr.mu.Unlock()
+	}
+}
+
+func (tr *wsTracker) close() {
+	tr.conn.Close()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	select {
+	case <-tr.closed:
+	default:
+		close(tr.closed)
+	}
+}
+
+// reconnect reopens the socket after it closed and announces its torrents again, since the
+// tracker dropped them from its swarms. It keeps retrying, with a growing delay, for as long as
+// the client runs.
+func (tr *wsTracker) reconnect() {
+	tr.mu.Lock()
+	announced := tr.announced
+	tr.mu.Unlock()
+	if len(announced) == 0 {
+		return
+	}
+	for delay := wsReconnectDelay; ; delay = min(2*delay, wsMaxReconnectDelay) {
+		time.Sleep(delay)
+		next, err := getWSTracker(tr.announce)
+		if err != nil {
+			// log.Printf("[WSTracker] Reconnecting to %s: %v", tr.announce, err)
+			continue
+		}
+		for infoHash, req := range announced {
+			next.mu.Lock()
+			_, newer := next.announced[infoHash]
+			next.mu.Unlock()
+			if !newer {
+				// A failure closes the new socket, which reconnects in turn
+				next.sendAnnounce(req)
+			}
+		}
+		return
+	}
+}
+
+// sendAnnounce sends req and remembers it to be sent again if the socket drops
+func (tr *wsTracker) sendAnnounce(req *wsAnnounceRequest) error {
+	tr.mu.Lock()
+	tr.announced[req.InfoHash] = req
+	tr.mu.Unlock()
+	_, err := tr.request("announce"+req.InfoHash, req)
+	return err
+}
+
+// request sends msg and waits for the reply with the given key
+func (tr *wsTracker) request(key string, msg any) (*wsResponse, error) {
+	reply := make(chan *wsResponse, 1)
+	tr.mu.Lock()
+	tr.waiting[key] = append(tr.waiting[key], reply)
+	tr.conn.SetWriteDeadline(time.Now().Add(wsTimeout))
+	err := websocket.JSON.Send(tr.conn, msg)
+	tr.mu.Unlock()
+	if err != nil {
+		tr.close()
+		return nil, err
+	}
+	select {
+	case resp := <-reply:
+		if resp.Failure != "" {
+			return nil, fmt.Errorf("tracker failure: %s", resp.Failure)
+		}
+		return resp, nil
+	case <-tr.closed:
+		return nil, errors.New("tracker closed the connection")
+	case <-time.After(wsTimeout):
+		// Forget the socket, a tracker that stops answering is reconnected to next time
+		tr.close()
+		return nil, errors.New("tracker did not answer")
+	}
+}
+
+func (t *TorrentFile) sendAnnounceWS(peerID *[20]byte, announce string, uploaded, downloaded uint64,
+	left int, event string) error {
+	tr, err := getWSTracker(announce)
+	if err != nil {
+		return err
+	}
+	return tr.sendAnnounce(&wsAnnounceRequest{
+		Action:     "announce",
+		InfoHash:   binaryString(t.InfoHash[:]),
+		PeerID:     binaryString(peerID[:]),
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Event:      event,
+		Offers:     []any{},
+	})
+}
+
+func (t *TorrentFile) requestPeersWS(peerID *[20]byte, announce string) ([]peer.Peer, error) {
+	return nil, t.sendAnnounceWS(peerID, announce, 0, 0, t.Length, "started")
+}
+
+func (t *TorrentFile) sendSeedingAnnounceWS(peerID *[20]byte, announce string, uploaded, downloaded uint64) error {
+	// Announcing nothing left lists us as a seeder
+	return t.sendAnnounceWS(peerID, announce, uploaded, downloaded, 0, "started")
+}
+
+func (t *TorrentFile) scrapeWS(announce string) (ScrapeStats, error) {
+	tr, err := getWSTracker(announce)
+	if err != nil {
+		return ScrapeStats{}, err
+	}
+	infoHash := binaryString(t.InfoHash[:])
+	resp, err := tr.request("scrape", &wsScrapeRequest{Action: "scrape", InfoHash: []string{infoHash}})
+	if err != nil {
+		return ScrapeStats{}, err
+	}
+	for key, stats := range resp.Files {
+		if b, err := parseBinaryString(key); err == nil && string(b) == string(t.InfoHash[:]) {
+			return stats, nil
+		}
+	}
+	return ScrapeStats{}, errors.New("tracker does not know the torrent")
+}
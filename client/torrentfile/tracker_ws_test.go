@@ -0,0 +1,113 @@
+package torrentfile
+
+import (
+	"client/common"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func init() {
+	common.InitAppState()
+}
+
+func TestBinaryString(t *testing.T) {
+	b := []byte{0, 1, 0x7f, 0x80, 0xff}
+	got, err := parseBinaryString(binaryString(b))
+	if err != nil || string(got) != string(b) {
+		t.Errorf("round trip = %x, %v, want %x", got, err, b)
+	}
+	if _, err := parseBinaryString("Ā"); err == nil {
+		t.Error("parsed a character above 0xff")
+	}
+}
+
+// wsAnnounce is an announce the test tracker received, and the socket it came on
+type wsAnnounce struct {
+	socket int
+	req    wsAnnounceRequest
+}
+
+// newWSTracker serves a WebSocket tracker that reports announces and closes the first socket
+// once drop is signalled
+func newWSTracker(announces chan<- wsAnnounce, drop <-chan struct{}, stats ScrapeStats) *httptest.Server {
+	sockets := make(chan int, 1)
+	sockets <- 0
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		socket := <-sockets + 1
+		sockets <- socket
+		if socket == 1 {
+			go func() {
+				<-drop
+				ws.Close()
+			}()
+		}
+		for {
+			var req map[string]any
+			if err := websocket.JSON.Receive(ws, &req); err != nil {
+				return
+			}
+			switch req["action"] {
+			case "announce":
+				var a wsAnnounceRequest
+				a.InfoHash, _ = req["info_hash"].(string)
+				a.Left = int(req["left"].(float64))
+				a.Event, _ = req["event"].(string)
+				announces <- wsAnnounce{socket, a}
+				websocket.JSON.Send(ws, wsResponse{Action: "announce", InfoHash: a.InfoHash})
+			case "scrape":
+				files := make(map[string]ScrapeStats)
+				for _, h := range req["info_hash"].([]any) {
+					files[h.(string)] = stats
+				}
+				websocket.JSON.Send(ws, wsResponse{Action: "scrape", Files: files})
+			}
+		}
+	}))
+}
+
+func TestWebSocketTracker(t *testing.T) {
+	wsReconnectDelay = 10 * time.Millisecond
+	announces := make(chan wsAnnounce, 10)
+	drop := make(chan struct{})
+	want := ScrapeStats{Complete: 3, Incomplete: 5, Downloaded: 8}
+	srv := newWSTracker(announces, drop, want)
+	defer srv.Close()
+	announce := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	tf := &TorrentFile{Length: 100, AnnounceList: []string{announce}}
+	copy(tf.InfoHash[:], "\x00\xff01234567890123456")
+	var peerID [20]byte
+	if err := tf.SendSeedingAnnounce(announce, 6881, &peerID, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+	first := <-announces
+	if first.socket != 1 || first.req.InfoHash != binaryString(tf.InfoHash[:]) || first.req.Left != 0 {
+		t.Errorf("first announce = %+v", first)
+	}
+
+	got, err := tf.Scrape(announce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Scrape = %+v, want %+v", got, want)
+	}
+	if _, err := tf.Scrape("udp://tracker.example.com:80"); err == nil {
+		t.Error("scraped a UDP tracker")
+	}
+
+	// The tracker drops the socket, and with it the torrent from its swarm
+	close(drop)
+	select {
+	case again := <-announces:
+		if again.socket < 2 || again.req.InfoHash != first.req.InfoHash || again.req.Left != 0 {
+			t.Errorf("announce after reconnecting = %+v", again)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the torrent was not announced again after the socket dropped")
+	}
+}
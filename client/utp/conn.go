@@ -0,0 +1,513 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	recvBufferSize = 1 << 20 // Bytes of received data we buffer, advertised as our window
+	maxReorder     = 512     // Out-of-order packets kept while waiting for a gap to fill
+	minRTO         = 500 * time.Millisecond
+	initialRTO     = time.Second
+	maxRetransmits = 8
+	tickInterval   = 50 * time.Millisecond
+	lingerTimeout  = 10 * time.Second // How long a closed connection keeps retransmitting its FIN
+)
+
+var errReset = errors.New("uTP connection reset by peer")
+
+type outPacket struct {
+	typ         uint8
+	seq         uint16
+	payload     []byte
+	sentAt      time.Time
+	transmits   int
+	needsResend bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s              *Socket
+	raddr          net.Addr
+	recvID, sendID uint16
+
+	mu         sync.Mutex
+	seq        uint16 // Next sequence number to send
+	ack        uint16 // Last sequence number received in order
+	replyMicro uint32 // Delay of the last packet received, echoed in tsDiff
+
+	// Send side
+	unacked  []*outPacket
+	inFlight int
+	peerWnd  uint32
+	cc       *ledbat
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	dupAcks  int
+	finSent  bool
+
+	// Receive side
+	readBuf  []byte
+	reorder  map[uint16][]byte
+	finSeq   uint16
+	gotFin   bool
+	eof      bool
+	reorderN int
+
+	readDeadline, writeDeadline time.Time
+	readable, writable          chan struct{}
+	established                 chan struct{}
+	estOnce                     sync.Once
+	done                        chan struct{}
+	doneOnce                    sync.Once
+	err                         error
+	closedAt                    time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:           s,
+		raddr:       raddr,
+		recvID:      recvID,
+		sendID:      sendID,
+		peerWnd:     recvBufferSize,
+		cc:          newLedbat(),
+		rto:         initialRTO,
+		reorder:     make(map[uint16][]byte),
+		readable:    make(chan struct{}, 1),
+		writable:    make(chan struct{}, 1),
+		established: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go c.timerLoop()
+	return c
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) recvWindow() uint32 {
+	used := len(c.readBuf) + c.reorderN
+	if used >= recvBufferSize {
+		return 0
+	}
+	return uint32(recvBufferSize - used)
+}
+
+// sendPacketLocked transmits p with the current ack state. c.mu must be held.
+func (c *Conn) sendPacketLocked(p *outPacket) {
+	connID := c.sendID
+	if p.typ == stSyn {
+		connID = c.recvID
+	}
+	h := header{
+		typ:    p.typ,
+		connID: connID,
+		ts:     timestamp(),
+		tsDiff: c.replyMicro,
+		wnd:    c.recvWindow(),
+		seq:    p.seq,
+		ack:    c.ack,
+	}
+	p.sentAt = time.Now()
+	p.transmits++
+	p.needsResend = false
+	c.s.send(h.marshal(p.payload), c.raddr)
+}
+
+// queueLocked sends a packet that must be acknowledged. c.mu must be held.
+func (c *Conn) queueLocked(typ uint8, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.unacked = append(c.unacked, p)
+	c.inFlight += len(payload)
+	c.sendPacketLocked(p)
+}
+
+func (c *Conn) sendSyn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = 1
+	c.queueLocked(stSyn, nil)
+}
+
+// acceptSyn sets up the receiving side of a connection from the peer's SYN
+func (c *Conn) acceptSyn(h header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = uint16(rand.Uint32())
+	c.ack = h.seq
+	c.peerWnd = h.wnd
+	c.replyMicro = timestamp() - h.ts
+	c.estOnce.Do(func() { close(c.established) })
+}
+
+// sendState acknowledges everything received so far
+func (c *Conn) sendState() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendStateLocked()
+}
+
+func (c *Conn) sendStateLocked() {
+	h := header{
+		typ:    stState,
+		connID: c.sendID,
+		ts:     timestamp(),
+		tsDiff: c.replyMicro,
+		wnd:    c.recvWindow(),
+		seq:    c.seq,
+		ack:    c.ack,
+	}
+	c.s.send(h.marshal(nil), c.raddr)
+}
+
+// handle processes a packet the socket routed to this connection
+func (c *Conn) handle(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.replyMicro = timestamp() - h.ts
+	c.peerWnd = h.wnd
+
+	switch h.typ {
+	case stReset:
+		c.teardownLocked(errReset)
+		return
+	case stSyn:
+		// Our STATE answering the SYN was lost
+		c.sendStateLocked()
+		return
+	}
+
+	select {
+	case <-c.established:
+	default:
+		if h.typ != stState {
+			return
+		}
+		// The STATE answering our SYN doesn't use up a sequence number, so the peer's
+		// first data packet carries the same one
+		c.ack = h.seq - 1
+		c.estOnce.Do(func() { close(c.established) })
+	}
+
+	c.processAckLocked(h, now)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receiveLocked(h, payload)
+		c.sendStateLocked()
+	}
+	if c.finSent && len(c.unacked) == 0 && c.gotFin && c.eof {
+		c.teardownLocked(nil)
+	}
+}
+
+func (c *Conn) processAckLocked(h header, now time.Time) {
+	acked := 0
+	ackedPackets := 0
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		p := c.unacked[0]
+		c.unacked = c.unacked[1:]
+		c.inFlight -= len(p.payload)
+		acked += len(p.payload)
+		ackedPackets++
+		if p.transmits == 1 {
+			c.updateRTTLocked(now.Sub(p.sentAt))
+		}
+	}
+	if ackedPackets > 0 {
+		c.dupAcks = 0
+		if h.tsDiff != 0 {
+			ourDelay := c.cc.addSample(h.tsDiff, now)
+			c.cc.onAck(acked, ourDelay, c.inFlight+acked)
+		}
+		signal(c.writable)
+		return
+	}
+	if h.typ == stState && len(c.unacked) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			// Fast retransmit of the packet the peer keeps waiting for
+			c.cc.onLoss()
+			c.sendPacketLocked(c.unacked[0])
+		}
+	}
+}
+
+func (c *Conn) updateRTTLocked(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, minRTO)
+}
+
+func (c *Conn) receiveLocked(h header, payload []byte) {
+	if h.typ == stFin {
+		c.gotFin = true
+		c.finSeq = h.seq
+	}
+	if !seqLess(c.ack, h.seq) {
+		return // Already received
+	}
+	if h.seq != c.ack+1 {
+		if _, ok := c.reorder[h.seq]; !ok && len(c.reorder) < maxReorder {
+			c.reorder[h.seq] = append([]byte(nil), payload...)
+			c.reorderN += len(payload)
+		}
+		return
+	}
+	c.readBuf = append(c.readBuf, payload...)
+	c.ack = h.seq
+	for {
+		next, ok := c.reorder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.reorderN -= len(next)
+		c.readBuf = append(c.readBuf, next...)
+		c.ack++
+	}
+	if c.gotFin && c.ack == c.finSeq {
+		c.eof = true
+	}
+	signal(c.readable)
+}
+
+func (c *Conn) timerLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.tick(time.Now())
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closedAt.IsZero() && now.Sub(c.closedAt) > lingerTimeout {
+		c.teardownLocked(nil)
+		return
+	}
+	if len(c.unacked) == 0 {
+		if c.finSent {
+			c.teardownLocked(nil)
+		}
+		return
+	}
+	oldest := c.unacked[0]
+	if now.Sub(oldest.sentAt) < c.rto {
+		return
+	}
+	if oldest.transmits > maxRetransmits {
+		c.teardownLocked(&timeoutError{"uTP peer stopped acknowledging"})
+		return
+	}
+	c.cc.onTimeout()
+	c.rto = min(2*c.rto, time.Minute)
+	c.sendPacketLocked(oldest)
+}
+
+// teardownLocked ends the connection. c.mu must be held.
+func (c *Conn) teardownLocked(err error) {
+	c.doneOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		go c.s.remove(c)
+	})
+	signal(c.readable)
+	signal(c.writable)
+}
+
+func (c *Conn) abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.teardownLocked(err)
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return net.ErrClosed
+}
+
+// wait blocks until ch is signalled, the connection ends or deadline passes
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-c.done:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Read reads received data, returning io.EOF once the peer closed the connection
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.readBuf) > 0 {
+			wasFull := c.recvWindow() < maxPayload
+			n := copy(p, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			if wasFull {
+				// Tell the peer the window opened again
+				c.sendStateLocked()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		select {
+		case <-c.done:
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		default:
+		}
+		if !c.closedAt.IsZero() {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends p, waiting while the congestion or the peer's receive window is full
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		select {
+		case <-c.done:
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return written, err
+		default:
+		}
+		if !c.closedAt.IsZero() {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		window := min(int(c.cc.window), int(c.peerWnd))
+		room := window - c.inFlight
+		if room < min(maxPayload, len(p)-written) && c.inFlight > 0 {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := c.wait(c.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p)-written, maxPayload)
+		if room > 0 && room < n {
+			n = room
+		}
+		c.queueLocked(stData, append([]byte(nil), p[written:written+n]...))
+		written += n
+		c.mu.Unlock()
+	}
+	return written, nil
+}
+
+// Close sends a FIN and returns. The connection keeps retransmitting in the background until
+// everything is acknowledged.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closedAt.IsZero() {
+		return nil
+	}
+	c.closedAt = time.Now()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	if !c.finSent {
+		c.finSent = true
+		c.queueLocked(stFin, nil)
+	}
+	signal(c.readable)
+	signal(c.writable)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.s.Addr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	signal(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	signal(c.writable)
+	return nil
+}
@@ -0,0 +1,70 @@
+package utp
+
+import "time"
+
+// LEDBAT congestion control (RFC 6817, as used by BEP 29): the window grows while the one-way
+// delay measured by the peer stays under target, and shrinks as soon as queues build up, so
+// uTP yields to interactive TCP traffic sharing the link.
+const (
+	target            = 100 * time.Millisecond
+	maxWindowIncrease = 3000 // Bytes per RTT when the delay is far below target
+	minWindow         = maxPayload
+	maxWindowSize     = 1 << 20
+	baseDelayHistory  = 2 // Minutes the base delay is remembered for
+)
+
+type ledbat struct {
+	window      float64 // Bytes allowed in flight
+	baseDelays  [baseDelayHistory + 1]uint32
+	minuteStart time.Time
+	slot        int
+	haveBase    bool
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{window: 2 * maxPayload}
+}
+
+// addSample records a one-way delay sample and returns the delay above the base delay
+func (l *ledbat) addSample(delay uint32, now time.Time) time.Duration {
+	if !l.haveBase {
+		for i := range l.baseDelays {
+			l.baseDelays[i] = delay
+		}
+		l.minuteStart = now
+		l.haveBase = true
+	}
+	if now.Sub(l.minuteStart) >= time.Minute {
+		l.slot = (l.slot + 1) % len(l.baseDelays)
+		l.baseDelays[l.slot] = delay
+		l.minuteStart = now
+	}
+	if delay < l.baseDelays[l.slot] {
+		l.baseDelays[l.slot] = delay
+	}
+	base := l.baseDelays[0]
+	for _, d := range l.baseDelays[1:] {
+		if d < base {
+			base = d
+		}
+	}
+	return time.Duration(delay-base) * time.Microsecond
+}
+
+// onAck grows or shrinks the window after acked bytes were acknowledged with the given queuing delay
+func (l *ledbat) onAck(acked int, ourDelay time.Duration, flight int) {
+	offTarget := float64(target-ourDelay) / float64(target)
+	windowFactor := float64(acked) / max(l.window, float64(flight), 1)
+	l.window += maxWindowIncrease * offTarget * windowFactor
+	l.window = min(max(l.window, minWindow), maxWindowSize)
+}
+
+// onTimeout collapses the window after a retransmission timeout
+func (l *ledbat) onTimeout() {
+	l.window = minWindow
+}
+
+// onLoss halves the window after a packet was detected lost
+func (l *ledbat) onLoss() {
+	l.window = max(l.window/2, minWindow)
+}
@@ -0,0 +1,88 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	// maxPayload keeps packets, with the UDP and IP headers, under a typical 1500 byte MTU
+	maxPayload = 1400 - headerSize
+)
+
+// header is the fixed 20 byte uTP packet header
+type header struct {
+	typ    uint8
+	ext    uint8
+	connID uint16
+	ts     uint32 // Sender's clock in microseconds
+	tsDiff uint32 // Sender's clock minus the timestamp of the last packet it received
+	wnd    uint32 // Bytes the sender can still receive
+	seq    uint16
+	ack    uint16
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = h.typ<<4 | version
+	buf[1] = 0 // No extensions are sent
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.ts)
+	binary.BigEndian.PutUint32(buf[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+var errNotUTP = errors.New("not a uTP packet")
+
+// parsePacket splits a datagram into its header and payload, skipping any extensions
+func parsePacket(buf []byte) (header, []byte, error) {
+	var h header
+	if len(buf) < headerSize || buf[0]&0x0f != version || buf[0]>>4 > stSyn {
+		return h, nil, errNotUTP
+	}
+	h.typ = buf[0] >> 4
+	h.ext = buf[1]
+	h.connID = binary.BigEndian.Uint16(buf[2:4])
+	h.ts = binary.BigEndian.Uint32(buf[4:8])
+	h.tsDiff = binary.BigEndian.Uint32(buf[8:12])
+	h.wnd = binary.BigEndian.Uint32(buf[12:16])
+	h.seq = binary.BigEndian.Uint16(buf[16:18])
+	h.ack = binary.BigEndian.Uint16(buf[18:20])
+	payload := buf[headerSize:]
+	for ext := h.ext; ext != 0; {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return h, nil, errNotUTP
+		}
+		ext = payload[0]
+		payload = payload[2+int(payload[1]):]
+	}
+	return h, payload, nil
+}
+
+// seqLess compares sequence numbers that wrap around at 2^16
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+var epoch = time.Now()
+
+// timestamp returns the local clock in microseconds, wrapping at 2^32 like the header field
+func timestamp() uint32 {
+	return uint32(time.Since(epoch).Microseconds())
+}
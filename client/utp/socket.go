@@ -0,0 +1,217 @@
+package utp
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptBacklog is the number of inbound connections waiting for Accept before new ones are reset
+const acceptBacklog = 64
+
+type connKey struct {
+	addr string
+	id   uint16 // The connection ID of packets arriving for the connection
+}
+
+// Socket multiplexes uTP connections over one UDP socket. It is a net.Listener for inbound
+// connections and dials outbound ones from the same port. Datagrams that are not uTP, such as
+// DHT messages, are passed to the handler set with HandleOther.
+type Socket struct {
+	pc        net.PacketConn
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	accept    chan *Conn
+	other     func(packet []byte, from net.Addr)
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a uTP socket on the UDP address addr
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over an existing packet connection
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// HandleOther sets the handler for datagrams that are not uTP packets. The packet is only
+// valid during the call.
+func (s *Socket) HandleOther(handler func(packet []byte, from net.Addr)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.other = handler
+}
+
+// WriteTo sends a raw datagram from the socket, for protocols sharing it through HandleOther
+func (s *Socket) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	return s.pc.WriteTo(packet, addr)
+}
+
+// Accept waits for the next inbound connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the socket's local address
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the UDP socket, resetting every connection on it
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.abort(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// Dial connects to a uTP peer at addr, giving up after timeout
+func (s *Socket) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	var c *Conn
+	for {
+		recvID := uint16(rand.Uint32())
+		key := connKey{raddr.String(), recvID}
+		if _, taken := s.conns[key]; taken {
+			continue
+		}
+		c = newConn(s, raddr, recvID, recvID+1)
+		s.conns[key] = c
+		break
+	}
+	s.mu.Unlock()
+
+	c.sendSyn()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.established:
+		return c, nil
+	case <-c.done:
+		return nil, c.closeErr()
+	case <-timer.C:
+		c.abort(errDialTimeout)
+		return nil, errDialTimeout
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+var errDialTimeout = &timeoutError{"uTP connection timed out"}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(packet []byte, addr net.Addr) {
+	s.pc.WriteTo(packet, addr)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 0x10000)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.Close()
+				return
+			}
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			s.mu.Lock()
+			other := s.other
+			s.mu.Unlock()
+			if other != nil {
+				other(buf[:n], from)
+			}
+			continue
+		}
+		s.dispatch(h, payload, from)
+	}
+}
+
+func (s *Socket) dispatch(h header, payload []byte, from net.Addr) {
+	s.mu.Lock()
+	c, ok := s.conns[connKey{from.String(), h.connID}]
+	if !ok && h.typ == stSyn {
+		// A retransmitted SYN belongs to the connection it already created
+		c, ok = s.conns[connKey{from.String(), h.connID + 1}]
+	}
+	if ok {
+		s.mu.Unlock()
+		c.handle(h, payload)
+		return
+	}
+	if h.typ != stSyn {
+		s.mu.Unlock()
+		if h.typ != stReset {
+			s.sendReset(h, from)
+		}
+		return
+	}
+	c = newConn(s, from, h.connID+1, h.connID)
+	c.acceptSyn(h)
+	select {
+	case s.accept <- c:
+		s.conns[connKey{from.String(), c.recvID}] = c
+		s.mu.Unlock()
+		c.sendState()
+	default:
+		s.mu.Unlock()
+		s.sendReset(h, from)
+	}
+}
+
+func (s *Socket) sendReset(h header, to net.Addr) {
+	reset := header{typ: stReset, connID: h.connID, ts: timestamp(), seq: uint16(rand.Uint32()), ack: h.seq}
+	s.send(reset.marshal(nil), to)
+}
+
+type timeoutError struct{ msg string }
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,273 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xffff, 0, true},      // 0 follows 0xffff
+		{0, 0xffff, false},     // and 0xffff precedes 0
+		{0xfff0, 0x0010, true}, // Across the wrap
+		{0x0010, 0xfff0, false},
+		{0, 0x7fff, true},  // Half the space ahead
+		{0, 0x8001, false}, // More than half ahead counts as behind
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqLess(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	h := header{typ: stData, connID: 0xbeef, ts: 1, tsDiff: 2, wnd: 3, seq: 0xfffe, ack: 7}
+	got, payload, err := parsePacket(h.marshal([]byte("data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h || string(payload) != "data" {
+		t.Errorf("parsePacket = %+v %q, want %+v %q", got, payload, h, "data")
+	}
+	// UDP tracker replies start with a zero byte and must not pass for uTP
+	if _, _, err := parsePacket(make([]byte, 32)); !errors.Is(err, errNotUTP) {
+		t.Errorf("parsePacket of zeros = %v, want errNotUTP", err)
+	}
+}
+
+// faultyConn drops and reorders the data packets written through it. Data packets are numbered
+// from 1 in the order they are written, retransmissions included; other packets pass untouched.
+type faultyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	n    int
+	drop map[int]bool // Data packets that are dropped
+	hold map[int]int  // Data packets sent only after the packet they map to
+	held map[int][]heldPacket
+}
+
+type heldPacket struct {
+	packet []byte
+	addr   net.Addr
+}
+
+func (c *faultyConn) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	h, _, err := parsePacket(packet)
+	if err != nil || h.typ != stData {
+		return c.PacketConn.WriteTo(packet, addr)
+	}
+	c.mu.Lock()
+	c.n++
+	n := c.n
+	if c.drop[n] {
+		c.mu.Unlock()
+		return len(packet), nil
+	}
+	if after, ok := c.hold[n]; ok {
+		c.held[after] = append(c.held[after], heldPacket{append([]byte(nil), packet...), addr})
+		c.mu.Unlock()
+		return len(packet), nil
+	}
+	release := c.held[n]
+	delete(c.held, n)
+	c.mu.Unlock()
+	written, err := c.PacketConn.WriteTo(packet, addr)
+	for _, p := range release {
+		c.PacketConn.WriteTo(p.packet, p.addr)
+	}
+	return written, err
+}
+
+func listen(t *testing.T) *Socket {
+	t.Helper()
+	s, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// connect dials from client to server and returns both ends
+func connect(t *testing.T, client, server *Socket) (dialed, accepted net.Conn) {
+	t.Helper()
+	dialed, err := client.Dial(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialed.Close() })
+	accepted, err = server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accepted.Close() })
+	return dialed, accepted
+}
+
+// transfer writes data on w, closes it and checks that r reads exactly data before io.EOF
+func transfer(t *testing.T, w, r net.Conn, data []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		w.Close()
+		errc <- err
+	}()
+	r.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read after %d bytes: %v", len(got), err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes that differ from the %d written", len(got), len(data))
+	}
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rand.Uint32())
+	}
+	return data
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := listen(t), listen(t)
+	dialed, accepted := connect(t, client, server)
+	if dialed.RemoteAddr().String() != server.Addr().String() {
+		t.Errorf("dialed connection's remote address is %v, want %v", dialed.RemoteAddr(), server.Addr())
+	}
+	if accepted.RemoteAddr().String() != client.Addr().String() {
+		t.Errorf("accepted connection's remote address is %v, want %v", accepted.RemoteAddr(), client.Addr())
+	}
+	// The accepting side may speak first, as a BitTorrent seeder answering a handshake does
+	if _, err := accepted.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	dialed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(dialed, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	client := listen(t)
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	_, err = client.Dial(silent.LocalAddr().String(), 200*time.Millisecond)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Dial to a silent address = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Dial took %v to time out", elapsed)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	client, server := listen(t), listen(t)
+	dialed, accepted := connect(t, client, server)
+	transfer(t, dialed, accepted, randomData(512<<10))
+}
+
+func TestLostAndReorderedPackets(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	faulty := &faultyConn{
+		PacketConn: pc,
+		drop:       map[int]bool{3: true, 10: true, 11: true, 40: true},
+		hold:       map[int]int{5: 8, 20: 21, 30: 45},
+		held:       make(map[int][]heldPacket),
+	}
+	client := NewSocket(faulty)
+	t.Cleanup(func() { client.Close() })
+	server := listen(t)
+	dialed, accepted := connect(t, client, server)
+	transfer(t, dialed, accepted, randomData(100*maxPayload))
+}
+
+func TestClose(t *testing.T) {
+	client, server := listen(t), listen(t)
+	dialed, accepted := connect(t, client, server)
+	transfer(t, dialed, accepted, []byte("last words"))
+
+	if _, err := dialed.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v, want net.ErrClosed", err)
+	}
+	accepted.Close()
+	// Once both FINs are acknowledged neither socket keeps the connection
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client.mu.Lock()
+		n := len(client.conns)
+		client.mu.Unlock()
+		server.mu.Lock()
+		n += len(server.conns)
+		server.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("connections were not removed after both sides closed")
+}
+
+func TestSocketCloseResetsConnections(t *testing.T) {
+	client, server := listen(t), listen(t)
+	_, accepted := connect(t, client, server)
+	server.Close()
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after the socket closed = %v, want net.ErrClosed", err)
+	}
+	if _, err := server.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestHandleOther(t *testing.T) {
+	client, server := listen(t), listen(t)
+	got := make(chan string, 1)
+	server.HandleOther(func(packet []byte, from net.Addr) {
+		if from.String() == client.Addr().String() {
+			got <- string(packet)
+		}
+	})
+	if _, err := client.WriteTo([]byte("\x00not utp"), server.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case packet := <-got:
+		if packet != "\x00not utp" {
+			t.Errorf("handler got %q", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	// uTP keeps working on the shared socket
+	dialed, accepted := connect(t, client, server)
+	transfer(t, dialed, accepted, []byte("still uTP"))
+}
@@ -0,0 +1,152 @@
+// Package verify hashes the pieces of torrent content on a pool of goroutines, so that checking
+// large files uses every CPU and can report progress and be cancelled along the way.
+package verify
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Options tune a check
+type Options struct {
+	Workers  int                   // Pieces hashed at once, 0 for one per CPU
+	Progress func(done, total int) // Called after each piece, on the caller's goroutine. May be nil.
+}
+
+type result struct {
+	index   int
+	sum     [20]byte
+	missing bool // The content ends before the piece does
+	err     error
+}
+
+// Check hashes every piece of r and compares it with hashes. found is called for each piece as
+// soon as it is hashed, in no particular order but always on the caller's goroutine, with ok
+// telling if the piece is present and intact. Content shorter than length only fails the
+// pieces it does not cover. Check returns early with the context's error when ctx is done.
+func Check(ctx context.Context, r io.ReaderAt, hashes [][20]byte, pieceLength, length int, opts Options,
+	found func(index int, ok bool)) error {
+	if want := numPieces(pieceLength, length); want != len(hashes) {
+		return fmt.Errorf("%d piece hashes for %d pieces", len(hashes), want)
+	}
+	return run(ctx, r, pieceLength, length, opts, func(res result) {
+		found(res.index, !res.missing && res.sum == hashes[res.index])
+	})
+}
+
+// Hash returns the hash of every piece of r, which must hold length bytes
+func Hash(ctx context.Context, r io.ReaderAt, pieceLength, length int, opts Options) ([][20]byte, error) {
+	hashes := make([][20]byte, numPieces(pieceLength, length))
+	missing := false
+	err := run(ctx, r, pieceLength, length, opts, func(res result) {
+		hashes[res.index] = res.sum
+		missing = missing || res.missing
+	})
+	if err != nil {
+		return nil, err
+	}
+	if missing {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return hashes, nil
+}
+
+func numPieces(pieceLength, length int) int {
+	if pieceLength <= 0 {
+		return 0
+	}
+	return (length + pieceLength - 1) / pieceLength
+}
+
+// run hashes the pieces on the worker pool and hands each result to each on the caller's goroutine
+func run(ctx context.Context, r io.ReaderAt, pieceLength, length int, opts Options, each func(result)) error {
+	if pieceLength <= 0 {
+		return errors.New("piece length must be positive")
+	}
+	total := numPieces(pieceLength, length)
+	if total == 0 {
+		return nil
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	workers = min(workers, total)
+
+	// Cancelling on return also stops the workers when a read fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int)
+	results := make(chan result, workers)
+	go func() {
+		defer close(indexes)
+		for i := 0; i < total; i++ {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				res := hashPiece(r, buf, index, pieceLength, length)
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	for res := range results {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if res.err != nil {
+			return fmt.Errorf("reading piece %d: %w", res.index, res.err)
+		}
+		each(res)
+		done++
+		if opts.Progress != nil {
+			opts.Progress(done, total)
+		}
+	}
+	if done < total {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func hashPiece(r io.ReaderAt, buf []byte, index, pieceLength, length int) result {
+	begin := index * pieceLength
+	end := min(begin+pieceLength, length)
+	buf = buf[:end-begin]
+	n, err := r.ReadAt(buf, int64(begin))
+	switch {
+	case n == len(buf):
+		// ReadAt may report io.EOF along with the last bytes of the content
+		return result{index: index, sum: sha1.Sum(buf)}
+	case err == io.EOF || err == nil:
+		return result{index: index, missing: true}
+	default:
+		return result{index: index, err: err}
+	}
+}
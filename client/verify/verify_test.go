@@ -0,0 +1,146 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// content returns length bytes of test data
+func content(length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// pieceHashes hashes data the way a torrent does, the last piece being shorter
+func pieceHashes(data []byte, pieceLength int) [][20]byte {
+	hashes := [][20]byte{}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		hashes = append(hashes, sha1.Sum(data[begin:min(begin+pieceLength, len(data))]))
+	}
+	return hashes
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		name        string
+		pieceLength int
+		length      int
+		available   int // Bytes of content actually there
+		wantErr     error
+	}{
+		{"whole pieces", 16, 64, 64, nil},
+		{"short last piece", 16, 70, 70, nil},
+		{"single short piece", 16, 5, 5, nil},
+		{"empty", 16, 0, 0, nil},
+		{"truncated", 16, 70, 60, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := content(tt.length)
+			r := bytes.NewReader(data[:tt.available])
+			got, err := Hash(context.Background(), r, tt.pieceLength, tt.length, Options{Workers: 3})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Hash() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if want := pieceHashes(data, tt.pieceLength); !reflect.DeepEqual(got, want) {
+				t.Errorf("Hash() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	data := content(70)
+	hashes := pieceHashes(data, 16)
+	corrupt := append([]byte(nil), data...)
+	corrupt[20] ^= 0xff
+	tests := []struct {
+		name   string
+		data   []byte
+		hashes [][20]byte
+		want   []bool
+	}{
+		{"intact", data, hashes, []bool{true, true, true, true, true}},
+		{"corrupt piece", corrupt, hashes, []bool{true, false, true, true, true}},
+		{"short last piece missing", data[:68], hashes, []bool{true, true, true, true, false}},
+		{"truncated", data[:40], hashes, []bool{true, true, false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]bool, len(tt.hashes))
+			progress := 0
+			opts := Options{Workers: 2, Progress: func(done, total int) { progress = done }}
+			err := Check(context.Background(), bytes.NewReader(tt.data), tt.hashes, 16, 70, opts,
+				func(index int, ok bool) { got[index] = ok })
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() found %v, want %v", got, tt.want)
+			}
+			if progress != len(tt.hashes) {
+				t.Errorf("progress reached %d, want %d", progress, len(tt.hashes))
+			}
+		})
+	}
+}
+
+func TestCheckWrongHashCount(t *testing.T) {
+	data := content(70)
+	err := Check(context.Background(), bytes.NewReader(data), pieceHashes(data, 16)[1:], 16, 70, Options{},
+		func(int, bool) {})
+	if err == nil {
+		t.Error("Check() accepted 4 hashes for 5 pieces")
+	}
+}
+
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) ReadAt([]byte, int64) (int, error) { return 0, errors.New("disk on fire") }
+
+func TestReadError(t *testing.T) {
+	_, err := Hash(context.Background(), failingReader{}, 16, 70, Options{})
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Hash() error = %v, want the read error", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	data := content(1600)
+	hashes := pieceHashes(data, 16)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Hash(ctx, bytes.NewReader(data), 16, len(data), Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Hash() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	// Cancelling midway stops the check before every piece is reported
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	found := 0
+	opts := Options{Workers: 4, Progress: func(done, total int) {
+		if done == 10 {
+			cancel()
+		}
+	}}
+	err := Check(ctx, bytes.NewReader(data), hashes, 16, len(data), opts, func(int, bool) { found++ })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Check() error = %v, want %v", err, context.Canceled)
+	}
+	if found != 10 {
+		t.Errorf("Check() reported %d pieces after cancelling at 10, want 10", found)
+	}
+}
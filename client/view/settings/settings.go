@@ -0,0 +1,362 @@
+package settings
+
+import (
+	"client/common"
+	"client/lsd"
+	"client/proxy"
+	"client/scheduler"
+	"client/session"
+	"client/torrent"
+	"client/view/viewutils"
+	"client/viewmodel"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// newRateEntry creates an entry showing a rate in KiB/s, empty meaning unlimited
+func newRateEntry(rate int64) *widget.Entry {
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder("Unlimited")
+	if rate > 0 {
+		entry.SetText(strconv.FormatInt(rate/1024, 10))
+	}
+	return entry
+}
+
+// parseRate converts a KiB/s entry into bytes per second
+func parseRate(text string) (int64, bool) {
+	if text == "" {
+		return 0, true
+	}
+	kib, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || kib < 0 {
+		return 0, false
+	}
+	return kib * 1024, true
+}
+
+// newCountEntry creates an entry showing a connection cap, empty meaning unlimited
+func newCountEntry(count int) *widget.Entry {
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder("Unlimited")
+	if count > 0 {
+		entry.SetText(strconv.Itoa(count))
+	}
+	return entry
+}
+
+func parseCount(text string) (int, bool) {
+	if text == "" {
+		return 0, true
+	}
+	count, err := strconv.Atoi(text)
+	if err != nil || count < 0 {
+		return 0, false
+	}
+	return count, true
+}
+
+// formatSchedule writes one rule per line in the form accepted by scheduler.ParseRule
+func formatSchedule(schedule scheduler.Schedule) string {
+	lines := make([]string, len(schedule.Rules))
+	for i, rule := range schedule.Rules {
+		lines[i] = rule.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func parseSchedule(text string, enabled bool) (scheduler.Schedule, error) {
+	schedule := scheduler.Schedule{Enabled: enabled}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := scheduler.ParseRule(line)
+		if err != nil {
+			return scheduler.Schedule{}, err
+		}
+		schedule.Rules = append(schedule.Rules, rule)
+	}
+	return schedule, nil
+}
+
+// HandleSettings shows the session-wide settings dialog
+func HandleSettings() {
+	portEntry := widget.NewEntry()
+	portEntry.SetText(strconv.Itoa(int(common.AppState.Port)))
+	uploadEntry := newRateEntry(common.AppState.UploadRate)
+	downloadEntry := newRateEntry(common.AppState.DownloadRate)
+	peerUploadEntry := newRateEntry(common.AppState.PeerUploadRate)
+	peerDownloadEntry := newRateEntry(common.AppState.PeerDownloadRate)
+	maxConnsEntry := newCountEntry(common.AppState.Connections.Max())
+	maxTorrentConnsEntry := newCountEntry(common.AppState.MaxTorrentConnections)
+	maxHalfOpenEntry := newCountEntry(common.AppState.HalfOpen.Max())
+	maxPerIPEntry := newCountEntry(common.AppState.ConnectionsPerIP.Max())
+	methodSelect := widget.NewSelect([]string{
+		common.EncryptionAES.String(),
+		common.EncryptionMSE.String(),
+		common.EncryptionTLS.String(),
+	}, nil)
+	methodSelect.SetSelected(common.AppState.Encryption.String())
+	msePlaintextCheck := widget.NewCheck("Allow MSE plaintext method", nil)
+	msePlaintextCheck.SetChecked(common.AppState.MSEAllowPlaintext)
+	utpCheck := widget.NewCheck("Use uTP (yields bandwidth to other traffic)", nil)
+	utpCheck.SetChecked(common.AppState.EnableUTP)
+	lsdCheck := widget.NewCheck("Local Service Discovery (find peers on the LAN)", nil)
+	lsdCheck.SetChecked(common.AppState.EnableLSD)
+	lsdIfaceEntry := widget.NewEntry()
+	lsdIfaceEntry.SetPlaceHolder("System default (e.g. eth1)")
+	lsdIfaceEntry.SetText(common.AppState.LSDInterface)
+	verifyIDsCheck := widget.NewCheck("Verify tracker peer IDs in handshakes", nil)
+	verifyIDsCheck.SetChecked(common.AppState.VerifyPeerIDs)
+	pieceFilesCheck := widget.NewCheck("Save new downloads as a folder with one file per piece", nil)
+	pieceFilesCheck.SetChecked(common.AppState.PieceFiles)
+	bindEntry := widget.NewEntry()
+	bindEntry.SetPlaceHolder("Any (e.g. 10.0.0.5 or eth1)")
+	bindEntry.SetText(common.AppState.BindAddress)
+	proxyConfig := common.AppState.Proxy.Config()
+	proxySelect := widget.NewSelect([]string{
+		proxy.None.String(),
+		proxy.SOCKS5.String(),
+		proxy.HTTP.String(),
+	}, nil)
+	proxySelect.SetSelected(proxyConfig.Type.String())
+	proxyAddrEntry := widget.NewEntry()
+	proxyAddrEntry.SetPlaceHolder("host:port")
+	proxyAddrEntry.SetText(proxyConfig.Address)
+	proxyUserEntry := widget.NewEntry()
+	proxyUserEntry.SetText(proxyConfig.Username)
+	proxyPassEntry := widget.NewPasswordEntry()
+	proxyPassEntry.SetText(proxyConfig.Password)
+	proxyOnlyCheck := widget.NewCheck("Refuse direct connections if the proxy is unavailable", nil)
+	proxyOnlyCheck.SetChecked(proxyConfig.Only)
+	ipFilterEntry := widget.NewEntry()
+	ipFilterEntry.SetPlaceHolder("/path/to/ipfilter.dat or blocklist.p2p")
+	ipFilterEntry.SetText(common.AppState.IPFilter.Path())
+	ipFilterStatus := widget.NewLabel(fmt.Sprintf("%d ranges loaded, %d malformed lines skipped, %d connections blocked",
+		common.AppState.IPFilter.Len(), common.AppState.IPFilter.Skipped(), common.AppState.IPFilter.Blocked()))
+	tlsCertEntry := widget.NewEntry()
+	tlsCertEntry.SetPlaceHolder("/path/to/peer.crt")
+	tlsCertEntry.SetText(common.AppState.TLSCertFile)
+	tlsKeyEntry := widget.NewEntry()
+	tlsKeyEntry.SetPlaceHolder("/path/to/peer.key")
+	tlsKeyEntry.SetText(common.AppState.TLSKeyFile)
+	tlsCAEntry := widget.NewEntry()
+	tlsCAEntry.SetPlaceHolder("/path/to/team-ca.crt")
+	tlsCAEntry.SetText(common.AppState.TLSCAFile)
+	scheduleCheck := widget.NewCheck("Enable schedule", nil)
+	scheduleCheck.SetChecked(common.AppState.Schedule.Enabled)
+	scheduleEntry := widget.NewMultiLineEntry()
+	scheduleEntry.SetPlaceHolder("Mon-Fri 09:00-18:00 up=1024 down=1024")
+	scheduleEntry.SetText(formatSchedule(common.AppState.Schedule))
+
+	form := widget.NewForm(
+		widget.NewFormItem("Listen port (restart to apply)", portEntry),
+		widget.NewFormItem("Bind address or interface (restart to apply to listening)", bindEntry),
+		widget.NewFormItem("Upload limit (KiB/s)", uploadEntry),
+		widget.NewFormItem("Download limit (KiB/s)", downloadEntry),
+		widget.NewFormItem("Per-peer upload (KiB/s)", peerUploadEntry),
+		widget.NewFormItem("Per-peer download (KiB/s)", peerDownloadEntry),
+		widget.NewFormItem("Max connections", maxConnsEntry),
+		widget.NewFormItem("Max connections per torrent", maxTorrentConnsEntry),
+		widget.NewFormItem("Max half-open dials", maxHalfOpenEntry),
+		widget.NewFormItem("Max connections per IP", maxPerIPEntry),
+		widget.NewFormItem("Encryption method", methodSelect),
+		widget.NewFormItem("", msePlaintextCheck),
+		widget.NewFormItem("", utpCheck),
+		widget.NewFormItem("", lsdCheck),
+		widget.NewFormItem("LSD interface", lsdIfaceEntry),
+		widget.NewFormItem("", verifyIDsCheck),
+		widget.NewFormItem("", pieceFilesCheck),
+		widget.NewFormItem("Proxy", proxySelect),
+		widget.NewFormItem("Proxy address", proxyAddrEntry),
+		widget.NewFormItem("Proxy username", proxyUserEntry),
+		widget.NewFormItem("Proxy password", proxyPassEntry),
+		widget.NewFormItem("", proxyOnlyCheck),
+		widget.NewFormItem("IP filter file", ipFilterEntry),
+		widget.NewFormItem("", ipFilterStatus),
+		widget.NewFormItem("TLS certificate (PEM)", tlsCertEntry),
+		widget.NewFormItem("TLS private key (PEM)", tlsKeyEntry),
+		widget.NewFormItem("TLS CA certificate (PEM)", tlsCAEntry),
+		widget.NewFormItem("", scheduleCheck),
+		widget.NewFormItem("Schedule (one rule per line)", scheduleEntry),
+	)
+	form.OnSubmit = func() {
+		port, err := strconv.ParseUint(portEntry.Text, 10, 16)
+		if err != nil || port == 0 {
+			viewutils.ShowMessage("Invalid listen port.")
+			return
+		}
+		upload, ok1 := parseRate(uploadEntry.Text)
+		download, ok2 := parseRate(downloadEntry.Text)
+		peerUpload, ok3 := parseRate(peerUploadEntry.Text)
+		peerDownload, ok4 := parseRate(peerDownloadEntry.Text)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			viewutils.ShowMessage("Rate limits must be non-negative integers (KiB/s).")
+			return
+		}
+		maxConns, ok1 := parseCount(maxConnsEntry.Text)
+		maxTorrentConns, ok2 := parseCount(maxTorrentConnsEntry.Text)
+		maxHalfOpen, ok3 := parseCount(maxHalfOpenEntry.Text)
+		maxPerIP, ok4 := parseCount(maxPerIPEntry.Text)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			viewutils.ShowMessage("Connection limits must be non-negative integers.")
+			return
+		}
+		var method common.EncryptionMode
+		if err := method.UnmarshalText([]byte(methodSelect.Selected)); err != nil {
+			viewutils.ShowMessage("Invalid encryption method.")
+			return
+		}
+		proxyType, err := proxy.ParseType(proxySelect.Selected)
+		if err != nil {
+			viewutils.ShowMessage("Invalid proxy type.")
+			return
+		}
+		if proxyType != proxy.None {
+			if _, _, err := net.SplitHostPort(proxyAddrEntry.Text); err != nil {
+				viewutils.ShowMessage("Invalid proxy address, expected host:port.")
+				return
+			}
+		}
+		schedule, err := parseSchedule(scheduleEntry.Text, scheduleCheck.Checked)
+		if err != nil {
+			viewutils.ShowMessage("Invalid schedule: " + err.Error())
+			return
+		}
+		if ipFilterEntry.Text != common.AppState.IPFilter.Path() {
+			if err := common.AppState.IPFilter.Load(ipFilterEntry.Text); err != nil {
+				viewutils.ShowMessage("Invalid IP filter: " + err.Error())
+				return
+			}
+			ipFilterStatus.SetText(fmt.Sprintf("%d ranges loaded, %d malformed lines skipped, %d connections blocked",
+				common.AppState.IPFilter.Len(), common.AppState.IPFilter.Skipped(), common.AppState.IPFilter.Blocked()))
+		}
+		common.AppState.Port = uint16(port)
+		common.AppState.UploadRate = upload
+		common.AppState.DownloadRate = download
+		common.AppState.PeerUploadRate = peerUpload
+		common.AppState.PeerDownloadRate = peerDownload
+		common.AppState.Connections.SetMax(maxConns)
+		common.AppState.MaxTorrentConnections = maxTorrentConns
+		common.AppState.HalfOpen.SetMax(maxHalfOpen)
+		common.AppState.ConnectionsPerIP.SetMax(maxPerIP)
+		common.AppState.Encryption = method
+		common.AppState.MSEAllowPlaintext = msePlaintextCheck.Checked
+		common.AppState.EnableUTP = utpCheck.Checked
+		utpErr := session.ApplyUTP()
+		common.AppState.VerifyPeerIDs = verifyIDsCheck.Checked
+		common.AppState.PieceFiles = pieceFilesCheck.Checked
+		lsdIface := strings.TrimSpace(lsdIfaceEntry.Text)
+		lsdChanged := lsdCheck.Checked != common.AppState.EnableLSD || lsdIface != common.AppState.LSDInterface
+		common.AppState.EnableLSD = lsdCheck.Checked
+		common.AppState.LSDInterface = lsdIface
+		var lsdErr error
+		if lsdChanged {
+			lsd.Stop()
+			if common.AppState.EnableLSD {
+				lsdErr = lsd.Start(common.AppState.Port, common.AppState.LSDInterface)
+			}
+		}
+		common.AppState.Proxy.Configure(proxy.Config{
+			Type:     proxyType,
+			Address:  proxyAddrEntry.Text,
+			Username: proxyUserEntry.Text,
+			Password: proxyPassEntry.Text,
+			Only:     proxyOnlyCheck.Checked,
+		})
+		common.AppState.TLSCertFile = tlsCertEntry.Text
+		common.AppState.TLSKeyFile = tlsKeyEntry.Text
+		common.AppState.TLSCAFile = tlsCAEntry.Text
+		common.AppState.BindAddress = strings.TrimSpace(bindEntry.Text)
+		bindErr := common.ApplyBindAddress()
+		tlsErr := common.LoadTLS()
+		viewmodel.SetSchedule(schedule)
+		if err := common.SaveConfig(); err != nil {
+			viewutils.ShowMessage("Error saving settings: " + err.Error())
+			return
+		}
+		if lsdErr != nil {
+			viewutils.ShowMessage("Settings saved, but local service discovery could not start: " + lsdErr.Error())
+			return
+		}
+		if utpErr != nil {
+			viewutils.ShowMessage("Settings saved, but the uTP socket could not be opened or closed: " + utpErr.Error())
+			return
+		}
+		if bindErr != nil {
+			viewutils.ShowMessage("Settings saved, but torrent connections are refused until the bind address resolves: " + bindErr.Error())
+			return
+		}
+		if tlsErr != nil {
+			viewutils.ShowMessage("Settings saved, but the TLS transport is disabled: " + tlsErr.Error())
+			return
+		}
+		viewutils.ShowMessage("Settings saved. Per-peer and per-torrent limits apply to new connections and torrents.")
+	}
+
+	form.Resize(fyne.NewSize(800, 800))
+	dlg := dialog.NewCustom("Settings", "Close", form, viewutils.MainWindow)
+	dlg.Resize(fyne.NewSize(1000, 800))
+	dlg.Show()
+}
+
+// HandleTorrentLimits shows the rate, connection limit and encryption dialog for a single torrent
+func HandleTorrentLimits(t *torrent.Torrent) {
+	uploadEntry := newRateEntry(t.UploadLimiter.Rate())
+	downloadEntry := newRateEntry(t.DownloadLimiter.Rate())
+	maxConnsEntry := newCountEntry(t.Connections.Max())
+	policySelect := widget.NewSelect([]string{
+		common.PolicyDefault.String(),
+		common.PolicyDisabled.String(),
+		common.PolicyPrefer.String(),
+		common.PolicyRequire.String(),
+	}, nil)
+	policySelect.SetSelected(t.Encryption.String())
+	secretEntry := widget.NewPasswordEntry()
+	secretEntry.SetPlaceHolder("Leave empty for a public torrent")
+	secretEntry.SetText(string(t.Secret))
+
+	form := widget.NewForm(
+		widget.NewFormItem("Upload limit (KiB/s)", uploadEntry),
+		widget.NewFormItem("Download limit (KiB/s)", downloadEntry),
+		widget.NewFormItem("Max connections", maxConnsEntry),
+		widget.NewFormItem("Encryption", policySelect),
+		widget.NewFormItem("Swarm secret", secretEntry),
+	)
+	form.OnSubmit = func() {
+		upload, ok1 := parseRate(uploadEntry.Text)
+		download, ok2 := parseRate(downloadEntry.Text)
+		if !ok1 || !ok2 {
+			viewutils.ShowMessage("Rate limits must be non-negative integers (KiB/s).")
+			return
+		}
+		maxConns, ok := parseCount(maxConnsEntry.Text)
+		if !ok {
+			viewutils.ShowMessage("Connection limit must be a non-negative integer.")
+			return
+		}
+		policy, err := common.ParseEncryptionPolicy(policySelect.Selected)
+		if err != nil {
+			viewutils.ShowMessage("Invalid encryption policy.")
+			return
+		}
+		t.SetRateLimits(upload, download)
+		t.Connections.SetMax(maxConns)
+		t.Encryption = policy
+		if err := t.SetSecret([]byte(secretEntry.Text)); err != nil {
+			viewutils.ShowMessage("Limits saved, but the swarm secret will not survive a restart: " + err.Error())
+		}
+	}
+
+	form.Resize(fyne.NewSize(800, 300))
+	dlg := dialog.NewCustom("Limits for "+t.Name, "Close", form, viewutils.MainWindow)
+	dlg.Resize(fyne.NewSize(1000, 300))
+	dlg.Show()
+}
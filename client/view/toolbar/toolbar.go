@@ -2,15 +2,21 @@ package toolbar
 
 import (
 	"client/common"
+	torrentstorage "client/storage"
 	"client/torrent"
 	"client/torrentfile"
+	"client/view/settings"
 	"client/view/torrentcreate"
 	"client/view/torrentlist"
 	"client/view/viewutils"
 	"client/viewmodel"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/theme"
@@ -36,6 +42,10 @@ func New(tl *torrentlist.TorrentList, seedingList *torrentlist.TorrentList) *wid
 		widget.NewToolbarAction(theme.MediaPlayIcon(), tb.handleResumeTorrent),
 		widget.NewToolbarAction(theme.MediaPauseIcon(), tb.handleStopTorrent),
 		widget.NewToolbarAction(theme.UploadIcon(), tb.handleSeedTorrent), // Add seed button
+		widget.NewToolbarAction(theme.ViewRefreshIcon(), tb.handleForceRecheck),
+		widget.NewToolbarSeparator(),
+		widget.NewToolbarAction(theme.MediaFastForwardIcon(), tb.handleTorrentLimits),
+		widget.NewToolbarAction(theme.SettingsIcon(), settings.HandleSettings),
 	)
 
 	return tb.widget
@@ -93,6 +103,10 @@ func (tb *Toolbar) handleResumeTorrent() {
 		viewutils.ShowMessage("No torrent is selected")
 		return
 	}
+	if _, _, checking := tb.torrentList.Grid.Selected.CheckProgress(); checking {
+		viewutils.ShowMessage("Wait for the check to finish")
+		return
+	}
 	if tb.torrentList.Grid.Selected.Path != "" && tb.torrentList.Grid.Selected.DownloadStatus != nil {
 		tb.torrentList.Grid.Selected.ResumeDownload()
 		tb.torrentList.ForceUpdateDetails()
@@ -101,28 +115,52 @@ func (tb *Toolbar) handleResumeTorrent() {
 	}
 	// If this is a seeding torrent and is paused, start seeding
 	if tb.torrentList.Grid.Selected.IsSeedingPaused {
-		tb.torrentList.Grid.Selected.IsSeedingPaused = false
-		go tb.torrentList.Grid.Selected.StartSeeder()
+		go tb.torrentList.Grid.Selected.ResumeSeeding()
 		tb.torrentList.ForceUpdateDetails()
 		return
 	}
+	// Content kept in a directory, a multi-file torrent's or one saved a file per piece, is a folder
+	t := tb.torrentList.Grid.Selected
+	if layout, _ := t.SavedLayout(); len(t.Files) > 0 || layout == torrentstorage.LayoutPieces {
+		dialog.NewFolderOpen(tb.dialogFolderOpenHandler, viewutils.MainWindow).Show()
+		return
+	}
 	dlg := dialog.NewFileOpen(tb.dialogFileOpenHandler, viewutils.MainWindow)
-	dlg.SetFileName(tb.torrentList.Grid.Selected.Name)
+	dlg.SetFileName(t.Name)
 	dlg.Show()
 }
 
 func (tb *Toolbar) openAndStartTorrent(path string, createIfNotExists bool) {
-	flags := os.O_RDWR
-	if createIfNotExists {
-		flags |= os.O_CREATE
+	t := tb.torrentList.Grid.Selected
+	if !createIfNotExists {
+		if _, err := os.Stat(path); err != nil {
+			dialog.ShowError(err, viewutils.MainWindow)
+			return
+		}
 	}
 
-	fileOutput, err := os.OpenFile(path, flags, 0666)
+	// A new download takes the layout from the settings, existing content keeps the one on disk
+	layout := torrentstorage.DetectLayout(path, t.TorrentFile)
+	if createIfNotExists {
+		layout = torrentstorage.LayoutFiles
+		if common.AppState.PieceFiles {
+			layout = torrentstorage.LayoutPieces
+		}
+	}
+	if createIfNotExists && (layout == torrentstorage.LayoutPieces || len(t.Files) > 0) {
+		// The save dialog leaves an empty file at path, where the content needs a directory
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Size() == 0 {
+			os.Remove(path)
+		}
+	}
+	store, err := torrentstorage.OpenLayout(layout, path, t.TorrentFile)
 	if err != nil {
 		dialog.ShowError(err, viewutils.MainWindow)
 		return
 	}
-	go viewmodel.StartTorrent(tb.torrentList.Grid.Selected, fileOutput)
+	t.Path = path
+	t.Layout = layout
+	go viewmodel.StartTorrent(t, store)
 }
 
 func (tb *Toolbar) dialogFileSaveHandler(u fyne.URIWriteCloser, err error) {
@@ -151,6 +189,17 @@ func (tb *Toolbar) dialogFileOpenHandler(u fyne.URIReadCloser, err error) {
 	tb.openAndStartTorrent(path, false)
 }
 
+func (tb *Toolbar) dialogFolderOpenHandler(u fyne.ListableURI, err error) {
+	if err != nil { // a filesystem error
+		dialog.ShowError(err, viewutils.MainWindow)
+		return
+	}
+	if u == nil { // user pressed "Cancel"
+		return
+	}
+	tb.openAndStartTorrent(u.Path(), false)
+}
+
 func (tb *Toolbar) handleStopTorrent() {
 	if tb.torrentList.Grid.Selected == nil {
 		return
@@ -161,12 +210,57 @@ func (tb *Toolbar) handleStopTorrent() {
 		return
 	}
 	if !tb.torrentList.Grid.Selected.IsSeedingPaused {
-		tb.torrentList.Grid.Selected.IsSeedingPaused = true
+		tb.torrentList.Grid.Selected.PauseSeeding()
 		tb.torrentList.ForceUpdateDetails()
 	}
 
 }
 
+// handleForceRecheck hashes the selected torrent's file again, or cancels the check if one runs
+func (tb *Toolbar) handleForceRecheck() {
+	t := tb.torrentList.Grid.Selected
+	if t == nil {
+		viewutils.ShowMessage("No torrent is selected")
+		return
+	}
+	if t.CancelCheck() {
+		return
+	}
+	if t.Path == "" {
+		viewutils.ShowMessage("Torrent has no file to check yet")
+		return
+	}
+	if t.DownloadStatus != nil && !t.Paused && t.CalculateDownloadPercentage() < 100 {
+		viewutils.ShowMessage("Pause the download before rechecking it")
+		return
+	}
+	if t.SeedingStatus != nil && !t.IsSeedingPaused {
+		viewutils.ShowMessage("Pause seeding before rechecking it")
+		return
+	}
+	go func() {
+		donePieces, err := t.ForceRecheck()
+		tb.torrentList.ForceUpdateDetails()
+		switch {
+		case errors.Is(err, context.Canceled):
+			viewutils.ShowMessage("Recheck cancelled")
+		case err != nil:
+			viewutils.ShowMessage("Recheck failed:\n" + err.Error())
+		default:
+			viewutils.ShowMessage(fmt.Sprintf("Recheck of %s found %d/%d pieces", t.Name, donePieces, len(t.PieceHashes)))
+		}
+	}()
+	tb.torrentList.ForceUpdateDetails()
+}
+
+func (tb *Toolbar) handleTorrentLimits() {
+	if tb.torrentList.Grid.Selected == nil {
+		viewutils.ShowMessage("No torrent is selected")
+		return
+	}
+	settings.HandleTorrentLimits(tb.torrentList.Grid.Selected)
+}
+
 func (tb *Toolbar) handleSeedTorrent() {
 	// Buttons to open file dialogs
 	torrentBtn := widget.NewButton("Choose .torrent", nil)
@@ -192,11 +286,23 @@ func (tb *Toolbar) handleSeedTorrent() {
 		}, viewutils.MainWindow)
 		dlg.Show()
 	}
+	// Multi-file content and content saved a file per piece are directories
+	folderBtn := widget.NewButton("Choose Folder", func() {
+		dialog.NewFolderOpen(func(u fyne.ListableURI, err error) {
+			if err != nil || u == nil {
+				return
+			}
+			fileBtn.SetText(u.Path())
+		}, viewutils.MainWindow).Show()
+	})
+	secretEntry := widget.NewPasswordEntry()
+	secretEntry.SetPlaceHolder("Leave empty for a public torrent")
 
 	form := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: "Torrent file", Widget: torrentBtn},
-			{Text: "File to seed", Widget: fileBtn},
+			{Text: "Content to seed", Widget: container.NewHBox(fileBtn, folderBtn)},
+			{Text: "Swarm secret", Widget: secretEntry},
 		},
 		OnSubmit: func() {
 			torrentPath := torrentBtn.Text
@@ -211,11 +317,18 @@ func (tb *Toolbar) handleSeedTorrent() {
 				return
 			}
 			t, err := torrent.New(&tf, &common.AppState.PeerID, common.AppState.Port)
-			t.Path = filePath // Save the actual file path
 			if err != nil {
 				viewutils.ShowMessage("Failed to create torrent: " + err.Error())
 				return
 			}
+			t.Path = filePath // Save the actual file path
+			t.Layout = torrentstorage.DetectLayout(filePath, &tf)
+			// An empty entry keeps the secret saved for the torrent before, if any
+			if secretEntry.Text != "" {
+				if err := t.SetSecret([]byte(secretEntry.Text)); err != nil {
+					viewutils.ShowMessage("The swarm secret will not survive a restart: " + err.Error())
+				}
+			}
 			t.IsSeedingPaused = true // Mark as paused for seeding
 			tb.seedingList.AddTorrent(t)
 			// Do NOT start seeding here; wait for resume
@@ -3,6 +3,8 @@ package torrentcreate
 import (
 	"client/torrentfile"
 	"client/view/viewutils"
+	"context"
+	"errors"
 	"strconv"
 
 	"fyne.io/fyne/v2"
@@ -86,9 +88,22 @@ func HandleCreateTorrent() {
 				return
 			}
 			torrentPath := writer.URI().Path()
+
+			// Show hashing progress, closing the dialog cancels it
+			ctx, cancel := context.WithCancel(context.Background())
+			progressBar := widget.NewProgressBar()
+			progressDlg := dialog.NewCustom("Hashing "+torrentName, "Cancel", progressBar, viewutils.MainWindow)
+			progressDlg.SetOnClosed(cancel)
+			progressDlg.Show()
+			progress := func(done, total int) {
+				fyne.Do(func() { progressBar.SetValue(float64(done) / float64(total)) })
+			}
 			go func() {
-				err := createAndSaveTorrent(filePath, announce, torrentName, description, pieceLength, torrentPath)
-				if err != nil {
+				err := createAndSaveTorrent(ctx, filePath, announce, torrentName, description, pieceLength, torrentPath, progress)
+				fyne.Do(progressDlg.Hide)
+				if errors.Is(err, context.Canceled) {
+					viewutils.ShowMessage("Torrent creation cancelled")
+				} else if err != nil {
 					viewutils.ShowMessage("Failed to create torrent: " + err.Error())
 				} else {
 					viewutils.ShowMessage("Torrent file created successfully!\n" + torrentPath)
@@ -107,9 +122,10 @@ func HandleCreateTorrent() {
 }
 
 // createAndSaveTorrent creates and saves a .torrent file with metadata and custom piece length using TorrentFile struct
-func createAndSaveTorrent(filePath, announce, torrentName, description string, pieceLength int, torrentPath string) error {
+func createAndSaveTorrent(ctx context.Context, filePath, announce, torrentName, description string, pieceLength int,
+	torrentPath string, progress func(done, total int)) error {
 	// Build TorrentFile struct
-	tf, err := torrentfile.CreateFromFile(filePath, announce, torrentName, description, pieceLength)
+	tf, err := torrentfile.CreateFromFile(ctx, filePath, announce, torrentName, description, pieceLength, progress)
 	if err != nil {
 		return err
 	}
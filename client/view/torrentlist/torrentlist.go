@@ -34,9 +34,14 @@ type Grid struct {
 		Peers            *widget.Label
 		DownloadedHeader *widget.Label
 		Downloaded       *widget.Label
+		Swarm            *widget.Label
 	}
+	swarm string // Tracker counts for the selected torrent
 }
 
+// scrapeInterval is how often the selected torrent's trackers are asked for its swarm counts
+const scrapeInterval = time.Minute
+
 func NewGrid() *Grid {
 	g := &Grid{quit: make(chan struct{})}
 	g.Progress = widget.NewProgressBar()
@@ -92,8 +97,10 @@ func (g *Grid) OnSelect(selected *torrent.Torrent, selectedList *TorrentList) {
 	g.quit = make(chan struct{})
 	ticker := time.NewTicker(500 * time.Millisecond)
 	g.Selected = selected
+	g.swarm = "Asking trackers…"
 	g.Progress.Show()
 	g.updateLabels()
+	go g.scrape(selected, g.quit)
 	go func() {
 		for {
 			select {
@@ -107,6 +114,32 @@ func (g *Grid) OnSelect(selected *torrent.Torrent, selectedList *TorrentList) {
 	}()
 }
 
+// scrape asks the torrent's trackers for its swarm counts until quit is closed
+func (g *Grid) scrape(selected *torrent.Torrent, quit chan struct{}) {
+	ticker := time.NewTicker(scrapeInterval)
+	defer ticker.Stop()
+	for {
+		swarm := "Not reported by the trackers"
+		for _, announce := range selected.AnnounceList {
+			if stats, err := selected.Scrape(announce); err == nil {
+				swarm = fmt.Sprintf("%d seeders, %d leechers, %d downloads", stats.Complete, stats.Incomplete, stats.Downloaded)
+				break
+			}
+		}
+		fyne.Do(func() {
+			if g.Selected == selected {
+				g.swarm = swarm
+				g.labels.Swarm.SetText(swarm)
+			}
+		})
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
 func (g *Grid) OnUnselected() {
 	select {
 	case <-g.quit:
@@ -121,7 +154,7 @@ func (g *Grid) OnUnselected() {
 
 func (g *Grid) updateGrid() {
 	// Create header labels
-	headers := []string{"Name", "Length", "Pieces", "Status", "Peers", "Downloaded"}
+	headers := []string{"Name", "Length", "Pieces", "Status", "Peers", "Downloaded", "Swarm"}
 	var allLabels []fyne.CanvasObject
 
 	// For each field
@@ -146,6 +179,8 @@ func (g *Grid) updateGrid() {
 		case "Downloaded":
 			g.labels.Downloaded = valueLabel
 			g.labels.DownloadedHeader = headerLabel // so it can be changed to sent bytes
+		case "Swarm":
+			g.labels.Swarm = valueLabel
 		}
 		allLabels = append(allLabels, valueLabel)
 	}
@@ -163,6 +198,7 @@ func (g *Grid) updateLabels() {
 		g.labels.Status.SetText("No torrent selected")
 		g.labels.Peers.SetText("No torrent selected")
 		g.labels.Downloaded.SetText("No torrent selected")
+		g.labels.Swarm.SetText("No torrent selected")
 		g.Grid.Refresh()
 		return
 	}
@@ -172,9 +208,15 @@ func (g *Grid) updateLabels() {
 	g.labels.Name.SetText(g.Selected.Name)
 	g.labels.Length.SetText(fmt.Sprintf("%d bytes", g.Selected.Length))
 	g.labels.Pieces.SetText(fmt.Sprintf("%d", len(g.Selected.PieceHashes)))
+	g.labels.Swarm.SetText(g.swarm)
 
-	// Seeding or Downloading status
-	if g.Selected.SeedingStatus != nil {
+	// Checking, Seeding or Downloading status
+	if checked, total, checking := g.Selected.CheckProgress(); checking {
+		g.labels.Status.SetText(fmt.Sprintf("🔍 CHECKING %d/%d", checked, total))
+		g.labels.Status.Importance = widget.MediumImportance
+		g.Progress.SetValue(float64(checked) / float64(max(total, 1)))
+		g.Progress.Show()
+	} else if g.Selected.SeedingStatus != nil {
 		if g.Selected.IsSeedingPaused {
 			g.labels.Status.SetText("⏸️ SEEDING PAUSED")
 			g.labels.Status.Importance = widget.HighImportance
@@ -233,6 +275,13 @@ func (tl *TorrentList) AddTorrent(t *torrent.Torrent) {
 	fyne.Do(tl.Widgets.Refresh)
 }
 
+// All returns a snapshot of the torrents in the list
+func (tl *TorrentList) All() []*torrent.Torrent {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return append([]*torrent.Torrent(nil), tl.Torrents...)
+}
+
 func (tl *TorrentList) ForceUpdateDetails() {
 	fyne.Do(tl.Grid.updateLabels)
 }
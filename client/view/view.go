@@ -2,9 +2,13 @@ package view
 
 import (
 	"client/common"
+	"client/torrent"
 	"client/view/toolbar"
 	"client/view/torrentlist"
 	"client/view/viewutils"
+	"client/viewmodel"
+	"fmt"
+	"log"
 
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
@@ -21,6 +25,11 @@ func CreateMainWindow() {
 	leecherList := torrentlist.New(grid)
 	seedingList := torrentlist.New(grid) // Create a second list for seeding torrents
 
+	// Apply the bandwidth schedule to both lists
+	viewmodel.StartScheduler(func() []*torrent.Torrent {
+		return append(leecherList.All(), seedingList.All()...)
+	})
+
 	// Create toolbar
 	toolbar := toolbar.New(leecherList, seedingList)
 
@@ -44,16 +53,14 @@ func CreateMainWindow() {
 	mainContent := container.NewHSplit(listsContainer, gridWithProgress)
 	mainContent.SetOffset(0.3)
 
-	// Add encryption toggle button in a bottom-right toolbar
+	// Add encryption policy button in a bottom-right toolbar, cycling DISABLED -> PREFER -> REQUIRE.
+	// The method used when encrypting is picked in the settings dialog.
 	encryptionLabel := func() string {
-		if common.AppState.IsTrafficAESEncrypted {
-			return "AES: ON"
-		}
-		return "AES: OFF"
+		return fmt.Sprintf("Encryption: %s (%s)", common.AppState.EncryptionPolicy, common.AppState.Encryption)
 	}
 	var encryptionBtn *widget.Button
 	setEncryptionBtnStyle := func() {
-		if common.AppState.IsTrafficAESEncrypted {
+		if common.AppState.EncryptionPolicy != common.PolicyDisabled {
 			encryptionBtn.Importance = widget.HighImportance
 		} else {
 			encryptionBtn.Importance = widget.MediumImportance
@@ -61,9 +68,12 @@ func CreateMainWindow() {
 	}
 
 	encryptionBtn = widget.NewButton(encryptionLabel(), func() {
-		common.AppState.IsTrafficAESEncrypted = !common.AppState.IsTrafficAESEncrypted
+		common.AppState.EncryptionPolicy = common.AppState.EncryptionPolicy.Next()
 		encryptionBtn.SetText(encryptionLabel())
 		setEncryptionBtnStyle()
+		if err := common.SaveConfig(); err != nil {
+			log.Printf("[View] Failed to save settings: %v", err)
+		}
 	})
 	setEncryptionBtnStyle()
 
@@ -76,4 +86,7 @@ func CreateMainWindow() {
 	viewutils.MainWindow.SetContent(finalContainer)
 	viewutils.MainWindow.Show()
 	viewutils.MainApp.Run()
+
+	// Save where every torrent stands before exiting, downloads still running included
+	viewmodel.CloseTorrents(append(leecherList.All(), seedingList.All()...))
 }
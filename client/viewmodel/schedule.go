@@ -0,0 +1,88 @@
+package viewmodel
+
+import (
+	"client/common"
+	"client/scheduler"
+	"client/torrent"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	sched            *scheduler.Scheduler
+	scheduleMu       sync.Mutex
+	pausedBySchedule = make(map[*torrent.Torrent]bool)
+)
+
+// StartScheduler applies common.AppState.Schedule to the session limits and to the torrents
+// returned by torrents, re-evaluating it periodically
+func StartScheduler(torrents func() []*torrent.Torrent) {
+	sched = scheduler.New(scheduler.SystemClock{}, common.AppState.Schedule, func(rule *scheduler.Rule) {
+		applyScheduleRule(rule, torrents())
+	})
+	go sched.Run(30 * time.Second)
+}
+
+// SetSchedule replaces the schedule and re-applies it, along with the configured session rates
+func SetSchedule(schedule scheduler.Schedule) {
+	common.AppState.Schedule = schedule
+	if sched == nil {
+		applyScheduleRule(nil, nil)
+		return
+	}
+	sched.SetSchedule(schedule)
+}
+
+// applyScheduleRule switches the session limits to the active rule, or back to the
+// configured rates, and pauses or resumes the torrents the rule covers
+func applyScheduleRule(rule *scheduler.Rule, torrents []*torrent.Torrent) {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+
+	upload, download := common.AppState.UploadRate, common.AppState.DownloadRate
+	if rule != nil {
+		log.Printf("[Scheduler] Rule %q is active", rule.String())
+		upload, download = rule.UploadRate, rule.DownloadRate
+	}
+	common.AppState.UploadLimiter.SetRate(upload)
+	common.AppState.DownloadLimiter.SetRate(download)
+
+	for _, t := range torrents {
+		if rule != nil && rule.Pauses(t.InfoHash) {
+			if !pausedBySchedule[t] && pauseTorrent(t) {
+				pausedBySchedule[t] = true
+			}
+		} else if pausedBySchedule[t] {
+			resumeTorrent(t)
+			delete(pausedBySchedule, t)
+		}
+	}
+}
+
+// pauseTorrent pauses a running download or seed, reporting whether anything was paused
+func pauseTorrent(t *torrent.Torrent) bool {
+	if t.SeedingStatus != nil {
+		if t.IsSeedingPaused {
+			return false
+		}
+		t.PauseSeeding()
+		return true
+	}
+	if t.DownloadStatus != nil && !t.Paused && t.CalculateDownloadPercentage() < 100 {
+		t.PauseDownload()
+		return true
+	}
+	return false
+}
+
+func resumeTorrent(t *torrent.Torrent) {
+	if t.SeedingStatus != nil {
+		go t.ResumeSeeding()
+		return
+	}
+	if t.DownloadStatus != nil && t.Paused {
+		// StartDownload announces and unpauses the download itself
+		go StartTorrent(t, nil)
+	}
+}
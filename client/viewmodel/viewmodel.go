@@ -1,18 +1,26 @@
 package viewmodel
 
 import (
+	"client/storage"
 	"client/torrent"
 	"log"
-	"os"
 )
 
-func StartTorrent(t *torrent.Torrent, fileOutput *os.File) {
-	if fileOutput != nil {
-		defer fileOutput.Close()
-	}
-	err := t.StartDownload(fileOutput)
+// StartTorrent downloads t into store, or into the torrent's own storage if store is nil
+func StartTorrent(t *torrent.Torrent, store storage.Storage) {
+	err := t.StartDownload(store)
 	if err != nil {
 		log.Printf("error starting download - %s", err.Error())
 	}
 	// Will automatically be updated to done
 }
+
+// CloseTorrents records the resume data of torrents, so that they are not checked again on the
+// next start, and closes their storage
+func CloseTorrents(torrents []*torrent.Torrent) {
+	for _, t := range torrents {
+		if err := t.Close(); err != nil {
+			log.Printf("error closing %s - %s", t.Name, err.Error())
+		}
+	}
+}
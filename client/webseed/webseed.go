@@ -0,0 +1,189 @@
+// Package webseed downloads torrent content from HTTP servers that mirror the torrent's
+// files (BEP 19).
+package webseed
+
+import (
+	"client/common"
+	"client/ratelimit"
+	"client/torrentfile"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestTimeout bounds each HTTP request, body included
+const RequestTimeout = 60 * time.Second
+
+// MinBackoff is how long a seed rests after its first failure. The delay doubles with every
+// further consecutive failure up to MaxBackoff.
+const MinBackoff = 30 * time.Second
+
+// MaxBackoff is the longest a failing seed rests between attempts
+const MaxBackoff = 10 * time.Minute
+
+// ErrNoRanges is returned when a server answers a range request for anything but the start of
+// a file with the whole file. Reading up to the range would stream the file from its first byte
+// for every piece, so such a seed rests for MaxBackoff instead.
+var ErrNoRanges = errors.New("server does not support range requests")
+
+// Seed is one web seed URL of a torrent
+type Seed struct {
+	URL    string
+	tf     *torrentfile.TorrentFile
+	client *http.Client
+
+	mu       sync.Mutex
+	failures int       // Consecutive failures, reset on success
+	retryAt  time.Time // Zero unless the seed is backing off
+}
+
+// New creates a seed for a url-list entry of tf
+func New(rawURL string, tf *torrentfile.TorrentFile) *Seed {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = common.AppState.Proxy.DialContext
+	if common.AppState.Proxy.Enabled() {
+		transport.Proxy = nil // Our own proxy replaces any from the environment
+	}
+	return &Seed{
+		URL:    rawURL,
+		tf:     tf,
+		client: &http.Client{Timeout: RequestTimeout, Transport: transport},
+	}
+}
+
+// RetryAt returns when the seed may be used again, zero if it is not backing off
+func (s *Seed) RetryAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retryAt
+}
+
+// Failed backs the seed off and returns how long it rests. A server asking for a longer
+// rest through Retry-After gets it.
+func (s *Seed) Failed(now time.Time, err error) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	delay := MinBackoff << min(s.failures-1, 10)
+	if delay > MaxBackoff {
+		delay = MaxBackoff
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+	if errors.Is(err, ErrNoRanges) {
+		delay = MaxBackoff
+	}
+	s.retryAt = now.Add(delay)
+	return delay
+}
+
+// Succeeded resets the backoff
+func (s *Seed) Succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+	s.retryAt = time.Time{}
+}
+
+// StatusError is an unexpected HTTP response
+type StatusError struct {
+	URL        string
+	Status     string
+	RetryAfter time.Duration // From a Retry-After header in seconds, 0 if absent
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("web seed %s: %s", e.URL, e.Status)
+}
+
+// FileURL returns the URL of a file of the torrent on this seed. A URL ending in a slash names
+// a directory holding the content, otherwise it names a single-file torrent's file itself.
+func (s *Seed) FileURL(file int) string {
+	if len(s.tf.Files) == 0 {
+		if strings.HasSuffix(s.URL, "/") {
+			return s.URL + url.PathEscape(s.tf.Name)
+		}
+		return s.URL
+	}
+	u := s.URL
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	u += url.PathEscape(s.tf.Name)
+	for _, part := range s.tf.Files[file].Path {
+		u += "/" + url.PathEscape(part)
+	}
+	return u
+}
+
+// Fetch downloads length bytes at offset into the torrent's content, with one range request
+// per file the bytes span. Reads wait on the given limiters.
+func (s *Seed) Fetch(ctx context.Context, offset, length int, limiters ...*ratelimit.Limiter) ([]byte, error) {
+	buf := make([]byte, 0, length)
+	for _, seg := range s.tf.Segments(offset, length) {
+		data, err := s.fetchRange(ctx, s.FileURL(seg.File), seg.Offset, seg.Length, limiters)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+func (s *Seed) fetchRange(ctx context.Context, fileURL string, offset, length int,
+	limiters []*ratelimit.Limiter) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body := io.Reader(&limitedReader{r: resp.Body, limiters: limiters})
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file, which is only of use when the
+		// range starts the file
+		if offset > 0 {
+			return nil, fmt.Errorf("web seed %s: %w", fileURL, ErrNoRanges)
+		}
+	default:
+		statusErr := &StatusError{URL: fileURL, Status: resp.Status}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			statusErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, statusErr
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("web seed %s: %w", fileURL, err)
+	}
+	return data, nil
+}
+
+// limitedReader waits on every limiter for the bytes it reads
+type limitedReader struct {
+	r        io.Reader
+	limiters []*ratelimit.Limiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for _, limiter := range l.limiters {
+		limiter.WaitN(n)
+	}
+	return n, err
+}
@@ -0,0 +1,147 @@
+package webseed
+
+import (
+	"bytes"
+	"client/common"
+	"client/torrentfile"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	common.InitAppState()
+}
+
+func TestFileURL(t *testing.T) {
+	single := &torrentfile.TorrentFile{Name: "movie one.mkv", Length: 10}
+	multi := &torrentfile.TorrentFile{
+		Name:   "album",
+		Length: 10,
+		Files: []torrentfile.File{
+			{Path: []string{"cd 1", "track#1.flac"}, Length: 5},
+			{Path: []string{"cover.jpg"}, Length: 5},
+		},
+	}
+	tests := []struct {
+		url  string
+		tf   *torrentfile.TorrentFile
+		file int
+		want string
+	}{
+		{"http://example.com/movie.mkv", single, 0, "http://example.com/movie.mkv"},
+		{"http://example.com/files/", single, 0, "http://example.com/files/movie%20one.mkv"},
+		{"http://example.com/files", multi, 0, "http://example.com/files/album/cd%201/track%231.flac"},
+		{"http://example.com/files/", multi, 1, "http://example.com/files/album/cover.jpg"},
+	}
+	for _, tt := range tests {
+		if got := New(tt.url, tt.tf).FileURL(tt.file); got != tt.want {
+			t.Errorf("FileURL(%d) of %s = %s, want %s", tt.file, tt.url, got, tt.want)
+		}
+	}
+}
+
+// serveFiles serves the named files with range support, counting the requests
+func serveFiles(t *testing.T, files map[string][]byte) (*httptest.Server, *atomic.Int32) {
+	requests := new(atomic.Int32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestFetchSpansFiles(t *testing.T) {
+	a := []byte("0123456789")
+	b := []byte("abcdefghij")
+	srv, requests := serveFiles(t, map[string][]byte{"/album/a": a, "/album/dir/b": b})
+	tf := &torrentfile.TorrentFile{
+		Name:   "album",
+		Length: 20,
+		Files: []torrentfile.File{
+			{Path: []string{"a"}, Length: 10},
+			{Path: []string{"empty"}, Length: 0},
+			{Path: []string{"dir", "b"}, Length: 10},
+		},
+	}
+	data, err := New(srv.URL+"/", tf).Fetch(context.Background(), 6, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "6789abcd"; string(data) != want {
+		t.Errorf("Fetch = %q, want %q", data, want)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests, want one per non-empty file", n)
+	}
+}
+
+func TestFetchWithoutRanges(t *testing.T) {
+	content := []byte("0123456789")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content) // Ignores the Range header
+	}))
+	defer srv.Close()
+	seed := New(srv.URL, &torrentfile.TorrentFile{Name: "f", Length: len(content)})
+
+	data, err := seed.Fetch(context.Background(), 0, 4)
+	if err != nil || string(data) != "0123" {
+		t.Errorf("Fetch at the start = %q, %v, want the first bytes", data, err)
+	}
+	_, err = seed.Fetch(context.Background(), 4, 4)
+	if !errors.Is(err, ErrNoRanges) {
+		t.Fatalf("Fetch past the start = %v, want ErrNoRanges", err)
+	}
+	if delay := seed.Failed(time.Now(), err); delay != MaxBackoff {
+		t.Errorf("seed without ranges rests %v, want %v", delay, MaxBackoff)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	seed := New(srv.URL, &torrentfile.TorrentFile{Name: "f", Length: 10})
+	now := time.Now()
+
+	for i, want := range []time.Duration{MinBackoff, 2 * MinBackoff, 4 * MinBackoff} {
+		if delay := seed.Failed(now, errors.New("timeout")); delay != want {
+			t.Errorf("failure %d rests %v, want %v", i+1, delay, want)
+		}
+	}
+	for range 10 {
+		seed.Failed(now, errors.New("timeout"))
+	}
+	if delay := seed.Failed(now, errors.New("timeout")); delay != MaxBackoff {
+		t.Errorf("backoff grew to %v, want it capped at %v", delay, MaxBackoff)
+	}
+
+	seed.Succeeded()
+	if !seed.RetryAt().IsZero() {
+		t.Errorf("RetryAt = %v after success, want zero", seed.RetryAt())
+	}
+
+	_, err := seed.Fetch(context.Background(), 0, 10)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != time.Hour {
+		t.Fatalf("Fetch = %v, want a StatusError with Retry-After of an hour", err)
+	}
+	if delay := seed.Failed(now, err); delay != time.Hour {
+		t.Errorf("seed rests %v, want the server's Retry-After", delay)
+	}
+	if got := seed.RetryAt(); !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("RetryAt = %v, want %v", got, now.Add(time.Hour))
+	}
+}